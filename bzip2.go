@@ -0,0 +1,271 @@
+package tarfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The blocks of a bzip2 stream are compressed independently, but they are not
+// byte aligned and there is no index of them. Blocks are found by searching
+// for the block magic, and each block is decompressed on its own by passing it
+// to `compress/bzip2` as a stream with only that block.
+// The magic can also appear in the compressed data of a block, so a block
+// only ends at a magic if it can be decompressed up to it.
+
+const (
+	bzip2BlockMagic = 0x314159265359
+	bzip2EOSMagic   = 0x177245385090
+	// bzip2Header is the stream header of the blocks which are passed to
+	// `compress/bzip2`, with the largest block size so that every block fits.
+	bzip2Header = 'B'<<24 | 'Z'<<16 | 'h'<<8 | '9'
+	// bzip2MaxBlockBits limits the search for the end of a block to 2MB,
+	// compressed blocks are at most slightly larger than their content.
+	bzip2MaxBlockBits = 16 << 20
+)
+
+// bzip2Reader decompresses a, possibly multi-stream, bzip2 file block by
+// block. It can be started at any block and reports a checkpoint for every
+// block.
+type bzip2Reader struct {
+	br bzip2BitReader
+	// header is set if a stream header is expected next.
+	header bool
+	// next is the magic which ended the previous block, at bit offset `at`.
+	next uint64
+	at   int64
+	out  int64
+	cur  io.Reader
+
+	// onCheckpoint, if set, is called at the start of every block.
+	onCheckpoint func(checkpoint)
+}
+
+// newBzip2Reader creates a bzip2Reader which starts decompressing at the
+// passed in checkpoint, which is either the start of the file or of a block.
+func newBzip2Reader(ra io.ReaderAt, size int64, cp checkpoint) (*bzip2Reader, error) {
+	b := &bzip2Reader{out: cp.out, header: cp.in == 0 && cp.bits == 0}
+	b.br.r = bufio.NewReaderSize(io.NewSectionReader(ra, cp.in, size-cp.in), 64*1024)
+	b.br.off = cp.in * 8
+	if _, err := b.br.readBits(uint(cp.bits)); err != nil {
+		return nil, errors.Wrap(err, "error seeking to bzip2 checkpoint")
+	}
+	return b, nil
+}
+
+func (b *bzip2Reader) Read(p []byte) (int, error) {
+	for {
+		if b.cur == nil {
+			if err := b.nextBlock(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := b.cur.Read(p)
+		b.out += int64(n)
+		if err == io.EOF {
+			b.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// findBlock skips stream headers and trailers up to the next block, and
+// returns the bit offset of the block magic.
+func (b *bzip2Reader) findBlock() (int64, error) {
+	for {
+		if b.header {
+			v, err := b.br.readBits(32)
+			if err != nil {
+				return 0, err
+			}
+			if v>>8 != bzip2Header>>8 || v&0xff < '1' || v&0xff > '9' {
+				return 0, errors.New("invalid bzip2 header")
+			}
+			b.header = false
+		}
+
+		magic, at := b.next, b.at
+		b.next = 0
+		if magic == 0 {
+			at = b.br.off
+			v, err := b.br.readBits(48)
+			if err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			magic = v
+		}
+		switch magic {
+		case bzip2BlockMagic:
+			return at, nil
+		case bzip2EOSMagic:
+			// skip the stream checksum, the next stream starts at a byte
+			// boundary
+			if _, err := b.br.readBits(32); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			b.br.alignByte()
+			b.header = true
+		default:
+			return 0, errors.New("invalid bzip2 block magic")
+		}
+	}
+}
+
+// nextBlock starts decompressing the next block.
+func (b *bzip2Reader) nextBlock() error {
+	start, err := b.findBlock()
+	if err != nil {
+		return err
+	}
+	if b.onCheckpoint != nil {
+		b.onCheckpoint(checkpoint{in: start / 8, bits: uint8(start % 8), out: b.out})
+	}
+
+	var block bzip2BitWriter
+	block.writeBits(bzip2Header, 32)
+	block.writeBits(bzip2BlockMagic, 48)
+	for {
+		magic, err := b.readBlock(&block)
+		if err != nil {
+			return err
+		}
+
+		// The block is followed by the end of the stream, the stream
+		// checksum is the checksum of the only block.
+		stream := bzip2BitWriter{buf: append([]byte{}, block.buf...), n: block.n}
+		stream.writeBits(bzip2EOSMagic, 48)
+		stream.writeBits(block.readBits(32+48, 32), 32)
+		r := bufio.NewReader(bzip2.NewReader(bytes.NewReader(stream.buf)))
+		if _, err := r.Peek(1); err != nil && err != io.EOF {
+			if magic == bzip2BlockMagic && block.n < bzip2MaxBlockBits {
+				// The magic was part of the block.
+				block.writeBits(magic, 48)
+				continue
+			}
+			return errors.Wrap(err, "error decompressing bzip2 block")
+		}
+		b.next, b.at = magic, b.br.off-48
+		b.cur = r
+		return nil
+	}
+}
+
+// readBlock adds the bits up to the next block or end of stream magic to w,
+// and returns the magic.
+// The input is read a byte at a time, with the last 64 bits which were read
+// kept in the bit reader. The magic can end at any of the 8 bits of each byte,
+// the bits before it are copied to w a byte at a time once they can no longer
+// be part of a magic.
+func (b *bzip2Reader) readBlock(w *bzip2BitWriter) (uint64, error) {
+	br := &b.br
+	for {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		br.bits = br.bits<<8 | uint64(c)
+		br.nbits += 8
+		for end := 7; end >= 0; end-- {
+			// `end` is the number of bits of the byte after the magic
+			e := uint(end)
+			if br.nbits < 48+e {
+				continue
+			}
+			magic := br.bits >> e & (1<<48 - 1)
+			if magic != bzip2BlockMagic && magic != bzip2EOSMagic {
+				continue
+			}
+			n := br.nbits - 48 - e
+			w.writeBits(br.bits>>(48+e), n)
+			br.nbits = e
+			br.off += int64(n + 48)
+			return magic, nil
+		}
+		// At least 48 bits are kept, the bits before them were searched.
+		if br.nbits >= 56 {
+			w.writeBits(br.bits>>(br.nbits-8), 8)
+			br.nbits -= 8
+			br.off += 8
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// bzip2BitReader reads the big-endian bit stream of bzip2.
+type bzip2BitReader struct {
+	r *bufio.Reader
+	// off is the offset of the next bit in the file.
+	off   int64
+	bits  uint64
+	nbits uint
+}
+
+// readBits reads up to 56 bits. io.EOF is only returned if the end of the
+// file is at a byte boundary.
+func (b *bzip2BitReader) readBits(n uint) (uint64, error) {
+	for b.nbits < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && b.nbits > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.bits = b.bits<<8 | uint64(c)
+		b.nbits += 8
+	}
+	b.nbits -= n
+	b.off += int64(n)
+	return b.bits >> b.nbits & (1<<n - 1), nil
+}
+
+// alignByte discards any bits left over from the current byte.
+func (b *bzip2BitReader) alignByte() {
+	b.off += int64(b.nbits % 8)
+	b.nbits -= b.nbits % 8
+}
+
+// bzip2BitWriter builds a big-endian bit stream.
+type bzip2BitWriter struct {
+	buf []byte
+	n   int
+}
+
+// writeBits appends the last `n` bits of v, up to 64, a byte at a time.
+func (w *bzip2BitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		free := 8 - uint(w.n%8)
+		if free == 8 {
+			w.buf = append(w.buf, 0)
+		}
+		take := free
+		if n < take {
+			take = n
+		}
+		n -= take
+		w.buf[len(w.buf)-1] |= byte(v>>n&(1<<take-1)) << (free - take)
+		w.n += int(take)
+	}
+}
+
+// readBits returns `n` bits starting at bit `off`.
+func (w *bzip2BitWriter) readBits(off int, n uint) uint64 {
+	var v uint64
+	for i := off; i < off+int(n); i++ {
+		v = v<<1 | uint64(w.buf[i/8]>>(7-uint(i%8))&1)
+	}
+	return v
+}
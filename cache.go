@@ -0,0 +1,409 @@
+package tarfs
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements a block cache for archives which are slow to read,
+// e.g. archives on HTTP servers or compressed archives.
+
+const (
+	defaultCacheBlockSize   = 64 << 10
+	defaultCacheMemoryBytes = 64 << 20
+	defaultCacheReadahead   = 4 << 20
+	// maxReadStreams is the number of sequential reads which are tracked for
+	// readahead, per archive.
+	maxReadStreams = 16
+)
+
+// CacheConfig configures the block cache, see `WithCache`.
+// Zero values are replaced with the defaults.
+type CacheConfig struct {
+	// BlockSize is the size of the blocks which are read and cached, 64KiB by
+	// default.
+	BlockSize int64
+	// MemoryBytes limits the size of the in-memory cache, 64MiB by default.
+	MemoryBytes int64
+	// Dir enables an on-disk cache in the passed in directory, blocks evicted
+	// from memory are moved there.
+	Dir string
+	// DiskBytes limits the size of the on-disk cache.
+	DiskBytes int64
+	// Readahead is the maximum readahead for sequential reads, 4MiB by
+	// default. The readahead starts at one block and is doubled for every
+	// sequential read, negative values disable readahead.
+	Readahead int64
+}
+
+// WithCache puts a block cache in front of the archive, so that repeated
+// reads of the same data don't go to the archive again. This is useful for
+// archives which are slow to read, such as compressed archives or archives
+// read with `HTTPReaderAt`.
+//
+// The cache holds the uncompressed data, and is shared by all layers of a
+// filesystem. The on-disk cache is only used while the server is alive, the
+// cache file is removed right after it is created.
+func WithCache(cfg CacheConfig) Opt {
+	return func(c *config) {
+		c.cache = &cfg
+	}
+}
+
+// NewCachedReaderAt returns a reader which reads from `ra` through a block
+// cache, see `WithCache`.
+func NewCachedReaderAt(ra io.ReaderAt, cfg CacheConfig) (io.ReaderAt, error) {
+	c, err := newBlockCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c.reader(0, ra), nil
+}
+
+// blockKey identifies a block of one of the readers of a cache.
+type blockKey struct {
+	id    int
+	index int64
+}
+
+// cacheEntry is a cached block. The data of the last block of a stream may be
+// shorter than the block size.
+type cacheEntry struct {
+	key  blockKey
+	data []byte
+	// slot is the slot in the cache file for blocks in the disk tier
+	slot int64
+	size int64
+}
+
+// blockCall is a read of a block which is in flight, concurrent reads of the
+// same block wait for it.
+type blockCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// blockCache is an LRU cache of fixed size blocks, with a memory tier and an
+// optional disk tier. Blocks evicted from memory are moved to disk, and moved
+// back to memory when they are read again.
+type blockCache struct {
+	cfg CacheConfig
+
+	mu       sync.Mutex
+	mem      *list.List
+	memIndex map[blockKey]*list.Element
+	memBytes int64
+	disk     *list.List
+	// diskIndex is nil if there is no disk tier
+	diskIndex map[blockKey]*list.Element
+	file      *os.File
+	slots     int64
+	freeSlots []int64
+	inflight  map[blockKey]*blockCall
+}
+
+func newBlockCache(cfg CacheConfig) (*blockCache, error) {
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = defaultCacheBlockSize
+	}
+	if cfg.MemoryBytes <= 0 {
+		cfg.MemoryBytes = defaultCacheMemoryBytes
+	}
+	if cfg.Readahead == 0 {
+		cfg.Readahead = defaultCacheReadahead
+	}
+	c := &blockCache{
+		cfg:      cfg,
+		mem:      list.New(),
+		memIndex: make(map[blockKey]*list.Element),
+		inflight: make(map[blockKey]*blockCall),
+	}
+	if cfg.Dir != "" && cfg.DiskBytes >= cfg.BlockSize {
+		f, err := ioutil.TempFile(cfg.Dir, "tarfs-cache")
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating cache file")
+		}
+		os.Remove(f.Name()) // nolint: errcheck
+		c.file = f
+		c.disk = list.New()
+		c.diskIndex = make(map[blockKey]*list.Element)
+	}
+	return c, nil
+}
+
+// reader returns a reader for `ra` which uses the cache, id must be unique
+// for the readers of a cache.
+func (c *blockCache) reader(id int, ra io.ReaderAt) *cachedReaderAt {
+	return &cachedReaderAt{c: c, id: id, ra: ra}
+}
+
+// get returns a block from the cache, the lock must be held.
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	if e, ok := c.memIndex[key]; ok {
+		c.mem.MoveToFront(e)
+		return e.Value.(*cacheEntry).data, true
+	}
+	e, ok := c.diskIndex[key]
+	if !ok {
+		return nil, false
+	}
+	ce := e.Value.(*cacheEntry)
+	c.disk.Remove(e)
+	delete(c.diskIndex, key)
+	c.freeSlots = append(c.freeSlots, ce.slot)
+
+	data := make([]byte, ce.size)
+	if _, err := c.file.ReadAt(data, ce.slot*c.cfg.BlockSize); err != nil {
+		logrus.WithError(err).Debug("error reading from cache file")
+		return nil, false
+	}
+	c.put(key, data)
+	return data, true
+}
+
+// put adds a block to the memory tier, the lock must be held.
+func (c *blockCache) put(key blockKey, data []byte) {
+	if _, ok := c.memIndex[key]; ok {
+		return
+	}
+	c.memIndex[key] = c.mem.PushFront(&cacheEntry{key: key, data: data})
+	c.memBytes += int64(len(data))
+	for c.memBytes > c.cfg.MemoryBytes {
+		e := c.mem.Back()
+		ce := e.Value.(*cacheEntry)
+		c.mem.Remove(e)
+		delete(c.memIndex, ce.key)
+		c.memBytes -= int64(len(ce.data))
+		c.demote(ce)
+	}
+}
+
+// demote moves a block evicted from memory to the disk tier, if there is
+// one. The lock must be held.
+func (c *blockCache) demote(ce *cacheEntry) {
+	if c.diskIndex == nil {
+		return
+	}
+	var slot int64
+	switch {
+	case len(c.freeSlots) > 0:
+		slot = c.freeSlots[len(c.freeSlots)-1]
+		c.freeSlots = c.freeSlots[:len(c.freeSlots)-1]
+	case c.slots < c.cfg.DiskBytes/c.cfg.BlockSize:
+		slot = c.slots
+		c.slots++
+	default:
+		e := c.disk.Back()
+		old := e.Value.(*cacheEntry)
+		c.disk.Remove(e)
+		delete(c.diskIndex, old.key)
+		slot = old.slot
+	}
+	if _, err := c.file.WriteAt(ce.data, slot*c.cfg.BlockSize); err != nil {
+		logrus.WithError(err).Debug("error writing to cache file")
+		c.freeSlots = append(c.freeSlots, slot)
+		return
+	}
+	c.diskIndex[ce.key] = c.disk.PushFront(&cacheEntry{key: ce.key, slot: slot, size: int64(len(ce.data))})
+}
+
+// blocks returns the blocks from `first` to `last` of a reader. Blocks which
+// are not cached are read with one read per contiguous range of missing
+// blocks, reads of blocks which are already in flight are waited for.
+// Blocks past the end of the stream are empty.
+func (c *blockCache) blocks(r *cachedReaderAt, first, last int64) ([][]byte, error) {
+	blocks := make([][]byte, last-first+1)
+	calls := make([]*blockCall, len(blocks))
+	owned := make([]bool, len(blocks))
+
+	c.mu.Lock()
+	for i := range blocks {
+		key := blockKey{r.id, first + int64(i)}
+		if data, ok := c.get(key); ok {
+			blocks[i] = data
+			continue
+		}
+		call, ok := c.inflight[key]
+		if !ok {
+			call = &blockCall{done: make(chan struct{})}
+			c.inflight[key] = call
+			owned[i] = true
+		}
+		calls[i] = call
+	}
+	c.mu.Unlock()
+
+	for i := 0; i < len(blocks); {
+		if !owned[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(blocks) && owned[j] {
+			j++
+		}
+		c.fetch(r, first+int64(i), calls[i:j])
+		i = j
+	}
+
+	for i, call := range calls {
+		if call == nil {
+			continue
+		}
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		blocks[i] = call.data
+	}
+	return blocks, nil
+}
+
+// fetch reads a contiguous range of blocks, starting at `first`, with a single
+// read and completes the calls for them.
+func (c *blockCache) fetch(r *cachedReaderAt, first int64, calls []*blockCall) {
+	bs := c.cfg.BlockSize
+	buf := make([]byte, int64(len(calls))*bs)
+	n, err := r.ra.ReadAt(buf, first*bs)
+	if err == io.EOF {
+		err = nil
+	}
+
+	c.mu.Lock()
+	for i, call := range calls {
+		key := blockKey{r.id, first + int64(i)}
+		delete(c.inflight, key)
+		if err != nil {
+			call.err = err
+			continue
+		}
+		start, end := int64(i)*bs, int64(i+1)*bs
+		if end > int64(n) {
+			end = int64(n)
+		}
+		if start > end {
+			start = end
+		}
+		call.data = append([]byte(nil), buf[start:end]...)
+		c.put(key, call.data)
+	}
+	c.mu.Unlock()
+
+	for _, call := range calls {
+		close(call.done)
+	}
+}
+
+// cachedReaderAt reads a stream through a block cache.
+type cachedReaderAt struct {
+	c  *blockCache
+	id int
+	ra io.ReaderAt
+
+	mu      sync.Mutex
+	streams []*readStream
+}
+
+// readStream is a sequential read of a stream.
+type readStream struct {
+	// next is the offset the next read is expected at
+	next int64
+	// ahead is the end of the readahead which was started
+	ahead  int64
+	window int64
+}
+
+func (r *cachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	bs := r.c.cfg.BlockSize
+	first, last := off/bs, (off+int64(len(p))-1)/bs
+	blocks, err := r.c.blocks(r, first, last)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for i, data := range blocks {
+		start := int64(0)
+		if i == 0 {
+			start = off - first*bs
+		}
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+		if int64(len(data)) < bs && n < len(p) {
+			return n, io.EOF
+		}
+	}
+
+	r.readahead(off, int64(len(p)))
+	return n, nil
+}
+
+// readahead starts reading the blocks after a sequential read, the readahead
+// window grows with every sequential read.
+func (r *cachedReaderAt) readahead(off, n int64) {
+	max := r.c.cfg.Readahead
+	if max < 0 {
+		return
+	}
+	bs := r.c.cfg.BlockSize
+	end := off + n
+
+	r.mu.Lock()
+	var s *readStream
+	for i, cur := range r.streams {
+		if off >= cur.next-bs && off <= cur.next+bs {
+			s = cur
+			// keep the most recent streams at the front
+			copy(r.streams[1:i+1], r.streams[:i])
+			r.streams[0] = s
+			break
+		}
+	}
+	if s == nil {
+		s = &readStream{next: end, ahead: end}
+		r.streams = append([]*readStream{s}, r.streams...)
+		if len(r.streams) > maxReadStreams {
+			r.streams = r.streams[:maxReadStreams]
+		}
+		r.mu.Unlock()
+		return
+	}
+	s.window *= 2
+	if s.window < bs {
+		s.window = bs
+	}
+	if s.window > max {
+		s.window = max
+	}
+	s.next = end
+	start := s.ahead
+	if start < end {
+		start = end
+	}
+	stop := end + s.window
+	if stop > s.ahead {
+		s.ahead = stop
+	}
+	r.mu.Unlock()
+
+	if start >= stop {
+		return
+	}
+	go func() {
+		if _, err := r.c.blocks(r, start/bs, (stop-1)/bs); err != nil {
+			logrus.WithError(err).WithField("offset", start).Debug("error reading ahead")
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+package tarfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// countingReaderAt counts the reads which go to the underlying reader, reads
+// block while `block` is set.
+type countingReaderAt struct {
+	ra io.ReaderAt
+
+	mu    sync.Mutex
+	reads int
+	block chan struct{}
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.reads++
+	block := r.block
+	r.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return r.ra.ReadAt(p, off)
+}
+
+func (r *countingReaderAt) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads
+}
+
+func readCached(t *testing.T, r io.ReaderAt, data []byte, off, n int64) {
+	p := make([]byte, n)
+	if _, err := r.ReadAt(p, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[off:off+n]) {
+		t.Fatalf("content at %d does not match", off)
+	}
+}
+
+func TestCache(t *testing.T) {
+	data := testData(1050)
+	cr := &countingReaderAt{ra: bytes.NewReader(data)}
+	r, err := NewCachedReaderAt(cr, CacheConfig{BlockSize: 100, MemoryBytes: 2000, Readahead: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readCached(t, r, data, 150, 200)
+	if n := cr.count(); n != 1 {
+		t.Fatalf("expected a single read for contiguous blocks, got %d", n)
+	}
+	readCached(t, r, data, 120, 250)
+	readCached(t, r, data, 300, 10)
+	if n := cr.count(); n != 1 {
+		t.Fatalf("expected cached blocks to be used, got %d reads", n)
+	}
+	readCached(t, r, data, 50, 400)
+	if n := cr.count(); n != 3 {
+		t.Fatalf("expected reads for the missing blocks only, got %d reads", n)
+	}
+
+	p := make([]byte, 100)
+	n, err := r.ReadAt(p, 1000)
+	if n != 50 || err != io.EOF {
+		t.Fatalf("expected 50 bytes and EOF at the end of the stream, got %d, %v", n, err)
+	}
+	if !bytes.Equal(p[:n], data[1000:]) {
+		t.Fatal("content does not match")
+	}
+	if _, err := r.ReadAt(p, 1050); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(1000)
+	cr := &countingReaderAt{ra: bytes.NewReader(data)}
+	// two blocks in memory, five on disk
+	r, err := NewCachedReaderAt(cr, CacheConfig{BlockSize: 100, MemoryBytes: 200, Dir: dir, DiskBytes: 500, Readahead: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := int64(0); off < 1000; off += 100 {
+		readCached(t, r, data, off, 100)
+	}
+	if n := cr.count(); n != 10 {
+		t.Fatalf("expected 10 reads, got %d", n)
+	}
+	readCached(t, r, data, 500, 100)
+	readCached(t, r, data, 300, 100)
+	if n := cr.count(); n != 10 {
+		t.Fatalf("expected blocks to be read from disk, got %d reads", n)
+	}
+	readCached(t, r, data, 0, 100)
+	if n := cr.count(); n != 11 {
+		t.Fatalf("expected evicted block to be read again, got %d reads", n)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected cache file to be removed, found %d files", len(files))
+	}
+}
+
+func TestCacheReadahead(t *testing.T) {
+	data := testData(10000)
+	cr := &countingReaderAt{ra: bytes.NewReader(data)}
+	ra, err := NewCachedReaderAt(cr, CacheConfig{BlockSize: 100, Readahead: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ra.(*cachedReaderAt)
+
+	cached := func(index int64) bool {
+		r.c.mu.Lock()
+		defer r.c.mu.Unlock()
+		_, ok := r.c.memIndex[blockKey{r.id, index}]
+		return ok
+	}
+	waitCached := func(index int64) {
+		for i := 0; !cached(index); i++ {
+			if i == 100 {
+				t.Fatalf("expected block %d to be read ahead", index)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// random reads don't trigger readahead
+	readCached(t, r, data, 5000, 100)
+	readCached(t, r, data, 2000, 100)
+	time.Sleep(10 * time.Millisecond)
+	if cached(51) || cached(21) {
+		t.Fatal("expected no readahead for random reads")
+	}
+
+	readCached(t, r, data, 0, 100)
+	readCached(t, r, data, 100, 100)
+	waitCached(2)
+	readCached(t, r, data, 200, 100)
+	waitCached(4)
+	readCached(t, r, data, 300, 100)
+	// the window is capped at 4 blocks
+	waitCached(7)
+	time.Sleep(10 * time.Millisecond)
+	if cached(8) {
+		t.Fatal("expected readahead to be limited")
+	}
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	data := testData(1000)
+	cr := &countingReaderAt{ra: bytes.NewReader(data), block: make(chan struct{})}
+	r, err := NewCachedReaderAt(cr, CacheConfig{BlockSize: 100, Readahead: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 50)
+			if _, err := r.ReadAt(p, 120); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(p, data[120:170]) {
+				errs <- io.ErrUnexpectedEOF
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(cr.block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := cr.count(); n != 1 {
+		t.Fatalf("expected a single read for concurrent misses, got %d", n)
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	data := testArchive(t, []testEntry{
+		{"file", 0644, string(testData(1000)), nil},
+	})
+	cr := &countingReaderAt{ra: bytes.NewReader(data)}
+	fs, err := FromReaderAt(cr, int64(len(data)), NewBTreeStore(2), WithCache(CacheConfig{BlockSize: 512, Readahead: -1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reads := cr.count()
+	for i := 0; i < 3; i++ {
+		f, status := fs.Open("file", uint32(os.O_RDONLY), &fuse.Context{})
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		p := make([]byte, 1000)
+		rr, status := f.Read(p, 0)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if !bytes.Equal(p, testData(1000)) {
+			t.Fatal("content does not match")
+		}
+		rr.Done()
+	}
+	if n := cr.count() - reads; n != 1 {
+		t.Fatalf("expected file to be read from the archive once, got %d reads", n)
+	}
+}
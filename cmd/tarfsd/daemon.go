@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// readyFDEnv is set for the process started by `daemonize`, to the file
+// descriptor it reports on once the filesystem is mounted.
+const readyFDEnv = "TARFSD_READY_FD"
+
+// readyMessage is reported by the daemon once the filesystem is mounted,
+// anything else is an error.
+const readyMessage = "READY"
+
+var notifyOnce sync.Once
+
+// daemonized returns whether this is the process started by `daemonize`.
+func daemonized() bool {
+	return os.Getenv(readyFDEnv) != ""
+}
+
+// daemonize starts tarfsd again in a new session with the same arguments,
+// and waits until it has mounted the filesystem or failed to.
+// Logs of the daemon keep going to stderr.
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close() // nolint: errcheck
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), readyFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close() // nolint: errcheck
+		return errors.Wrap(err, "error starting daemon")
+	}
+	w.Close() // nolint: errcheck
+
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "error waiting for daemon")
+	}
+	if string(msg) == readyMessage {
+		return cmd.Process.Release()
+	}
+	cmd.Wait() // nolint: errcheck
+	if len(msg) == 0 {
+		return errors.New("daemon exited before the filesystem was mounted")
+	}
+	return errors.New(string(msg))
+}
+
+// notifyReady reports that the filesystem is mounted, to the process which
+// started the daemon, and to systemd if it is started as a notify service.
+func notifyReady() {
+	notify(readyMessage, "READY=1")
+}
+
+// notifyError reports that the filesystem could not be mounted. It returns
+// whether the error was passed to the process which started the daemon,
+// which prints it.
+func notifyError(err error) bool {
+	return notify(err.Error(), "STATUS="+strings.Replace(err.Error(), "\n", " ", -1))
+}
+
+// notify sends the first notification, it returns whether it was sent to the
+// process which started the daemon.
+func notify(msg, systemd string) bool {
+	var sent bool
+	notifyOnce.Do(func() {
+		if daemonized() {
+			f := os.NewFile(3, "ready")
+			if _, err := f.Write([]byte(msg)); err != nil {
+				logrus.WithError(err).Warn("error notifying parent process")
+			} else {
+				sent = true
+			}
+			f.Close() // nolint: errcheck
+		}
+		if sock := os.Getenv("NOTIFY_SOCKET"); sock != "" {
+			if err := sdNotify(sock, systemd); err != nil {
+				logrus.WithError(err).Warn("error notifying systemd")
+			}
+		}
+	})
+	return sent
+}
+
+// sdNotify sends a state to the systemd notify socket, see sd_notify(3).
+func sdNotify(sock, state string) error {
+	if strings.HasPrefix(sock, "@") {
+		// abstract socket
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint: errcheck
+	_, err = conn.Write([]byte(state))
+	return err
+}
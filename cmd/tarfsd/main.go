@@ -1,52 +1,205 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"syscall"
-
-	"fmt"
-
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/cpuguy83/tarfs"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, usage())
+	cmd, args := mount, os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			cmd, args = export, args[1:]
+		case "image":
+			cmd, args = mountImage, args[1:]
+		case "index":
+			cmd, args = index, args[1:]
+		}
+	}
+	if err := cmd(args); err != nil {
+		if !notifyError(err) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		}
 		os.Exit(1)
 	}
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		panic(err)
+}
+
+// newFlags returns the flag set for a command, with the log flags which are
+// accepted by all commands.
+func newFlags(name string) (*flag.FlagSet, *logFlags) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage())
+		flags.PrintDefaults()
 	}
-	defer f.Close() // nolint: errcheck
+	l := &logFlags{}
+	flags.StringVar(&l.level, "log-level", "info", "log level: debug, info, warn or error")
+	flags.StringVar(&l.format, "log-format", "text", "log format: text or json")
+	return flags, l
+}
 
-	logrus.SetLevel(logrus.DebugLevel)
-	formatter := new(logrus.TextFormatter)
-	formatter.FullTimestamp = true
-	logrus.SetFormatter(formatter)
+// parseFlags parses the arguments of a command, which must have `n`
+// positional arguments, and sets up logging.
+func parseFlags(flags *flag.FlagSet, l *logFlags, args []string, n int) {
+	flags.Parse(args) // nolint: errcheck
+	if flags.NArg() != n {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := l.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+type logFlags struct {
+	level  string
+	format string
+}
 
-	db := tarfs.NewBTreeStore(4)
-	tfs, err := tarfs.FromFile(f, db)
+func (l *logFlags) setup() error {
+	level, err := logrus.ParseLevel(l.level)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	logrus.SetLevel(level)
+	switch l.format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log format: %s", l.format)
+	}
+	return nil
+}
+
+// mountFlags are the flags of the commands which mount a filesystem.
+type mountFlags struct {
+	options mountOptions
+	daemon  bool
+	degree  int
+}
+
+func addMountFlags(flags *flag.FlagSet) *mountFlags {
+	m := &mountFlags{options: newMountOptions()}
+	flags.Var(&m.options, "o", "comma separated mount `options`, see above")
+	flags.BoolVar(&m.daemon, "daemon", false, "run in the background once the filesystem is mounted")
+	flags.IntVar(&m.degree, "degree", 4, "degree of the b-tree the metadata is stored in")
+	return m
+}
+
+// start starts the process which mounts the filesystem in the background in
+// daemon mode, and exits once the filesystem is mounted.
+func (m *mountFlags) start() {
+	if !m.daemon || daemonized() {
+		return
 	}
+	if err := daemonize(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
 
-	conn := nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(tfs, nil).Root(), nil)
-	srv, err := fuse.NewServer(conn.RawFS(), os.Args[2], &fuse.MountOptions{
-		Name: "tarfs",
-	})
+// mount mounts a tar file.
+func mount(args []string) error {
+	flags, l := newFlags("tarfsd")
+	m := addMountFlags(flags)
+	indexPath := flags.String("index", "", "mount the archive using an index written by the index command, without reading the archive")
+	digest := flags.String("digest", "", "digest of the archive the index belongs to, without it only the size and a hash of the start and end of the archive are checked")
+	progressive := flags.Bool("progressive", false, "mount the archive right away and index it in the background")
+	parseFlags(flags, l, args, 2)
+	m.start()
+
+	opts := m.options.tarfsOpts()
+	if *digest != "" {
+		opts = append(opts, tarfs.WithDigest(*digest))
+	}
+	if *progressive {
+		opts = append(opts, tarfs.WithProgressiveIndexing())
+	}
+	db := tarfs.NewBTreeStore(m.degree)
+
+	var tfs pathfs.FileSystem
+	if isURL(flags.Arg(0)) {
+		r, err := tarfs.NewHTTPReaderAt(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tarfs.WithCache(tarfs.CacheConfig{}))
+		if *indexPath != "" {
+			tfs, err = tarfs.FromIndex(r, r.Size(), *indexPath, opts...)
+		} else {
+			tfs, err = tarfs.FromReaderAt(r, r.Size(), db, opts...)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close() // nolint: errcheck
+
+		if *indexPath != "" {
+			var st os.FileInfo
+			st, err = f.Stat()
+			if err != nil {
+				return err
+			}
+			tfs, err = tarfs.FromIndex(f, st.Size(), *indexPath, opts...)
+		} else {
+			tfs, err = tarfs.FromFile(f, db, opts...)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", flags.Arg(0))
+		}
+	}
+	return serve(tfs, flags.Arg(1), flags.Arg(0), &m.options)
+}
+
+// isURL returns whether the archive should be read from an HTTP server
+// instead of a local file.
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// serve mounts the filesystem and serves it until it is unmounted.
+// Filesystems are served with the node API, which lets the kernel cache
+// lookups of read-only filesystems. With the `default_permissions` mount
+// option permissions are checked by the kernel, and the filesystem is created
+// with `tarfs.WithDefaultPermissions` by `tarfsOpts`.
+// `source` is used as the name of the filesystem unless it is set in the
+// mount options.
+func serve(tfs pathfs.FileSystem, mountPath, source string, o *mountOptions) error {
+	root, err := tarfs.NewNodeFS(tfs)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	opts := o.nodeOptions(tarfs.NodeOptions(tfs))
+	opts.MountOptions = *o.fuseOptions(source)
+	srv, err := fuse.NewServer(fs.NewNodeFS(root, opts), mountPath, &opts.MountOptions)
+	if err != nil {
+		return errors.Wrapf(err, "error mounting %s", mountPath)
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		for range c {
@@ -56,11 +209,136 @@ func main() {
 		}
 	}()
 
-	srv.Serve()
+	done := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(done)
+	}()
+	if err := srv.WaitMount(); err != nil {
+		return errors.Wrapf(err, "error mounting %s", mountPath)
+	}
+	logrus.WithField("mountpoint", mountPath).Info("filesystem mounted")
+	notifyReady()
+	<-done
+	return nil
+}
+
+// mountImage mounts the root filesystem of an image from an OCI image layout
+// or `docker save` output.
+func mountImage(args []string) error {
+	flags, l := newFlags("image")
+	m := addMountFlags(flags)
+	ref := flags.String("ref", "", "name or digest of the image, can be left out if there is only one image")
+	parseFlags(flags, l, args, 2)
+	m.start()
+
+	img, err := tarfs.OpenImage(flags.Arg(0), *ref)
+	if err != nil {
+		return err
+	}
+	defer img.Close() // nolint: errcheck
+
+	opts := m.options.tarfsOpts()
+	tfs, err := tarfs.FromLayers(img.Layers, tarfs.NewBTreeStore(m.degree), opts...)
+	if err != nil {
+		return err
+	}
+	return serve(tfs, flags.Arg(1), flags.Arg(0), &m.options)
+}
+
+// export writes the filesystem of a tar file, with the changes from an upper
+// dir applied, to a new tar file.
+func export(args []string) error {
+	flags, l := newFlags("export")
+	diff := flags.Bool("diff", false, "only export the changes from the upper dir, with whiteouts for removed files")
+	upper := flags.String("upper", "", "upper dir with the changes to the archive")
+	parseFlags(flags, l, args, 2)
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+
+	var opts []tarfs.Opt
+	if *upper != "" {
+		opts = append(opts, tarfs.WithUpperDir(*upper))
+	}
+	tfs, err := tarfs.FromFile(f, tarfs.NewBTreeStore(4), opts...)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", flags.Arg(0))
+	}
+
+	mode := tarfs.ExportFull
+	if *diff {
+		mode = tarfs.ExportDiff
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if flags.Arg(1) != "-" {
+		out, err = os.Create(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tarfs.Export(tfs, out, mode); err != nil {
+		out.Close() // nolint: errcheck
+		return err
+	}
+	return out.Close()
+}
+
+// index writes an index for an archive, which can be used to mount the
+// archive without reading it.
+func index(args []string) error {
+	flags, l := newFlags("index")
+	digest := flags.String("digest", "", "digest of the archive, which must also be passed when mounting it")
+	parseFlags(flags, l, args, 2)
+
+	var opts []tarfs.Opt
+	if *digest != "" {
+		opts = append(opts, tarfs.WithDigest(*digest))
+	}
+	if isURL(flags.Arg(0)) {
+		r, err := tarfs.NewHTTPReaderAt(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return tarfs.WriteIndex(r, r.Size(), flags.Arg(1), opts...)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return tarfs.WriteIndex(f, st.Size(), flags.Arg(1), opts...)
 }
 
 func usage() string {
 	return fmt.Sprintf(`Usage:
-	%s [TAR FILE PATH] [MOUNT PATH]
+	%[1]s [-o OPTIONS] [-daemon] [-progressive] [-index INDEX PATH] [-digest DIGEST] [TAR FILE PATH OR URL] [MOUNT PATH]
+	%[1]s image [-o OPTIONS] [-daemon] [-ref REF] [IMAGE LAYOUT OR DOCKER SAVE PATH] [MOUNT PATH]
+	%[1]s export [-diff] [-upper DIR] [TAR FILE PATH] [OUTPUT PATH|-]
+	%[1]s index [-digest DIGEST] [TAR FILE PATH OR URL] [INDEX PATH]
+
+Mount options:
+	allow_other         allow other users to access the filesystem
+	default_permissions let the kernel check permissions
+	fsname=NAME         name of the filesystem, defaults to the archive
+	ro                  mount read-only, also if there is an upper dir
+	upperdir=DIR        write changes to DIR, the filesystem is read-only without it
+	uid=N, gid=N        report all files as owned by uid and gid
+	uidmap=C:H:S        map S uids from C in the archive to H on the host
+	gidmap=C:H:S        map S gids from C in the archive to H on the host
+	umask=MASK          clear the permission bits in MASK (octal)
+	entry_timeout=S     seconds the kernel caches names for
+	attr_timeout=S      seconds the kernel caches attributes for
+	negative_timeout=S  seconds the kernel caches missing names for
+Other options are passed to the kernel.
 `, filepath.Base(os.Args[0]))
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/tarfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+)
+
+// mountOptions are the `-o` options of the commands which mount a
+// filesystem, in the style of mount(8). The flag can be passed multiple times.
+type mountOptions struct {
+	allowOther bool
+	// defaultPermissions makes the kernel check permissions instead of the
+	// filesystem
+	defaultPermissions bool
+	fsName             string
+	readOnly           bool
+	upperDir           string
+	// uid and gid are negative if they are not set
+	uid, gid int
+	umask    os.FileMode
+	// uidMap and gidMap are nil if they are not set
+	uidMap, gidMap []tarfs.IDMapping
+	// timeouts are nil if they are not set
+	entryTimeout    *time.Duration
+	attrTimeout     *time.Duration
+	negativeTimeout *time.Duration
+	// other are the options which are passed to the kernel
+	other []string
+}
+
+func newMountOptions() mountOptions {
+	return mountOptions{uid: -1, gid: -1}
+}
+
+func (o *mountOptions) String() string {
+	return ""
+}
+
+func (o *mountOptions) Set(value string) error {
+	for _, opt := range strings.Split(value, ",") {
+		key, val := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "":
+		case "allow_other":
+			o.allowOther = true
+		case "default_permissions":
+			o.defaultPermissions = true
+		case "fsname":
+			o.fsName = val
+		case "ro":
+			o.readOnly = true
+		case "upperdir":
+			o.upperDir = val
+		case "uid":
+			o.uid, err = parseID(val)
+		case "gid":
+			o.gid, err = parseID(val)
+		case "uidmap":
+			o.uidMap, err = parseIDMapping(o.uidMap, val)
+		case "gidmap":
+			o.gidMap, err = parseIDMapping(o.gidMap, val)
+		case "umask":
+			var mask uint64
+			mask, err = strconv.ParseUint(val, 8, 32)
+			if mask&^uint64(os.ModePerm) != 0 {
+				err = errors.New("only permission bits can be masked")
+			}
+			o.umask = os.FileMode(mask)
+		case "entry_timeout":
+			o.entryTimeout, err = parseTimeout(val)
+		case "attr_timeout":
+			o.attrTimeout, err = parseTimeout(val)
+		case "negative_timeout":
+			o.negativeTimeout, err = parseTimeout(val)
+		default:
+			o.other = append(o.other, opt)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid mount option %s", opt)
+		}
+	}
+	return nil
+}
+
+func parseID(s string) (int, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return int(id), err
+}
+
+// parseIDMapping parses a range of ids in the format CONTAINER:HOST:SIZE and
+// adds it to the ranges which are already set.
+func parseIDMapping(ranges []tarfs.IDMapping, s string) ([]tarfs.IDMapping, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return nil, errors.New("expected CONTAINER:HOST:SIZE")
+	}
+	var ids [3]uint32
+	for i, p := range parts {
+		id, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = uint32(id)
+	}
+	return append(ranges, tarfs.IDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}), nil
+}
+
+// parseTimeout parses a timeout in seconds, which may be fractional.
+func parseTimeout(s string) (*time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	if secs < 0 {
+		return nil, errors.New("timeout must not be negative")
+	}
+	d := time.Duration(secs * float64(time.Second))
+	return &d, nil
+}
+
+// tarfsOpts returns the options for the server which implement the mount
+// options.
+func (o *mountOptions) tarfsOpts() []tarfs.Opt {
+	var opts []tarfs.Opt
+	if o.upperDir != "" {
+		opts = append(opts, tarfs.WithUpperDir(o.upperDir))
+	}
+	if o.defaultPermissions {
+		opts = append(opts, tarfs.WithDefaultPermissions())
+	}
+	if o.uidMap != nil || o.gidMap != nil {
+		opts = append(opts, tarfs.WithIDMappings(o.uidMap, o.gidMap))
+	}
+	if o.uid >= 0 || o.gid >= 0 {
+		opts = append(opts, tarfs.WithOwner(o.uid, o.gid))
+	}
+	if o.umask != 0 {
+		opts = append(opts, tarfs.WithUmask(o.umask))
+	}
+	return opts
+}
+
+// fuseOptions returns the options for mounting the filesystem. Filesystems
+// without an upper dir can't be changed, so they are mounted read-only.
+func (o *mountOptions) fuseOptions(source string) *fuse.MountOptions {
+	opts := &fuse.MountOptions{
+		Name:       "tarfs",
+		FsName:     source,
+		AllowOther: o.allowOther,
+	}
+	if o.fsName != "" {
+		opts.FsName = o.fsName
+	}
+	if o.defaultPermissions {
+		opts.Options = append(opts.Options, "default_permissions")
+	}
+	if o.readOnly || o.upperDir == "" {
+		opts.Options = append(opts.Options, "ro")
+	}
+	opts.Options = append(opts.Options, o.other...)
+	return opts
+}
+
+// nodeOptions sets the timeouts from the mount options on opts.
+func (o *mountOptions) nodeOptions(opts *fs.Options) *fs.Options {
+	if o.entryTimeout != nil {
+		opts.EntryTimeout = o.entryTimeout
+	}
+	if o.attrTimeout != nil {
+		opts.AttrTimeout = o.attrTimeout
+	}
+	if o.negativeTimeout != nil {
+		opts.NegativeTimeout = o.negativeTimeout
+	}
+	return opts
+}
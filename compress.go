@@ -0,0 +1,489 @@
+package tarfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// compression is the compression format of an archive.
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionGzip
+	compressionBzip2
+	compressionXz
+	compressionZstd
+)
+
+func (c compression) String() string {
+	switch c {
+	case compressionNone:
+		return "uncompressed"
+	case compressionGzip:
+		return "gzip"
+	case compressionBzip2:
+		return "bzip2"
+	case compressionXz:
+		return "xz"
+	case compressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+const (
+	// defaultCheckpointSpan is the minimum amount of uncompressed data between
+	// checkpoints which need to store a decompression window.
+	defaultCheckpointSpan = 4 << 20
+	// maxIdleDecompressors is the number of open decompressors kept around
+	// so that sequential reads can pick up where the last read left off.
+	maxIdleDecompressors = 4
+
+	zstdMagic          = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50
+	zstdSkippableMask  = 0xFFFFFFF0
+)
+
+var (
+	magicGzip  = []byte{gzipID1, gzipID2}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// detectCompression sniffs the compression format of the archive from the
+// magic bytes at the start of it.
+func detectCompression(ra io.ReaderAt, size int64) (compression, error) {
+	buf := make([]byte, 6)
+	if size < int64(len(buf)) {
+		buf = buf[:size]
+	}
+	if _, err := ra.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return compressionNone, errors.Wrap(err, "error reading archive header")
+	}
+
+	switch {
+	case bytes.HasPrefix(buf, magicGzip):
+		return compressionGzip, nil
+	case bytes.HasPrefix(buf, magicBzip2):
+		return compressionBzip2, nil
+	case bytes.HasPrefix(buf, magicXz):
+		return compressionXz, nil
+	case len(buf) >= 4:
+		magic := binary.LittleEndian.Uint32(buf)
+		if magic == zstdMagic || magic&zstdSkippableMask == zstdSkippableMagic {
+			return compressionZstd, nil
+		}
+	}
+	return compressionNone, nil
+}
+
+// checkpoint is a point in a compressed stream from which decompression can
+// be restarted without decompressing everything before it.
+type checkpoint struct {
+	// in is the offset in the compressed stream.
+	in int64
+	// bits is the number of bits of the byte at `in` which are already
+	// consumed, this is only used for gzip.
+	bits uint8
+	// out is the offset in the uncompressed stream.
+	out int64
+	// window is the uncompressed data preceding the checkpoint which may be
+	// referenced by the data following it, this is only used for gzip.
+	window []byte
+}
+
+// compressedReaderAt is an io.ReaderAt for the uncompressed content of a
+// compressed stream.
+//
+// The checkpoint index is built while the stream is scanned (see `scan`) so
+// that reads at an arbitrary offset only need to decompress from the nearest
+// checkpoint before it.
+// For gzip this is every member and at block boundaries at least `span` bytes
+// apart, for bzip2 and xz every block and for zstd every frame. The state of
+// a zstd decoder can't be restored within a frame, so archives which are
+// compressed as a single zstd frame (or xz block) rely on re-using the
+// decompressor of a previous read.
+type compressedReaderAt struct {
+	ra     io.ReaderAt
+	size   int64
+	format compression
+	span   int64
+
+	mu          sync.Mutex
+	checkpoints []checkpoint
+	idle        []*decompressor
+	// xz are the streams of xz archives, see `xzStreams`.
+	xz []xzStream
+}
+
+// decompressor is an open decompression stream at offset `pos` of the
+// uncompressed data.
+type decompressor struct {
+	io.ReadCloser
+	pos int64
+}
+
+func newCompressedReaderAt(ra io.ReaderAt, size int64, format compression) *compressedReaderAt {
+	return &compressedReaderAt{
+		ra:     ra,
+		size:   size,
+		format: format,
+		span:   defaultCheckpointSpan,
+	}
+}
+
+func (c *compressedReaderAt) addCheckpoint(cp checkpoint) {
+	c.mu.Lock()
+	c.checkpoints = append(c.checkpoints, cp)
+	c.mu.Unlock()
+}
+
+// scan returns a reader for the entire uncompressed stream.
+// Checkpoints are added to the index as the returned reader is consumed.
+func (c *compressedReaderAt) scan() (io.Reader, error) {
+	switch c.format {
+	case compressionGzip:
+		g := newGzipReader(io.NewSectionReader(c.ra, 0, c.size), 0)
+		g.onCheckpoint = c.addCheckpoint
+		g.span = c.span
+		return g, nil
+	case compressionZstd:
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdScanner{ra: c.ra, size: c.size, dec: dec, onCheckpoint: c.addCheckpoint}, nil
+	case compressionBzip2:
+		b, err := newBzip2Reader(c.ra, c.size, checkpoint{})
+		if err != nil {
+			return nil, err
+		}
+		b.onCheckpoint = c.addCheckpoint
+		return b, nil
+	case compressionXz:
+		// The blocks are known from the indexes, the stream is read from
+		// the start so that the indexes are checked against the blocks.
+		streams, err := c.xzStreams()
+		if err != nil {
+			return nil, err
+		}
+		c.addCheckpoint(checkpoint{})
+		for _, s := range streams {
+			for _, b := range s.blocks {
+				if b.out > 0 {
+					c.addCheckpoint(checkpoint{in: b.in, out: b.out})
+				}
+			}
+		}
+		return c.open(checkpoint{})
+	}
+	return nil, errors.Errorf("unsupported compression: %s", c.format)
+}
+
+// xzStreams returns the streams of an xz archive, which are read from the
+// archive the first time.
+func (c *compressedReaderAt) xzStreams() ([]xzStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.xz == nil {
+		streams, err := readXzIndex(c.ra, c.size)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading xz index")
+		}
+		c.xz = streams
+	}
+	return c.xz, nil
+}
+
+// open starts decompressing at the passed in checkpoint.
+func (c *compressedReaderAt) open(cp checkpoint) (io.ReadCloser, error) {
+	switch c.format {
+	case compressionGzip:
+		g, err := resumeGzip(c.ra, c.size, cp)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(g), nil
+	case compressionZstd:
+		dec, err := zstd.NewReader(io.NewSectionReader(c.ra, cp.in, c.size-cp.in), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case compressionBzip2:
+		b, err := newBzip2Reader(c.ra, c.size, cp)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(b), nil
+	case compressionXz:
+		r, err := c.openXz(cp)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, errors.Errorf("unsupported compression: %s", c.format)
+}
+
+// openXz starts decompressing an xz archive at the start or at a block.
+func (c *compressedReaderAt) openXz(cp checkpoint) (io.Reader, error) {
+	if cp.in == 0 {
+		return xz.NewReader(io.NewSectionReader(c.ra, 0, c.size))
+	}
+	streams, err := c.xzStreams()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		i := sort.Search(len(s.blocks), func(i int) bool {
+			return s.blocks[i].in >= cp.in
+		})
+		if i < len(s.blocks) && s.blocks[i].in == cp.in {
+			// The streams after this one are read as they are.
+			rest := io.NewSectionReader(c.ra, s.end, c.size-s.end)
+			return xz.NewReader(io.MultiReader(s.tail(c.ra, i), rest))
+		}
+	}
+	return nil, errors.Errorf("no xz block at offset %d", cp.in)
+}
+
+// nearest returns the last checkpoint at or before the passed in offset.
+func (c *compressedReaderAt) nearest(off int64) (checkpoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := sort.Search(len(c.checkpoints), func(i int) bool {
+		return c.checkpoints[i].out > off
+	})
+	if i == 0 {
+		return checkpoint{}, false
+	}
+	return c.checkpoints[i-1], true
+}
+
+// takeIdle returns the idle decompressor closest to `off` which does not
+// need to go backwards and is past `min`.
+func (c *compressedReaderAt) takeIdle(min, off int64) *decompressor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	best := -1
+	for i, d := range c.idle {
+		if d.pos < min || d.pos > off {
+			continue
+		}
+		if best == -1 || d.pos > c.idle[best].pos {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	d := c.idle[best]
+	c.idle = append(c.idle[:best], c.idle[best+1:]...)
+	return d
+}
+
+func (c *compressedReaderAt) putIdle(d *decompressor) {
+	c.mu.Lock()
+	c.idle = append(c.idle, d)
+	var evict *decompressor
+	if len(c.idle) > maxIdleDecompressors {
+		evict = c.idle[0]
+		c.idle = c.idle[1:]
+	}
+	c.mu.Unlock()
+
+	if evict != nil {
+		evict.Close() // nolint: errcheck
+	}
+}
+
+func (c *compressedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	cp, ok := c.nearest(off)
+	if !ok {
+		return 0, errors.Errorf("no checkpoint for offset %d", off)
+	}
+
+	d := c.takeIdle(cp.out, off)
+	if d == nil {
+		rc, err := c.open(cp)
+		if err != nil {
+			return 0, err
+		}
+		d = &decompressor{ReadCloser: rc, pos: cp.out}
+	}
+
+	if skip := off - d.pos; skip > 0 {
+		n, err := io.CopyN(ioutil.Discard, d, skip)
+		d.pos += n
+		if err != nil {
+			d.Close() // nolint: errcheck
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(d, p)
+	d.pos += int64(n)
+	switch err {
+	case nil:
+		c.putIdle(d)
+	case io.ErrUnexpectedEOF:
+		err = io.EOF
+		fallthrough
+	default:
+		d.Close() // nolint: errcheck
+	}
+	return n, err
+}
+
+// zstdScanner decompresses a zstd stream frame by frame, adding a checkpoint
+// at the start of each frame.
+type zstdScanner struct {
+	ra   io.ReaderAt
+	size int64
+	dec  *zstd.Decoder
+
+	// next is the offset of the next frame
+	next int64
+	out  int64
+	cur  io.Reader
+
+	onCheckpoint func(checkpoint)
+}
+
+func (z *zstdScanner) Read(p []byte) (int, error) {
+	for {
+		if z.cur == nil {
+			if z.next >= z.size {
+				return 0, io.EOF
+			}
+			start := z.next
+			length, skippable, err := zstdFrameSize(z.ra, start, z.size)
+			if err != nil {
+				return 0, err
+			}
+			z.next += length
+			if skippable {
+				continue
+			}
+			if err := z.dec.Reset(io.NewSectionReader(z.ra, start, length)); err != nil {
+				return 0, errors.Wrap(err, "error reading zstd frame")
+			}
+			z.onCheckpoint(checkpoint{in: start, out: z.out})
+			z.cur = z.dec
+		}
+
+		n, err := z.cur.Read(p)
+		z.out += int64(n)
+		if err == io.EOF {
+			z.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// zstdFrameSize determines the size of the compressed zstd frame at `off`
+// by walking its block headers, which means nothing needs to be decompressed.
+func zstdFrameSize(ra io.ReaderAt, off, size int64) (int64, bool, error) {
+	var buf [14]byte
+	hdr := buf[:]
+	if size-off < int64(len(hdr)) {
+		hdr = hdr[:size-off]
+	}
+	if _, err := ra.ReadAt(hdr, off); err != nil && err != io.EOF {
+		return 0, false, errors.Wrap(err, "error reading zstd frame header")
+	}
+	if len(hdr) < 8 {
+		return 0, false, errors.New("truncated zstd frame")
+	}
+
+	magic := binary.LittleEndian.Uint32(hdr)
+	if magic&zstdSkippableMask == zstdSkippableMagic {
+		return 8 + int64(binary.LittleEndian.Uint32(hdr[4:])), true, nil
+	}
+	if magic != zstdMagic {
+		return 0, false, errors.New("invalid zstd frame magic")
+	}
+
+	desc := hdr[4]
+	fcsFlag := desc >> 6
+	singleSegment := desc&(1<<5) != 0
+	checksum := desc&(1<<2) != 0
+
+	n := int64(5)
+	if !singleSegment {
+		n++
+	}
+	n += [4]int64{0, 1, 2, 4}[desc&3]
+	switch fcsFlag {
+	case 0:
+		if singleSegment {
+			n++
+		}
+	case 1:
+		n += 2
+	case 2:
+		n += 4
+	case 3:
+		n += 8
+	}
+
+	var bh [3]byte
+	for {
+		if _, err := ra.ReadAt(bh[:], off+n); err != nil {
+			return 0, false, errors.Wrap(err, "error reading zstd block header")
+		}
+		v := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+		last := v&1 == 1
+		blockSize := int64(v >> 3)
+		n += 3
+		switch (v >> 1) & 3 {
+		case 0, 2: // raw, compressed
+			n += blockSize
+		case 1: // rle
+			n++
+		default:
+			return 0, false, errors.New("invalid zstd block type")
+		}
+		if last {
+			break
+		}
+	}
+	if checksum {
+		n += 4
+	}
+	if off+n > size {
+		return 0, false, errors.New("truncated zstd frame")
+	}
+	return n, false, nil
+}
+
+// countingReader keeps track of how much data has been read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) pos() (int64, error) {
+	return c.n, nil
+}
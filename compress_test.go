@@ -0,0 +1,315 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// testData generates data with a mix of compressible and random content.
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, size)
+	words := [][]byte{[]byte("foo "), []byte("bar "), []byte("baz "), []byte("quux\n")}
+	for len(data) < size {
+		if rnd.Intn(4) == 0 {
+			chunk := make([]byte, rnd.Intn(512))
+			rnd.Read(chunk)
+			data = append(data, chunk...)
+			continue
+		}
+		data = append(data, words[rnd.Intn(len(words))]...)
+	}
+	return data[:size]
+}
+
+func TestInflate(t *testing.T) {
+	data := testData(1 << 20)
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression, flate.HuffmanOnly} {
+		buf := bytes.NewBuffer(nil)
+		w, err := flate.NewWriter(buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+
+		f := &inflater{br: &bitReader{r: bytes.NewReader(buf.Bytes())}}
+		out, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("level %d: decompressed data does not match", level)
+		}
+	}
+}
+
+func gzipMembers(t *testing.T, data []byte, members int) []byte {
+	buf := bytes.NewBuffer(nil)
+	chunk := len(data) / members
+	for i := 0; i < members; i++ {
+		end := (i + 1) * chunk
+		if i == members-1 {
+			end = len(data)
+		}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data[i*chunk : end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func zstdFrames(t *testing.T, data []byte, frames int) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	var out []byte
+	chunk := len(data) / frames
+	for i := 0; i < frames; i++ {
+		end := (i + 1) * chunk
+		if i == frames-1 {
+			end = len(data)
+		}
+		out = enc.EncodeAll(data[i*chunk:end], out)
+	}
+	return out
+}
+
+// xzStreams compresses data with xz, as multiple streams with padding between
+// them and with blocks of at most blockSize bytes.
+func xzStreams(t *testing.T, data []byte, streams int, blockSize int64) []byte {
+	buf := bytes.NewBuffer(nil)
+	chunk := len(data) / streams
+	for i := 0; i < streams; i++ {
+		end := (i + 1) * chunk
+		if i == streams-1 {
+			end = len(data)
+		}
+		if i > 0 {
+			buf.Write(make([]byte, 4))
+		}
+		w, err := xz.WriterConfig{BlockSize: blockSize}.NewWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data[i*chunk : end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// bzip2Streams compresses data with the bzip2 command as multiple streams,
+// with the smallest block size. It returns nil if bzip2 is not installed.
+func bzip2Streams(t *testing.T, data []byte, streams int) []byte {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	chunk := len(data) / streams
+	for i := 0; i < streams; i++ {
+		end := (i + 1) * chunk
+		if i == streams-1 {
+			end = len(data)
+		}
+		cmd := exec.Command("bzip2", "-1", "-c")
+		cmd.Stdin = bytes.NewReader(data[i*chunk : end])
+		cmd.Stdout = buf
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedReaderAt(t *testing.T) {
+	data := testData(4 << 20)
+
+	// xz and bzip2 compression is slow, so use a smaller amount of data for
+	// them.
+	xzData := data[:256*1024]
+	bzip2Data := data[:1<<20]
+
+	for _, tc := range []struct {
+		name        string
+		format      compression
+		data        []byte
+		compressed  []byte
+		checkpoints int
+	}{
+		{"gzip", compressionGzip, data, gzipMembers(t, data, 1), 4},
+		{"gzip multi-member", compressionGzip, data, gzipMembers(t, data, 3), 5},
+		{"zstd", compressionZstd, data, zstdFrames(t, data, 1), 1},
+		{"zstd multi-frame", compressionZstd, data, zstdFrames(t, data, 8), 8},
+		{"xz", compressionXz, xzData, xzStreams(t, xzData, 1, 0), 1},
+		{"xz multi-block", compressionXz, xzData, xzStreams(t, xzData, 1, 32*1024), 8},
+		{"xz multi-stream", compressionXz, xzData, xzStreams(t, xzData, 3, 32*1024), 9},
+		{"bzip2", compressionBzip2, bzip2Data, bzip2Streams(t, bzip2Data, 1), 8},
+		{"bzip2 multi-stream", compressionBzip2, bzip2Data, bzip2Streams(t, bzip2Data, 3), 10},
+	} {
+		data := tc.data
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.compressed == nil {
+				t.Skip("bzip2 is not installed")
+			}
+			ra := bytes.NewReader(tc.compressed)
+			format, err := detectCompression(ra, ra.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.format {
+				t.Fatalf("expected format %s, got %s", tc.format, format)
+			}
+
+			cra := newCompressedReaderAt(ra, ra.Size(), format)
+			cra.span = 1 << 20
+			stream, err := cra.scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatal("scanned data does not match")
+			}
+			if len(cra.checkpoints) < tc.checkpoints {
+				t.Fatalf("expected at least %d checkpoints, got %d", tc.checkpoints, len(cra.checkpoints))
+			}
+
+			// Checkpoints loaded from an index work without scanning the
+			// stream first.
+			loaded := newCompressedReaderAt(ra, ra.Size(), format)
+			loaded.checkpoints = cra.checkpoints
+
+			rnd := rand.New(rand.NewSource(2))
+			for _, cra := range []*compressedReaderAt{cra, loaded} {
+				for i := 0; i < 50; i++ {
+					off := rnd.Int63n(int64(len(data)))
+					p := make([]byte, rnd.Intn(64*1024))
+					n, err := cra.ReadAt(p, off)
+					if err != nil && err != io.EOF {
+						t.Fatal(err)
+					}
+					if err == nil && n != len(p) {
+						t.Fatalf("short read without error: %d != %d", n, len(p))
+					}
+					if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+						t.Fatalf("data at offset %d does not match", off)
+					}
+				}
+
+				p := make([]byte, 10)
+				n, err := cra.ReadAt(p, int64(len(data))-5)
+				if err != io.EOF || n != 5 {
+					t.Fatalf("expected EOF after 5 bytes, got %d: %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCorruptGzip(t *testing.T) {
+	compressed := gzipMembers(t, testData(1<<16), 1)
+	// flip a bit in the crc
+	compressed[len(compressed)-6] ^= 1
+
+	ra := bytes.NewReader(compressed)
+	cra := newCompressedReaderAt(ra, ra.Size(), compressionGzip)
+	stream, err := cra.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(stream); err == nil {
+		t.Fatal("expected checksum error")
+	}
+}
+
+// bzip2Tar is a tar archive with a single file, "hello", containing
+// "hello bzip2\n" compressed with bzip2.
+const bzip2Tar = "425a6839314159265359727a0e01000070fb80ca9001004000758000087264de1008082000542528c81a340018f54125353434d19000347dc5c32105af42112ea701d1858810e09b1193c5538464cc571f70d625bb5ce7128787097c4c2724a8b36660fc5dc914e14241c9e83804"
+
+func TestFromReaderAtCompressed(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	data := testData(1 << 20)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"foo", []byte("hello")},
+		{"bar", data},
+		{"baz", []byte("world")},
+	} {
+		if err := w.WriteHeader(newTestHeader(f.name, 0644, int64(len(f.data)), time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	bz, err := hex.DecodeString(bzip2Tar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		compressed []byte
+		file       string
+		expected   []byte
+	}{
+		{"gzip", gzipMembers(t, buf.Bytes(), 1), "bar", data},
+		{"zstd", zstdFrames(t, buf.Bytes(), 4), "bar", data},
+		{"bzip2", bz, "hello", []byte("hello bzip2\n")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rdr := bytes.NewReader(tc.compressed)
+			fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, status := fs.Open(tc.file, uint32(os.O_RDONLY), &fuse.Context{})
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			p := make([]byte, len(tc.expected))
+			rr, status := f.Read(p, 0)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			if !bytes.Equal(p, tc.expected) {
+				t.Fatalf("unexpected content for %s", tc.file)
+			}
+			rr.Done()
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/google/btree"
 	"github.com/sirupsen/logrus"
@@ -11,6 +12,7 @@ import (
 
 // MetadataStore is an abstraction for implementing different storages for
 // filesystem metadata.
+// Implementations must be safe for concurrent use.
 // This is used to insert or delete file metadata based on a key (typically the file path).
 // It is also used to get the entries for a particular directory.
 // TODO: Maybe `Entries()` isn't right here
@@ -20,6 +22,50 @@ type MetadataStore interface {
 	Entries(string) []FileInfo
 }
 
+// Usage is the space used by the entries of a metadata store.
+type Usage struct {
+	// Entries is the number of entries, including directories.
+	Entries uint64
+	// Bytes is the size of the file content, with each file rounded up to the
+	// block size of the archive. Hard links and holes of sparse files don't
+	// use any space.
+	Bytes uint64
+}
+
+func (u *Usage) add(o Usage) {
+	u.Entries += o.Entries
+	u.Bytes += o.Bytes
+}
+
+func (u *Usage) sub(o Usage) {
+	u.Entries -= o.Entries
+	u.Bytes -= o.Bytes
+}
+
+// UsageCounter can be implemented by a MetadataStore which keeps track of the
+// space used by its entries as they are added, for reporting filesystem
+// statistics. The usage of other stores is computed when it is first needed.
+type UsageCounter interface {
+	Usage() Usage
+}
+
+// entryUsage returns the space used by a single entry. Whiteouts replace the
+// entry they remove, so they don't use any space.
+func entryUsage(fi FileInfo) Usage {
+	if fi == nil || isWhiteout(fi) {
+		return Usage{}
+	}
+	n := asNode(fi)
+	switch {
+	case n == nil:
+		return Usage{Entries: 1, Bytes: uint64(blockAlign(storedSize(fi)))}
+	case n.stat == nil, n.hardlink != "":
+		// directories which were not indexed yet and hard links
+		return Usage{Entries: 1}
+	}
+	return Usage{Entries: 1, Bytes: uint64(blockAlign(storedSize(n)))}
+}
+
 // stringKey is used to wrap FileInfo metadata and sort keys for the B-Tree.
 type stringKey struct {
 	key  string
@@ -27,15 +73,20 @@ type stringKey struct {
 }
 
 func (k *stringKey) Less(other btree.Item) bool {
-	keyCount := strings.Count(k.key, "/")
-	oKey := other.(*stringKey)
-	oCount := strings.Count(oKey.key, "/")
+	return keyLess(k.key, other.(*stringKey).key)
+}
+
+// keyLess sorts keys by depth first, so the entries of a directory are next
+// to each other.
+func keyLess(a, b string) bool {
+	keyCount := strings.Count(a, "/")
+	oCount := strings.Count(b, "/")
 
 	if keyCount < oCount {
 		return true
 	}
 	if keyCount == oCount {
-		return k.key < oKey.key
+		return a < b
 	}
 	return false
 }
@@ -49,7 +100,9 @@ func NewBTreeStore(degree int) MetadataStore {
 }
 
 type btreeStore struct {
-	db *btree.BTree
+	mu    sync.RWMutex
+	db    *btree.BTree
+	usage Usage
 }
 
 func (s *btreeStore) Add(key string, fi FileInfo) error {
@@ -58,10 +111,21 @@ func (s *btreeStore) Add(key string, fi FileInfo) error {
 		key:  key,
 		info: fi,
 	}
-	s.db.ReplaceOrInsert(sk)
+	s.mu.Lock()
+	if old := s.db.ReplaceOrInsert(sk); old != nil {
+		s.usage.sub(entryUsage(old.(*stringKey).info))
+	}
+	s.usage.add(entryUsage(fi))
+	s.mu.Unlock()
 	return nil
 }
 
+func (s *btreeStore) Usage() Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usage
+}
+
 func (s *btreeStore) Get(key string) FileInfo {
 	logrus.WithField("key", key).Debug("store.Get")
 	var info FileInfo
@@ -70,7 +134,9 @@ func (s *btreeStore) Get(key string) FileInfo {
 	sk := &stringKey{
 		key: key,
 	}
+	s.mu.RLock()
 	i := s.db.Get(sk)
+	s.mu.RUnlock()
 	if i == nil {
 		return nil
 	}
@@ -88,6 +154,9 @@ func (s *btreeStore) Entries(key string) []FileInfo {
 	logrus.WithField("key", key).Debug("Entries")
 	defer logrus.WithField("key", key).Debug("end Entries")
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	i := s.db.Get(&stringKey{key: key})
 	if i == nil {
 		panic("non-existent key")
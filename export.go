@@ -0,0 +1,346 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+)
+
+// ExportMode selects what is written by `Export`.
+type ExportMode int
+
+const (
+	// ExportFull writes the complete filesystem, including the unchanged
+	// entries from the archive.
+	ExportFull ExportMode = iota
+	// ExportDiff only writes the entries which were changed. Removed entries
+	// are written as OCI style whiteouts, so the result can be used as a layer
+	// on top of the original archive.
+	ExportDiff
+)
+
+// Export writes the filesystem, which must have been created by this package,
+// as a tar archive.
+// Unchanged entries are copied from the original archive as-is, which keeps
+// their order and any PAX records intact. Changed and new entries are added
+// from the upper dir.
+//
+// The filesystem should not be modified while it is exported.
+func Export(fs pathfs.FileSystem, w io.Writer, mode ExportMode) error {
+	s, ok := fs.(*server)
+	if !ok {
+		return errors.New("filesystem is not served by tarfs")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := &exporter{
+		s:       s,
+		w:       w,
+		tw:      tar.NewWriter(w),
+		written: make(map[string]struct{}),
+		links:   make(map[uint64]string),
+	}
+	if mode == ExportFull {
+		if err := e.writeArchive(); err != nil {
+			return err
+		}
+	}
+	if s.upper != nil {
+		if err := e.writeUpper(mode == ExportDiff); err != nil {
+			return err
+		}
+	}
+	return e.tw.Close()
+}
+
+type exporter struct {
+	s  *server
+	w  io.Writer
+	tw *tar.Writer
+
+	// written tracks the entries from the upper dir which are already written
+	written map[string]struct{}
+	// links maps the inode of files in the upper dir to the first name
+	// written for it, so the other names can be written as hard links.
+	links map[uint64]string
+}
+
+type exportEntry struct {
+	name string
+	n    *node
+}
+
+// writeArchive writes the entries of the archive which were not removed, in
+// the order of the original archive.
+// Entries which were changed are replaced by the version in the upper dir.
+func (e *exporter) writeArchive() error {
+	var entries []exportEntry
+	e.collect("", &entries)
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].n, entries[j].n
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		return a.header < b.header
+	})
+
+	for _, entry := range entries {
+		n := entry.n
+		toc := e.s.layers[n.layer].toc
+		switch {
+		case n.length == 0 && !toc, toc && entry.name == "":
+			// The root entry added when the archive does not have one.
+			continue
+		case entry.name != "" && e.s.inUpper(entry.name):
+			if err := e.writeUpperEntry(entry.name); err != nil {
+				return err
+			}
+		case n.hardlink != "" && e.linkChanged(n):
+			// The file this was linked to has changed, but this entry still
+			// has the original content.
+			if err := e.writeArchiveFile(n); err != nil {
+				return err
+			}
+		case toc:
+			// Archives indexed from a table of contents have no tar headers
+			// to copy, see stargz.go.
+			if err := e.writeTOCEntry(n); err != nil {
+				return err
+			}
+		default:
+			if _, err := io.Copy(e.w, io.NewSectionReader(e.s.layers[n.layer], n.header, n.length)); err != nil {
+				return errors.Wrapf(err, "error copying archive entry %s", n.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (e *exporter) linkChanged(n *node) bool {
+	target := asNode(e.s.lookup(n.hardlink))
+	return target == nil || target.layer != n.layer || e.s.inUpper(n.hardlink)
+}
+
+// collect adds the archive entry for `name`, and everything below it, to
+// entries. Removed entries are skipped.
+func (e *exporter) collect(name string, entries *[]exportEntry) {
+	n := asNode(e.s.db.Get(fuseNameToKey(name)))
+	if n == nil {
+		return
+	}
+	*entries = append(*entries, exportEntry{name: name, n: n})
+	if n.Mode().IsDir() {
+		for _, child := range e.s.db.Entries(fuseNameToKey(name)) {
+			e.collect(filepath.Join(name, filepath.Base(child.Name())), entries)
+		}
+	}
+}
+
+// writeTOCEntry writes an entry which was read from a table of contents.
+// Files are written by `writeArchiveFile`.
+func (e *exporter) writeTOCEntry(n *node) error {
+	hdr := &tar.Header{
+		Name:    n.Name(),
+		Mode:    int64(unixPerm(n.Mode())),
+		Uid:     int(n.Owner().UID),
+		Gid:     int(n.Owner().GID),
+		ModTime: n.ModTime(),
+	}
+	switch {
+	case n.hardlink != "":
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = strings.TrimPrefix(n.hardlink, "/")
+	case n.Mode().IsDir():
+		hdr.Typeflag = tar.TypeDir
+	case n.Mode()&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = n.Linkname()
+	default:
+		return e.writeArchiveFile(n)
+	}
+	for k, v := range n.Xattrs() {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+k] = string(v)
+	}
+	return e.writeEntry(hdr, nil)
+}
+
+func (e *exporter) writeArchiveFile(n *node) error {
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       n.Name(),
+		Mode:       int64(unixPerm(n.Mode())),
+		Uid:        int(n.Owner().UID),
+		Gid:        int(n.Owner().GID),
+		Size:       n.Size(),
+		ModTime:    n.ModTime(),
+		AccessTime: n.AccessTime(),
+		ChangeTime: n.ChangeTime(),
+	}
+	for k, v := range n.Xattrs() {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+k] = string(v)
+	}
+
+	mode := n.Mode()
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+	case mode&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+	case mode&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		if err := e.s.verifyFile(n); err != nil {
+			return err
+		}
+		return e.writeEntry(hdr, e.s.data(n))
+	}
+	major, minor := n.Device()
+	hdr.Devmajor = int64(major)
+	hdr.Devminor = int64(minor)
+	hdr.Size = 0
+	return e.writeEntry(hdr, nil)
+}
+
+// writeUpper writes the entries of the upper dir which were not written yet.
+// If `diff` is set the whiteouts in the upper dir are written as well.
+func (e *exporter) writeUpper(diff bool) error {
+	return filepath.Walk(e.s.upperDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == e.s.upperDir {
+				return nil
+			}
+			return err
+		}
+		name, err := filepath.Rel(e.s.upperDir, p)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if _, ok := e.written[name]; ok {
+			return nil
+		}
+
+		if isReserved(name) {
+			if !diff {
+				return nil
+			}
+			return e.writeWhiteout(name)
+		}
+		if err := e.writeUpperEntry(name); err != nil {
+			return err
+		}
+		if diff && info.IsDir() {
+			// A directory which replaces a removed archive directory must
+			// hide the content of the old directory.
+			if _, err := os.Lstat(e.s.upperPath(whiteoutName(name))); err == nil {
+				return e.writeEntry(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     filepath.ToSlash(filepath.Join(name, whiteoutOpaque)),
+				}, nil)
+			}
+		}
+		return nil
+	})
+}
+
+func (e *exporter) writeWhiteout(name string) error {
+	removed := filepath.Join(filepath.Dir(name), strings.TrimPrefix(filepath.Base(name), whiteoutPrefix))
+	if e.s.inUpper(removed) {
+		// Replaced by a new entry, which hides the old entry by itself.
+		return nil
+	}
+	return e.writeEntry(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+	}, nil)
+}
+
+func (e *exporter) writeUpperEntry(name string) error {
+	p := e.s.upperPath(name)
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return errors.Wrap(err, "error reading upper dir")
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(p)
+		if err != nil {
+			return errors.Wrap(err, "error reading upper dir")
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return errors.Wrapf(err, "error creating header for %s", name)
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid = int(e.s.uids.toContainer(uint32(hdr.Uid)))
+	hdr.Gid = int(e.s.gids.toContainer(uint32(hdr.Gid)))
+	e.written[name] = struct{}{}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := listXattrs(p)
+		if err != nil {
+			return errors.Wrapf(err, "error reading xattrs for %s", name)
+		}
+		for k, v := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxSchilyXattr+k] = string(e.s.containerXattr(k, v))
+		}
+	}
+
+	if ino, nlink := fileID(fi); !fi.IsDir() && nlink > 1 {
+		if first, ok := e.links[ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return e.writeEntry(hdr, nil)
+		}
+		e.links[ino] = hdr.Name
+	}
+
+	if !fi.Mode().IsRegular() {
+		return e.writeEntry(hdr, nil)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrap(err, "error reading upper dir")
+	}
+	defer f.Close() // nolint: errcheck
+	return e.writeEntry(hdr, f)
+}
+
+// writeEntry writes a new entry to the archive.
+// The tar writer is flushed so that raw entries can be copied after it.
+func (e *exporter) writeEntry(hdr *tar.Header, data io.Reader) error {
+	if err := e.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "error writing header for %s", hdr.Name)
+	}
+	if data != nil {
+		if _, err := io.Copy(e.tw, data); err != nil {
+			return errors.Wrapf(err, "error writing data for %s", hdr.Name)
+		}
+	}
+	return e.tw.Flush()
+}
@@ -0,0 +1,228 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+func newExportTestFS(t *testing.T) ([]byte, pathfs.FileSystem, string) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{"foo", os.ModeDir | 0755, ""},
+		{"foo/bar", 0644, "bar"},
+		{"foo/baz", 0644, "baz"},
+		{"quux", os.ModeDir | 0755, ""},
+		{"quux/hello", 0644, "hello"},
+	} {
+		h := newTestHeader(f.name, f.mode, int64(len(f.data)), now)
+		if f.name == "foo/baz" {
+			h.PAXRecords = map[string]string{paxSchilyXattr + "user.foo": "bar"}
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "foo/bar", ModTime: now}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := FromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len()), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return buf.Bytes(), fs, dir
+}
+
+type exportedEntry struct {
+	hdr  *tar.Header
+	data string
+}
+
+func readExport(t *testing.T, fs pathfs.FileSystem, mode ExportMode) ([]byte, []exportedEntry) {
+	buf := bytes.NewBuffer(nil)
+	if err := Export(fs, buf, mode); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []exportedEntry
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, exportedEntry{hdr: h, data: string(data)})
+	}
+	return buf.Bytes(), entries
+}
+
+func entryNames(entries []exportedEntry) string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.hdr.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestExportUnchanged(t *testing.T) {
+	orig, fs, dir := newExportTestFS(t)
+	defer os.RemoveAll(dir)
+
+	out, _ := readExport(t, fs, ExportFull)
+	if !bytes.Equal(out, orig) {
+		t.Fatal("export of an unchanged filesystem should match the original archive")
+	}
+	if _, entries := readExport(t, fs, ExportDiff); len(entries) != 0 {
+		t.Fatalf("expected empty diff, got %s", entryNames(entries))
+	}
+}
+
+func TestExport(t *testing.T) {
+	_, fs, dir := newExportTestFS(t)
+	defer os.RemoveAll(dir)
+	fCtx := &fuse.Context{}
+
+	f, status := fs.Open("foo/bar", uint32(os.O_WRONLY|os.O_TRUNC), fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("BAR!"), 0)
+	f.Release()
+	f, status = fs.Create("foo/new", uint32(os.O_WRONLY), 0644, fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("new"), 0)
+	f.Release()
+	if status := fs.Unlink("quux/hello", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	_, entries := readExport(t, fs, ExportFull)
+	if names := entryNames(entries); names != "foo/,foo/bar,foo/baz,quux/,link,foo/new" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	for _, e := range entries {
+		var expected string
+		switch e.hdr.Name {
+		case "foo/bar":
+			expected = "BAR!"
+		case "foo/baz":
+			expected = "baz"
+			if e.hdr.PAXRecords[paxSchilyXattr+"user.foo"] != "bar" {
+				t.Fatal("expected PAX records to be preserved")
+			}
+		case "link":
+			// The link target was modified, so this must have the original data.
+			if e.hdr.Typeflag != tar.TypeReg {
+				t.Fatalf("expected link to be exported as a regular file, got %c", e.hdr.Typeflag)
+			}
+			expected = "bar"
+		case "foo/new":
+			expected = "new"
+		}
+		if e.data != expected {
+			t.Fatalf("%s: expected %q, got %q", e.hdr.Name, expected, e.data)
+		}
+	}
+
+	_, entries = readExport(t, fs, ExportDiff)
+	if names := entryNames(entries); names != "foo/,foo/bar,foo/new,quux/,quux/.wh.hello" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
+
+func TestExportOpaqueDir(t *testing.T) {
+	_, fs, dir := newExportTestFS(t)
+	defer os.RemoveAll(dir)
+	fCtx := &fuse.Context{}
+
+	if status := fs.Unlink("quux/hello", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Rmdir("quux", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Mkdir("quux", 0755, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	_, entries := readExport(t, fs, ExportDiff)
+	if names := entryNames(entries); names != "quux/,quux/.wh..wh..opq" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	_, entries = readExport(t, fs, ExportFull)
+	if names := entryNames(entries); names != "foo/,foo/bar,foo/baz,link,quux/" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
+
+func TestWhiteoutsPersisted(t *testing.T) {
+	orig, fs, dir := newExportTestFS(t)
+	defer os.RemoveAll(dir)
+	fCtx := &fuse.Context{}
+
+	if status := fs.Unlink("foo/bar", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("quux/hello", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Rmdir("quux", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Mkdir("quux", 0755, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if names := dirNames(t, fs, "foo"); names != "baz" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+
+	fs, err := FromReaderAt(bytes.NewReader(orig), int64(len(orig)), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(t, fs, "foo"); names != "baz" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	if names := dirNames(t, fs, "quux"); names != "" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	if _, status := fs.GetAttr("quux/hello", fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", status)
+	}
+	if status := fs.Mkdir(".wh.foo", 0755, fCtx); status != fuse.EINVAL {
+		t.Fatalf("expected EINVAL for reserved name, got %v", status)
+	}
+}
@@ -3,12 +3,14 @@ package tarfs
 import (
 	"archive/tar"
 	"io"
+	"strings"
+	"syscall"
 	"time"
 
 	"os"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -23,6 +25,11 @@ type FileInfo interface {
 	Mode() os.FileMode
 	Owner() Owner
 	Name() string
+	Linkname() string
+	Nlink() uint32
+	Xattrs() map[string][]byte
+	// Device returns the device numbers of character and block devices.
+	Device() (major, minor uint32)
 }
 
 // Owner is the uid/gid used for a filesystem node
@@ -38,8 +45,28 @@ type StatT struct {
 	Atime time.Time
 	Mtime time.Time
 	Ctime time.Time
-	Ino   int64
-	Size  int64
+	// Ino is the inode number. Entries are numbered in the order they appear
+	// in the archive, so the numbers don't change when the archive is indexed
+	// again. Hard links share the inode number of the node they link to.
+	Ino  int64
+	Size int64
+	// DataOffset is the offset of the content of the node in the
+	// uncompressed archive.
+	DataOffset int64
+	// Linkname is the target of a symlink.
+	Linkname string
+	// Nlink is the number of hard links to the node.
+	// Hard links share the StatT of the node they link to.
+	Nlink uint32
+	// Xattrs are the extended attributes of the node.
+	Xattrs map[string][]byte
+	// Sparse is the list of data fragments of a sparse file, it is nil for
+	// files which are not sparse.
+	Sparse []SparseEntry
+	// Devmajor and Devminor are the device numbers of character and block
+	// devices.
+	Devmajor uint32
+	Devminor uint32
 }
 
 type dirNode struct {
@@ -56,9 +83,42 @@ func (n *dirNode) Entries() []FileInfo {
 	return entries
 }
 
+// dirNlink returns the link count of a directory with the passed in entries,
+// which is linked from its parent, its own `.` entry and the `..` entry of
+// each subdirectory.
+func dirNlink(entries []FileInfo) uint32 {
+	nlink := uint32(2)
+	for _, e := range entries {
+		if e.Mode().IsDir() {
+			nlink++
+		}
+	}
+	return nlink
+}
+
 type node struct {
 	name string
 	stat *StatT
+	// hardlink is the key of the entry a hard link points to.
+	hardlink string
+	// header is the offset of the entry in the archive and length the size
+	// of all its headers and padded data.
+	header int64
+	length int64
+	// layer is the index of the archive the entry is from, see `FromLayers`.
+	layer int
+}
+
+// asNode returns the node for entries which were read from an archive by this
+// package.
+func asNode(fi FileInfo) *node {
+	switch n := fi.(type) {
+	case *node:
+		return n
+	case *dirNode:
+		return n.node
+	}
+	return nil
 }
 
 func (n *node) Name() string {
@@ -77,11 +137,21 @@ func (n *node) ModTime() time.Time {
 	return n.stat.Mtime
 }
 
+// ChangeTime returns the change time of the entry, or the modification time
+// for archives which don't store it.
 func (n *node) ChangeTime() time.Time {
-	return n.stat.Mtime
+	if n.stat.Ctime.IsZero() {
+		return n.stat.Mtime
+	}
+	return n.stat.Ctime
 }
 
+// AccessTime returns the access time of the entry, or the modification time
+// for archives which don't store it.
 func (n *node) AccessTime() time.Time {
+	if n.stat.Atime.IsZero() {
+		return n.stat.Mtime
+	}
 	return n.stat.Atime
 }
 
@@ -101,6 +171,22 @@ func (n *node) Owner() Owner {
 	return n.stat.Owner
 }
 
+func (n *node) Linkname() string {
+	return n.stat.Linkname
+}
+
+func (n *node) Nlink() uint32 {
+	return n.stat.Nlink
+}
+
+func (n *node) Xattrs() map[string][]byte {
+	return n.stat.Xattrs
+}
+
+func (n *node) Device() (uint32, uint32) {
+	return n.stat.Devmajor, n.stat.Devminor
+}
+
 type file struct {
 	name string
 	io.ReaderAt
@@ -146,6 +232,50 @@ func (eofReadResult) Bytes(b []byte) ([]byte, fuse.Status) {
 
 func (eofReadResult) Done() {}
 
+// unixPerm returns the permission bits of the mode, including the setuid,
+// setgid and sticky bits, as they are used by the system.
+func unixPerm(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// fuseMode returns the mode with the file type bits used by fuse.
+func fuseMode(mode os.FileMode) uint32 {
+	m := unixPerm(mode)
+	switch {
+	case mode.IsDir():
+		m |= fuse.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= fuse.S_IFLNK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	default:
+		m |= fuse.S_IFREG
+	}
+	return m
+}
+
+// isSpecial checks if the mode is for a device node, named pipe or socket,
+// which have no content in the archive.
+func isSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0
+}
+
 func fillStat(t *StatT, fi os.FileInfo) {
 	fillStatSys(t, fi)
 
@@ -155,10 +285,32 @@ func fillStat(t *StatT, fi os.FileInfo) {
 		t.Ctime = sys.ChangeTime
 		t.Owner.UID = uint32(sys.Uid)
 		t.Owner.GID = uint32(sys.Gid)
-
+		t.Linkname = sys.Linkname
+		t.Xattrs = headerXattrs(sys)
+		if sys.Typeflag == tar.TypeChar || sys.Typeflag == tar.TypeBlock {
+			t.Devmajor = uint32(sys.Devmajor)
+			t.Devminor = uint32(sys.Devminor)
+		}
 	}
 
 	t.Mode = uint32(fi.Mode())
 	t.Size = fi.Size()
 	t.Mtime = fi.ModTime()
 }
+
+// paxSchilyXattr is the PAX record prefix used for extended attributes.
+const paxSchilyXattr = "SCHILY.xattr."
+
+func headerXattrs(h *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for k, v := range h.PAXRecords {
+		if !strings.HasPrefix(k, paxSchilyXattr) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[strings.TrimPrefix(k, paxSchilyXattr)] = []byte(v)
+	}
+	return xattrs
+}
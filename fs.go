@@ -3,134 +3,607 @@ package tarfs
 import (
 	"archive/tar"
 	"io"
+	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"os"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // server is the fuse server which serves a tar file as a path filesystem.
-// Currently this server only implements a read-only filesystem.
+// By default this server only implements a read-only filesystem, see
+// `WithUpperDir` for enabling writes.
 type server struct {
 	pathfs.FileSystem
 	db     MetadataStore
-	stream io.ReaderAt
+	layers []layerStream
+
+	// upper is used for writable servers, see overlay.go
+	upper    pathfs.FileSystem
+	upperDir string
+	// mu serializes changes to the upper dir
+	mu sync.Mutex
+
+	// defaultPermissions is set if permissions are checked by the kernel
+	defaultPermissions bool
+	// verify is set if file contents are verified, see verify.go
+	verify *verifier
+	// uids and gids map the owner of archive entries, see idmap.go, and
+	// umask is applied to their mode
+	uids, gids *idMap
+	umask      uint32
+
+	// walkedUsage is the usage of stores which don't implement UsageCounter
+	usageOnce   sync.Once
+	walkedUsage Usage
 }
 
 // Newserver creates a new tarfs server from the passed in metadata store.
 // The passed in metadata store should be pre-populated with filesystem metadata.
 // See `FromFile` as an example of this.
-func Newserver(db MetadataStore, tarStream io.ReaderAt) pathfs.FileSystem {
-	return &server{
+func Newserver(db MetadataStore, tarStream io.ReaderAt, opts ...Opt) pathfs.FileSystem {
+	return newServer(db, []layerStream{{ReaderAt: tarStream}}, opts...)
+}
+
+func newServer(db MetadataStore, layers []layerStream, opts ...Opt) *server {
+	cfg := newConfig(opts)
+
+	s := &server{
 		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
 		db:         db,
-		stream:     tarStream,
+		layers:     layers,
+
+		defaultPermissions: cfg.defaultPermissions,
+		uids:               cfg.uids,
+		gids:               cfg.gids,
+		umask:              uint32(cfg.umask),
+	}
+	if cfg.manifest != nil || cfg.computeDigests {
+		s.verify = newVerifier(cfg.manifest)
+	}
+	if cfg.cache != nil {
+		// The archive can still be served without the cache.
+		c, err := newBlockCache(*cfg.cache)
+		if err != nil {
+			logrus.WithError(err).Warn("not using cache")
+		} else {
+			for i, l := range s.layers {
+				s.layers[i].ReaderAt = c.reader(i, l.ReaderAt)
+			}
+		}
 	}
+	if cfg.upperDir != "" {
+		s.FileSystem = pathfs.NewDefaultFileSystem()
+		s.upper = pathfs.NewLoopbackFileSystem(cfg.upperDir)
+		s.upperDir = cfg.upperDir
+		if err := s.loadWhiteouts(); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("dir", s.upperDir).Error("error loading whiteouts")
+		}
+	}
+	return s
 }
 
 // FromFile takes the passed in tar file and creates a new tarfs server
 // Metadata from the tarfile is stored in the metadata store, which is used as
 // the backing store for the tarfs server.
 // The passed in file must not be acessed or modified while the server is active.
-func FromFile(f *os.File, db MetadataStore) (pathfs.FileSystem, error) {
+func FromFile(f *os.File, db MetadataStore, opts ...Opt) (pathfs.FileSystem, error) {
 	st, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	return FromReaderAt(f, st.Size(), db)
+	return FromReaderAt(f, st.Size(), db, append(opts, withModTime(st.ModTime()))...)
 }
 
 // FromReaderAt creates a new tarfs server from io.ReaderAt.
 // The size of the tar archive needs to be provided.
 // Metadata from the tarfile is stored in the metadata store, which is used as
 // the backing store for the tarfs server.
-func FromReaderAt(ra io.ReaderAt, size int64, db MetadataStore) (pathfs.FileSystem, error) {
-	r := io.NewSectionReader(ra, 0, size)
-	tr := tar.NewReader(r)
+//
+// Archives compressed with gzip, bzip2, xz or zstd are detected and
+// decompressed transparently. While the archive is indexed an index of
+// decompression checkpoints is built so that file reads don't need to
+// decompress the archive from the start.
+//
+// stargz and eStargz archives are indexed from their table of contents, without
+// reading the rest of the archive, and file contents are verified against the
+// chunk digests in the table of contents. Index files are not used for those.
+func FromReaderAt(ra io.ReaderAt, size int64, db MetadataStore, opts ...Opt) (pathfs.FileSystem, error) {
+	cfg := newConfig(opts)
+	format, err := detectCompression(ra, size)
+	if err != nil {
+		return nil, err
+	}
 
-	// we add the root entry because some archive does not contain the root entry.
-	// If the archive contains the real stat for the root, the real stat is used.
-	rootStat := StatT{
-		Mode: uint32(0755 | os.ModeDir),
-		Owner: Owner{
-			UID: uint32(os.Geteuid()),
-			GID: uint32(os.Getegid()),
-		},
-		// follows traditional convention, adopted in several file systems
-		// including ext4: https://ext4.wiki.kernel.org/index.php/Ext4_Disk_Layout#Special_inodes
-		Ino:  2,
-		Size: 4096,
+	var key indexKey
+	if cfg.indexFile != "" {
+		if key, err = newIndexKey(ra, size, cfg, format); err != nil {
+			return nil, err
+		}
 	}
-	rootNode := &dirNode{node: &node{name: "", stat: &rootStat}}
-	if err := db.Add("/", rootNode); err != nil {
-		return nil, errors.Wrap(err, "error adding root node")
+	if cfg.indexFile != "" && !cfg.computeDigests {
+		idx, err := openIndexFile(cfg.indexFile, key)
+		if err == nil {
+			logrus.WithField("index", cfg.indexFile).Debug("using index file")
+			return indexServer(ra, size, format, idx, opts), nil
+		}
+		logrus.WithError(err).WithField("index", cfg.indexFile).Debug("not using index file")
+	}
+
+	if cfg.progressive && cfg.upperDir == "" && !cfg.computeDigests {
+		return indexProgressively(ra, size, format, db, key, cfg, opts)
+	}
+
+	var digests contentDigests
+	if cfg.computeDigests {
+		digests = make(contentDigests)
+	}
+	a, err := indexArchive(ra, size, format, db, digests)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.indexFile != "" && !a.toc {
+		// The index file is only a cache, so the archive can still be served
+		// without it.
+		if err := writeIndexFile(cfg.indexFile, db, key, a.checkpoints); err != nil {
+			logrus.WithError(err).WithField("index", cfg.indexFile).Warn("error writing index file")
+		}
+	}
+	s := newServer(db, []layerStream{{ReaderAt: a.stream, toc: a.toc}}, opts...)
+	if digests != nil {
+		s.verify.add(digests)
+	}
+	return s, nil
+}
+
+// FromIndex creates a new tarfs server from io.ReaderAt, using the metadata
+// and decompression checkpoints from an index written by `WriteIndex` instead
+// of reading the archive. This allows mounting compressed archives without
+// decompressing them first.
+//
+// An error is returned if the index does not belong to the archive, the
+// archive's size and compression, a hash of its start and end, and the digest
+// set with `WithDigest`, need to match the ones the index was written with.
+// Only the start and end of the archive are read to check this, so pass the
+// digest if the archive can differ from the indexed one anywhere else.
+// Digests can't be computed without reading the archive, so
+// `WithComputedDigests` can not be used with an index.
+func FromIndex(ra io.ReaderAt, size int64, index string, opts ...Opt) (pathfs.FileSystem, error) {
+	cfg := newConfig(opts)
+	if cfg.computeDigests {
+		return nil, errors.New("computed digests can not be used with an index")
+	}
+	format, err := detectCompression(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newIndexKey(ra, size, cfg, format)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := openIndexFile(index, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening index")
+	}
+	return indexServer(ra, size, format, idx, opts), nil
+}
+
+// indexServer creates a server for an archive from its index file.
+func indexServer(ra io.ReaderAt, size int64, format compression, idx *fileStore, opts []Opt) pathfs.FileSystem {
+	var stream io.ReaderAt = ra
+	if format != compressionNone {
+		cra := newCompressedReaderAt(ra, size, format)
+		cra.checkpoints = idx.checkpoints
+		stream = cra
+	}
+	return Newserver(idx, stream, opts...)
+}
+
+// indexedArchive is an archive which was added to a metadata store.
+type indexedArchive struct {
+	// stream is the uncompressed archive
+	stream      io.ReaderAt
+	checkpoints []checkpoint
+	// size is the size of the uncompressed archive
+	size int64
+	// toc is set for archives which were indexed from a table of contents,
+	// see stargz.go.
+	toc bool
+}
+
+// indexArchive adds the metadata of a, possibly compressed, archive to db.
+// The digests of regular files are added to `digests` if it is not nil.
+//
+// stargz archives are indexed from their table of contents instead, and the
+// digests from there are used.
+func indexArchive(ra io.ReaderAt, size int64, format compression, db MetadataStore, digests contentDigests) (*indexedArchive, error) {
+	a, index, err := openArchive(ra, size, format, db, digests)
+	if err != nil || index == nil {
+		return a, err
+	}
+	if err := index(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// openArchive returns the stream of an archive, and a function which reads
+// the archive and adds its metadata to db. The checkpoints and size of the
+// archive are only set once the archive was indexed.
+// stargz archives are indexed right away, and no function is returned.
+func openArchive(ra io.ReaderAt, size int64, format compression, db MetadataStore, digests contentDigests) (*indexedArchive, func() error, error) {
+	if format == compressionGzip {
+		a, err := indexStargz(ra, size, db)
+		if err != errNotStargz {
+			return a, nil, err
+		}
+	}
+	if format == compressionNone {
+		index := func() error {
+			r := io.NewSectionReader(ra, 0, size)
+			pos := func() (int64, error) {
+				return r.Seek(0, io.SeekCurrent)
+			}
+			return indexTar(r, ra, pos, db, digests)
+		}
+		return &indexedArchive{stream: ra, size: size}, index, nil
+	}
+
+	cra := newCompressedReaderAt(ra, size, format)
+	a := &indexedArchive{stream: cra}
+	index := func() error {
+		scanner, err := cra.scan()
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s stream", format)
+		}
+		cr := &countingReader{r: scanner}
+		if err := indexTar(cr, cra, cr.pos, db, digests); err != nil {
+			return err
+		}
+		// Consume anything after the end of the archive so the checkpoint
+		// index is complete and the stream checksums get verified.
+		if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+			return errors.Wrapf(err, "error reading %s stream", format)
+		}
+		a.checkpoints, a.size = cra.checkpoints, cr.n
+		return nil
+	}
+	return a, index, nil
+}
+
+// indexTar reads all the headers from the tar stream and adds them to the
+// metadata store.
+// `offset` must return the current offset in the tar stream.
+// `ra` gives access to the parts of the stream which were already read, which
+// is needed to read the sparse maps of sparse files.
+// The digests of regular files are added to `digests` if it is not nil.
+func indexTar(r io.Reader, ra io.ReaderAt, offset func() (int64, error), db MetadataStore, digests contentDigests) error {
+	tr := tar.NewReader(r)
+	x, err := newTarIndexer(db)
+	if err != nil {
+		return err
 	}
 
-	missingDirs := make(map[string]struct{})
+	var next int64
 	for {
+		start := next
 		h, err := tr.Next()
 		if err != nil {
 			if err != io.EOF {
-				return nil, errors.Wrap(err, "error reading tar")
+				return errors.Wrap(err, "error reading tar")
 			}
 			break
 		}
 
-		pos, err := r.Seek(0, io.SeekCurrent)
+		pos, err := offset()
 		if err != nil {
-			return nil, errors.Wrap(err, "error getting file position in tar")
-		}
-
-		var stat StatT
-		fillStat(&stat, h.FileInfo())
-		stat.Ino = pos
-
-		key := headerNameEntry(h.Name)
-		var nodeInfo FileInfo = &node{name: h.Name, stat: &stat}
-		if h.FileInfo().IsDir() {
-			node := nodeInfo.(*node)
-			if dirInfo := db.Get(key); dirInfo != nil {
-				dirInfo.(*dirNode).node = node
-				nodeInfo = dirInfo
-				delete(missingDirs, key)
-			} else {
-				nodeInfo = &dirNode{node: node}
+			return errors.Wrap(err, "error getting file position in tar")
+		}
+		sparse, err := sparseMap(h, ra, start, pos)
+		if err != nil {
+			return err
+		}
+		if sparse != nil {
+			next = blockAlign(pos + sparseDataSize(sparse))
+		} else {
+			next = blockAlign(pos + dataSize(h))
+		}
+
+		if err := x.add(h, start, pos, next, sparse); err != nil {
+			return err
+		}
+		if digests != nil && h.Typeflag != tar.TypeLink && h.FileInfo().Mode().IsRegular() {
+			fd, err := digestContent(tr)
+			if err != nil {
+				return errors.Wrapf(err, "error reading %s", h.Name)
 			}
+			digests[pos] = fd
 		}
+	}
+
+	return x.finish()
+}
 
-		if err := db.Add(key, nodeInfo); err != nil {
-			return nil, errors.Wrapf(err, "error adding node entry to db: %s", h.Name)
+// tarIndexer adds the entries of an archive to a metadata store.
+type tarIndexer struct {
+	db MetadataStore
+	// missingDirs are the directories which have entries, but were not
+	// found in the archive yet.
+	missingDirs map[string]struct{}
+	dirs        []string
+	ino         int64
+	links       *linkResolver
+	// progress is set if the archive is served while it is indexed, see
+	// progress.go
+	progress *progressStore
+	// layer is set if the archive is a layer of a layered filesystem, see
+	// layers.go
+	layer *layerStore
+}
+
+// newTarIndexer adds the root entry to db and returns an indexer for the
+// entries of an archive.
+// For a `progressStore` entries are added to the underlying store, while
+// holding the lock of the progress store.
+func newTarIndexer(db MetadataStore) (*tarIndexer, error) {
+	x := &tarIndexer{
+		db:          db,
+		missingDirs: make(map[string]struct{}),
+		dirs:        []string{"/"},
+		ino:         rootIno,
+		links:       newLinkResolver(),
+	}
+	if ps, ok := db.(*progressStore); ok {
+		if err := ps.lock(); err != nil {
+			return nil, err
 		}
+		defer ps.unlock()
+		ps.x = x
+		x.db = ps.MetadataStore
+		x.progress = ps
+	}
+	if ls, ok := db.(*layerStore); ok {
+		x.db = ls.MetadataStore
+		x.layer = ls
+	}
+
+	// we add the root entry because some archive does not contain the root entry.
+	// If the archive contains the real stat for the root, the real stat is used.
+	rootStat := StatT{
+		Mode: uint32(0755 | os.ModeDir),
+		Owner: Owner{
+			UID: uint32(os.Geteuid()),
+			GID: uint32(os.Getegid()),
+		},
+		Ino:   rootIno,
+		Size:  4096,
+		Nlink: 1,
+	}
+	rootNode := &dirNode{node: &node{name: "", stat: &rootStat}}
+	if err := x.db.Add("/", rootNode); err != nil {
+		return nil, errors.Wrap(err, "error adding root node")
+	}
+	return x, nil
+}
 
-		parentKey := filepath.Dir(key)
-		var parent *dirNode
-		if parentInfo := db.Get(parentKey); parentInfo != nil {
-			parent = parentInfo.(*dirNode)
+// add adds an entry to the metadata store. `start` is the offset of the
+// first header of the entry, `pos` the offset of its data and `next` the
+// offset after its data.
+func (x *tarIndexer) add(h *tar.Header, start, pos, next int64, sparse []SparseEntry) error {
+	if x.progress != nil {
+		if err := x.progress.lock(); err != nil {
+			return err
+		}
+		defer x.progress.unlock()
+	}
+	db := x.db
+	key := headerNameEntry(h.Name)
+	var stat StatT
+	fillStat(&stat, h.FileInfo())
+	if key == "/" {
+		stat.Ino = rootIno
+	} else {
+		x.ino++
+		stat.Ino = x.ino
+	}
+	stat.DataOffset = pos
+	stat.Nlink = 1
+	stat.Sparse = sparse
+
+	n := &node{name: h.Name, stat: &stat, header: start, length: next - start}
+	var nodeInfo FileInfo = n
+	if h.Typeflag == tar.TypeLink {
+		target := headerNameEntry(h.Linkname)
+		n.hardlink = target
+		targetInfo := db.Get(target)
+		if targetInfo != nil && targetInfo.Mode().IsDir() {
+			return errors.Errorf("hard link to directory not supported: %s -> %s", h.Name, h.Linkname)
+		}
+		if tn, ok := targetInfo.(*node); ok && !x.links.isPending(target) {
+			n.stat = tn.stat
+			n.stat.Nlink++
 		} else {
-			missingDirs[parentKey] = struct{}{}
-			parent = &dirNode{node: &node{name: filepath.Base(parentKey)}}
+			// The target has not been indexed yet, it will be filled in
+			// once it shows up in the stream.
+			x.links.wait(key, target, n)
 		}
-		parent.entries = append(parent.entries, nodeInfo)
-		if err := db.Add(parentKey, parent); err != nil {
-			return nil, errors.Wrapf(err, "error adding parent node entry to db for %s", h.Name)
+	}
+	if h.FileInfo().IsDir() {
+		x.dirs = append(x.dirs, key)
+		node := nodeInfo.(*node)
+		if dirInfo := db.Get(key); dirInfo != nil {
+			dirInfo.(*dirNode).node = node
+			nodeInfo = dirInfo
+			delete(x.missingDirs, key)
+		} else {
+			nodeInfo = &dirNode{node: node}
 		}
 	}
 
-	if len(missingDirs) != 0 {
-		ss := []string{}
-		for s := range missingDirs {
-			ss = append(ss, s)
+	if err := db.Add(key, nodeInfo); err != nil {
+		return errors.Wrapf(err, "error adding node entry to db: %s", h.Name)
+	}
+	if !h.FileInfo().IsDir() && !x.links.isPending(key) {
+		x.links.resolve(key, n)
+	}
+
+	parentKey := filepath.Dir(key)
+	var parent *dirNode
+	if parentInfo := db.Get(parentKey); parentInfo != nil {
+		parent = parentInfo.(*dirNode)
+	} else {
+		x.missingDirs[parentKey] = struct{}{}
+		parent = &dirNode{node: &node{name: filepath.Base(parentKey)}}
+	}
+	parent.entries = append(parent.entries, nodeInfo)
+	if err := db.Add(parentKey, parent); err != nil {
+		return errors.Wrapf(err, "error adding parent node entry to db for %s", h.Name)
+	}
+	return nil
+}
+
+// finish checks that all parent directories and hard link targets were
+// found, and sets the link counts of directories.
+// For layers they can be in the layers below, they are passed on to the layer
+// store instead.
+func (x *tarIndexer) finish() error {
+	if x.progress != nil {
+		if err := x.progress.lock(); err != nil {
+			return err
 		}
-		return nil, errors.Errorf("missing directory entries: %s", strings.Join(ss, ","))
+		defer x.progress.unlock()
+	}
+	if x.layer != nil {
+		x.layer.missingDirs, x.layer.links = x.missingDirs, x.links
+	} else {
+		if len(x.missingDirs) != 0 {
+			ss := []string{}
+			for s := range x.missingDirs {
+				ss = append(ss, s)
+			}
+			return errors.Errorf("missing directory entries: %s", strings.Join(ss, ","))
+		}
+		if missing := x.links.missing(); len(missing) != 0 {
+			return errors.Errorf("missing hard link targets: %s", strings.Join(missing, ","))
+		}
+	}
+	for _, key := range x.dirs {
+		if dir, ok := x.db.Get(key).(*dirNode); ok {
+			dir.stat.Nlink = dirNlink(dir.entries)
+		}
+	}
+
+	return nil
+}
+
+const blockSize = 512
+
+// rootIno is the inode number of the root directory, which follows the
+// traditional convention adopted in several file systems including ext4:
+// https://ext4.wiki.kernel.org/index.php/Ext4_Disk_Layout#Special_inodes
+const rootIno = 2
+
+// ioBlockSize is the block size reported for efficient I/O.
+const ioBlockSize = 4096
+
+func blockAlign(n int64) int64 {
+	return (n + blockSize - 1) &^ (blockSize - 1)
+}
+
+// dataSize returns the size of the data stored in the archive after the
+// header.
+func dataSize(h *tar.Header) int64 {
+	switch h.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		return 0
+	}
+	return h.Size
+}
+
+// storedSize returns the size of the file content stored in the archive,
+// which for sparse files excludes the holes.
+func storedSize(fi FileInfo) int64 {
+	if !fi.Mode().IsRegular() {
+		return 0
+	}
+	if n := asNode(fi); n != nil && n.stat != nil && n.stat.Sparse != nil {
+		return sparseDataSize(n.stat.Sparse)
+	}
+	return fi.Size()
+}
+
+// seekData returns the offset of the next data or hole in the content of an
+// archive entry, see `seekSparse`. Only sparse files have holes.
+func seekData(fi FileInfo, off int64, whence int) (int64, error) {
+	sparse := []SparseEntry{{Offset: 0, Length: fi.Size()}}
+	if n := asNode(fi); n != nil && n.stat != nil && n.stat.Sparse != nil {
+		sparse = n.stat.Sparse
+	}
+	return seekSparse(sparse, fi.Size(), off, whence)
+}
+
+type pendingLink struct {
+	key  string
+	node *node
+}
+
+// linkResolver tracks hard links which were found in the archive before the
+// entry they link to.
+type linkResolver struct {
+	// pending maps a link target to the links waiting on it.
+	pending map[string][]pendingLink
+	// waiting maps the key of an unresolved link to its target.
+	waiting map[string]string
+}
+
+func newLinkResolver() *linkResolver {
+	return &linkResolver{
+		pending: make(map[string][]pendingLink),
+		waiting: make(map[string]string),
+	}
+}
+
+func (l *linkResolver) wait(key, target string, n *node) {
+	l.pending[target] = append(l.pending[target], pendingLink{key: key, node: n})
+	l.waiting[key] = target
+}
+
+func (l *linkResolver) isPending(key string) bool {
+	_, ok := l.waiting[key]
+	return ok
+}
+
+// resolve points all links waiting on `key` at the passed in target,
+// including any links which are in turn waiting on those.
+func (l *linkResolver) resolve(key string, target *node) {
+	links := l.pending[key]
+	delete(l.pending, key)
+	for _, link := range links {
+		link.node.stat = target.stat
+		link.node.layer = target.layer
+		target.stat.Nlink++
+		delete(l.waiting, link.key)
+		l.resolve(link.key, target)
 	}
+}
 
-	return Newserver(db, ra), nil
+func (l *linkResolver) missing() []string {
+	ss := make([]string, 0, len(l.waiting))
+	for key, target := range l.waiting {
+		ss = append(ss, key+" -> "+target)
+	}
+	sort.Strings(ss)
+	return ss
 }
 
 func headerNameEntry(name string) string {
@@ -147,70 +620,151 @@ func fuseNameToKey(name string) string {
 
 func (s *server) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	logrus.WithField("name", name).Debug("Open")
-	f := s.db.Get(fuseNameToKey(name))
+	// Device nodes, named pipes and sockets are opened by the kernel, there
+	// is no content to serve for them. Device nodes in the upper dir must not
+	// be opened either, that would open the devices of the host.
+	if flags&fuse.O_ANYWRITE != 0 && s.upper == nil {
+		return nil, fuse.EROFS
+	}
+	attr, status := s.checkAccess(name, openMask(flags), context)
+	if !status.Ok() {
+		return nil, status
+	}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		return nil, fuse.Status(syscall.ENXIO)
+	}
+	if s.inUpper(name) {
+		return s.upper.Open(name, flags, context)
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		if status := s.copyUp(name); !status.Ok() {
+			return nil, status
+		}
+		return s.upper.Open(name, flags, context)
+	}
+
+	f := s.lookup(name)
 	if f == nil {
 		return nil, fuse.ENOENT
 	}
+	return s.openFile(f)
+}
 
+// openFile returns a read-only file for an archive entry.
+func (s *server) openFile(fi FileInfo) (nodefs.File, fuse.Status) {
+	if err := s.verifyFile(fi); err != nil {
+		return nil, fuse.EIO
+	}
 	return &file{
-		ReaderAt: io.NewSectionReader(s.stream, f.Inode(), f.Size()),
+		ReaderAt: s.data(fi),
 		File:     nodefs.NewReadOnlyFile(nodefs.NewDefaultFile()),
-		name:     f.Name(),
+		name:     fi.Name(),
 	}, fuse.OK
 }
 
 func (s *server) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	logrus.WithField("name", name).Debug("OpenDir")
-	dir := s.db.Get(fuseNameToKey(name))
+	if _, status := s.checkAccess(name, accessRead, context); !status.Ok() {
+		return nil, status
+	}
+	return s.readDir(name, context)
+}
+
+// readDir returns the entries of a directory, without checking permissions.
+func (s *server) readDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	var entries []fuse.DirEntry
+	inUpper := s.inUpper(name)
+	if inUpper {
+		upperEntries, status := s.upper.OpenDir(name, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		for _, e := range upperEntries {
+			if !isReserved(e.Name) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	dir := s.lookup(name)
+	if inUpper && (dir == nil || !dir.Mode().IsDir()) {
+		return entries, fuse.OK
+	}
 	if dir == nil {
 		return nil, fuse.ENOENT
 	}
 	if !dir.Mode().IsDir() {
-		return nil, fuse.EIO
+		return nil, fuse.ENOTDIR
 	}
 
-	if !checkPermissions(dir, context) {
-		return nil, fuse.EPERM
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		seen[e.Name] = struct{}{}
 	}
 
 	dirEntries := s.db.Entries(fuseNameToKey(name))
-
-	entries := make([]fuse.DirEntry, 0, len(dirEntries))
 	for _, e := range dirEntries {
-		entries = append(entries, fuse.DirEntry{
-			Name: filepath.Base(e.Name()),
-			Mode: uint32(e.Mode()),
-		})
+		base := filepath.Base(e.Name())
+		if _, ok := seen[base]; ok {
+			continue
+		}
+		if s.upper != nil && s.lookup(filepath.Join(name, base)) == nil {
+			// removed from the overlay
+			continue
+		}
+		entries = append(entries, dirEntry(e))
 	}
 
 	return entries, fuse.OK
 }
 
+// dirEntry returns the directory listing entry of an archive entry.
+func dirEntry(fi FileInfo) fuse.DirEntry {
+	return fuse.DirEntry{
+		Name: filepath.Base(fi.Name()),
+		Mode: fuseMode(fi.Mode()),
+		Ino:  uint64(fi.Inode()),
+	}
+}
+
 func (s *server) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr, status fuse.Status) {
 	logrus.WithField("name", name).Debug("GetAttr")
 	defer func() {
 		logrus.WithField("name", name).WithField("status", status).WithField("attr", attr).Debug("end GetAttr")
 	}()
-	fi := s.db.Get(fuseNameToKey(name))
-	if fi == nil {
-		return nil, fuse.ENOENT
-	}
-	if !checkPermissions(fi, context) {
-		return nil, fuse.EPERM
-	}
+	return s.checkAccess(name, 0, context)
+}
+
+// fileAttr returns the fuse attributes of an archive entry, with the id
+// mappings and umask of the server applied.
+func (s *server) fileAttr(fi FileInfo) *fuse.Attr {
+	attr := entryAttr(fi)
+	attr.Uid = s.uids.toHost(attr.Uid)
+	attr.Gid = s.gids.toHost(attr.Gid)
+	attr.Mode &^= s.umask
+	return attr
+}
 
-	attr = &fuse.Attr{
-		Mtime: uint64(fi.ModTime().Unix()),
-		Mode:  uint32(fi.Mode().Perm()),
-		Size:  uint64(fi.Size()),
+// entryAttr returns the fuse attributes of an archive entry.
+func entryAttr(fi FileInfo) *fuse.Attr {
+	atime, mtime, ctime := fi.AccessTime(), fi.ModTime(), fi.ChangeTime()
+	attr := &fuse.Attr{
+		Ino:       uint64(fi.Inode()),
+		Nlink:     fi.Nlink(),
+		Atime:     uint64(atime.Unix()),
+		Atimensec: uint32(atime.Nanosecond()),
+		Mtime:     uint64(mtime.Unix()),
+		Mtimensec: uint32(mtime.Nanosecond()),
+		Ctime:     uint64(ctime.Unix()),
+		Ctimensec: uint32(ctime.Nanosecond()),
+		Mode:      fuseMode(fi.Mode()),
+		Size:      uint64(fi.Size()),
+		Blocks:    uint64(blockAlign(storedSize(fi)) / blockSize),
 	}
-	switch {
-	case fi.Mode().IsDir():
-		attr.Mode |= fuse.S_IFDIR
-	case (fi.Mode() & os.ModeSymlink) == os.ModeSymlink:
-		attr.Mode |= fuse.S_IFLNK
-	default:
-		attr.Mode |= fuse.S_IFREG
+	setBlksize(attr, ioBlockSize)
+	if major, minor := fi.Device(); major != 0 || minor != 0 {
+		attr.Rdev = uint32(unix.Mkdev(major, minor))
 	}
 
 	owner := fi.Owner()
@@ -218,29 +772,128 @@ func (s *server) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr, s
 		Uid: owner.UID,
 		Gid: owner.GID,
 	}
+	return attr
+}
 
-	return attr, fuse.OK
+func (s *server) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	logrus.WithField("name", name).Debug("Readlink")
+	if _, status := s.checkAccess(name, 0, context); !status.Ok() {
+		return "", status
+	}
+	if s.inUpper(name) {
+		return s.upper.Readlink(name, context)
+	}
+	fi := s.lookup(name)
+	if fi == nil {
+		return "", fuse.ENOENT
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", fuse.EINVAL
+	}
+	return fi.Linkname(), fuse.OK
 }
 
-func (s *server) StatFs(name string) *fuse.StatfsOut {
-	// TODO: actually fill this in
-	// But this is good enough to make this work with overlayfs.
-	return &fuse.StatfsOut{}
+func (s *server) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	logrus.WithField("name", name).WithField("attr", attr).Debug("GetXAttr")
+	if _, status := s.checkAccess(name, 0, context); !status.Ok() {
+		return nil, status
+	}
+	if s.inUpper(name) {
+		return s.upper.GetXAttr(name, attr, context)
+	}
+	fi := s.lookup(name)
+	if fi == nil {
+		return nil, fuse.ENOENT
+	}
+	v, ok := fi.Xattrs()[attr]
+	if !ok {
+		return nil, fuse.ENOATTR
+	}
+	return s.hostXattr(attr, v), fuse.OK
 }
 
-func checkPermissions(fi FileInfo, context *fuse.Context) bool {
-	owner := fi.Owner()
-	perms := fi.Mode().Perm()
+func (s *server) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	logrus.WithField("name", name).Debug("ListXAttr")
+	if _, status := s.checkAccess(name, 0, context); !status.Ok() {
+		return nil, status
+	}
+	if s.inUpper(name) {
+		return s.upper.ListXAttr(name, context)
+	}
+	fi := s.lookup(name)
+	if fi == nil {
+		return nil, fuse.ENOENT
+	}
+	return xattrNames(fi), fuse.OK
+}
 
-	if perms&(1<<2) != 0 {
-		return true
+func xattrNames(fi FileInfo) []string {
+	xattrs := fi.Xattrs()
+	attrs := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		attrs = append(attrs, k)
 	}
-	if owner.GID == context.Owner.Gid {
-		return perms&(1<<5) != 0
+	sort.Strings(attrs)
+	return attrs
+}
+
+// OnUnmount releases the metadata store if it holds any resources.
+func (s *server) OnUnmount() {
+	if c, ok := s.db.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logrus.WithError(err).Error("error closing metadata store")
+		}
 	}
-	if owner.UID == context.Owner.Uid {
-		return perms&(1<<8) != 0
+}
+
+// nameMax is the maximum length of a file name reported by StatFs. Archives
+// may have longer names, but the upper dir and most tools are limited to it.
+const nameMax = 255
+
+// StatFs reports the space used by the files in the archive. Read-only
+// filesystems have no free space, writable ones report the free space of the
+// filesystem of the upper dir.
+// The filesystem id is assigned by the kernel.
+func (s *server) StatFs(name string) *fuse.StatfsOut {
+	usage := s.usage()
+	out := &fuse.StatfsOut{
+		Blocks:  (usage.Bytes + ioBlockSize - 1) / ioBlockSize,
+		Files:   usage.Entries,
+		Bsize:   ioBlockSize,
+		Frsize:  ioBlockSize,
+		NameLen: nameMax,
 	}
+	if s.upper == nil {
+		return out
+	}
+	upper := s.upper.StatFs("")
+	if upper == nil {
+		return out
+	}
+	frsize := uint64(upper.Frsize)
+	if frsize == 0 {
+		frsize = uint64(upper.Bsize)
+	}
+	out.Bfree = upper.Bfree * frsize / ioBlockSize
+	out.Bavail = upper.Bavail * frsize / ioBlockSize
+	out.Blocks += out.Bfree
+	out.Ffree = upper.Ffree
+	out.Files += out.Ffree
+	return out
+}
 
-	return false
+// usage returns the space used by the entries of the metadata store.
+// Stores which don't keep track of it are walked once.
+func (s *server) usage() Usage {
+	if c, ok := s.db.(UsageCounter); ok {
+		return c.Usage()
+	}
+	s.usageOnce.Do(func() {
+		var keys []string
+		storeKeys(s.db, "/", &keys)
+		for _, k := range keys {
+			s.walkedUsage.add(entryUsage(s.db.Get(k)))
+		}
+	})
+	return s.walkedUsage
 }
@@ -3,12 +3,18 @@ package tarfs
 import (
 	"archive/tar"
 	"bytes"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"golang.org/x/sys/unix"
 )
 
 func TestFromReaderAt(t *testing.T) {
@@ -99,6 +105,532 @@ func TestFromReaderAt(t *testing.T) {
 	}
 }
 
+func TestReadlink(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+
+	hdrs := []*tar.Header{
+		newTestHeader("foo", os.ModeDir|0755, 0, time.Now()),
+		newTestHeader("foo/bar", 0644, 0, time.Now()),
+		{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/foo/bar", Mode: 0777},
+		{Name: "foo/rel", Typeflag: tar.TypeSymlink, Linkname: "../foo/bar", Mode: 0777},
+		{Name: "dangling", Typeflag: tar.TypeSymlink, Linkname: "does/not/exist", Mode: 0777},
+	}
+	for _, h := range hdrs {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	for _, h := range hdrs[2:] {
+		attr, status := fs.GetAttr(h.Name, fCtx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if attr.Mode&fuse.S_IFLNK != fuse.S_IFLNK {
+			t.Fatalf("expected symlink mode for %s, got %o", h.Name, attr.Mode)
+		}
+
+		target, status := fs.Readlink(h.Name, fCtx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if target != h.Linkname {
+			t.Fatalf("expected link target %q for %s, got %q", h.Linkname, h.Name, target)
+		}
+	}
+
+	if _, status := fs.Readlink("foo/bar", fCtx); status != fuse.EINVAL {
+		t.Fatalf("expected EINVAL for non-symlink, got %v", status)
+	}
+	if _, status := fs.Readlink("nope", fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for missing entry, got %v", status)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+
+	entries := []struct {
+		hdr  *tar.Header
+		data []byte
+	}{
+		{newTestHeader("foo", 0644, 5, time.Now()), []byte("hello")},
+		{&tar.Header{Name: "bar", Typeflag: tar.TypeLink, Linkname: "foo", Mode: 0644}, nil},
+		// link to a link
+		{&tar.Header{Name: "baz", Typeflag: tar.TypeLink, Linkname: "bar", Mode: 0644}, nil},
+		// links before their target
+		{&tar.Header{Name: "early2", Typeflag: tar.TypeLink, Linkname: "early", Mode: 0644}, nil},
+		{&tar.Header{Name: "early", Typeflag: tar.TypeLink, Linkname: "late", Mode: 0644}, nil},
+		{newTestHeader("late", 0644, 5, time.Now()), []byte("world")},
+	}
+	for _, e := range entries {
+		if err := w.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	for _, group := range []struct {
+		names []string
+		data  []byte
+	}{
+		{[]string{"foo", "bar", "baz"}, []byte("hello")},
+		{[]string{"late", "early", "early2"}, []byte("world")},
+	} {
+		var ino uint64
+		for _, name := range group.names {
+			attr, status := fs.GetAttr(name, fCtx)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			if ino == 0 {
+				ino = attr.Ino
+			}
+			if attr.Ino != ino {
+				t.Fatalf("expected %s to have inode %d, got %d", name, ino, attr.Ino)
+			}
+			if attr.Nlink != uint32(len(group.names)) {
+				t.Fatalf("expected %s to have %d links, got %d", name, len(group.names), attr.Nlink)
+			}
+			if attr.Size != uint64(len(group.data)) {
+				t.Fatalf("expected %s to have size %d, got %d", name, len(group.data), attr.Size)
+			}
+
+			f, status := fs.Open(name, uint32(os.O_RDONLY), fCtx)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			p := make([]byte, len(group.data))
+			rr, status := f.Read(p, 0)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			if !bytes.Equal(p, group.data) {
+				t.Fatalf("expected %q for %s, got %q", group.data, name, p)
+			}
+			rr.Done()
+		}
+	}
+}
+
+// collectInodes adds the inode numbers of `name` and everything below it to
+// inodes, and checks that directory entries report the same numbers.
+func collectInodes(t *testing.T, fs pathfs.FileSystem, name string, inodes map[string]uint64) {
+	fCtx := &fuse.Context{}
+	attr, status := fs.GetAttr(name, fCtx)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	inodes[name] = attr.Ino
+	if attr.Mode&syscall.S_IFMT != fuse.S_IFDIR {
+		return
+	}
+	entries, status := fs.OpenDir(name, fCtx)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	for _, e := range entries {
+		child := filepath.Join(name, e.Name)
+		collectInodes(t, fs, child, inodes)
+		if e.Ino != inodes[child] {
+			t.Fatalf("%s: expected dir entry inode %d, got %d", child, inodes[child], e.Ino)
+		}
+	}
+}
+
+func TestInodes(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		newTestHeader("dir", os.ModeDir|0755, 0, now),
+		newTestHeader("dir/empty", 0644, 0, now),
+		newTestHeader("dir/empty2", 0644, 0, now),
+		newTestHeader("file", 0644, 5, now),
+		{Typeflag: tar.TypeLink, Name: "link", Linkname: "file", ModTime: now},
+		{Typeflag: tar.TypeSymlink, Name: "symlink", Linkname: "file", ModTime: now},
+	} {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(testData(int(h.Size)))
+	}
+	w.Close()
+	data := buf.Bytes()
+
+	dir, err := ioutil.TempDir("", "tarfs-inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index")
+
+	var expected map[string]uint64
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		opts    []Opt
+	}{
+		{"uncompressed", data, nil},
+		{"gzip", gzipMembers(t, data, 2), nil},
+		{"index", data, []Opt{WithIndexFile(index)}},
+		{"from index", data, []Opt{WithIndexFile(index)}},
+	} {
+		rdr := bytes.NewReader(tc.archive)
+		fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inodes := make(map[string]uint64)
+		collectInodes(t, fs, "", inodes)
+		if expected == nil {
+			expected = inodes
+			continue
+		}
+		if !reflect.DeepEqual(inodes, expected) {
+			t.Fatalf("%s: expected the same inodes as before, got %v != %v", tc.name, inodes, expected)
+		}
+	}
+
+	if expected[""] != rootIno {
+		t.Fatalf("expected root inode %d, got %d", rootIno, expected[""])
+	}
+	if expected["link"] != expected["file"] {
+		t.Fatal("expected hard links to share the inode")
+	}
+	seen := make(map[uint64]string)
+	for name, ino := range expected {
+		if name == "link" {
+			continue
+		}
+		if other, ok := seen[ino]; ok {
+			t.Fatalf("%s and %s share inode %d", name, other, ino)
+		}
+		seen[ino] = name
+	}
+}
+
+func TestHardlinkMissingTarget(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	if err := w.WriteHeader(&tar.Header{Name: "foo", Typeflag: tar.TypeLink, Linkname: "nope", Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	if _, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2)); err == nil {
+		t.Fatal("expected error for hard link with missing target")
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+
+	capability := string([]byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00})
+	hdr := newTestHeader("foo", 0644, 0, time.Now())
+	hdr.PAXRecords = map[string]string{
+		"SCHILY.xattr.user.foo":            "bar",
+		"SCHILY.xattr.security.capability": capability,
+		"SCHILY.xattr.security.selinux":    "system_u:object_r:bin_t:s0",
+	}
+	if err := w.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(newTestHeader("bar", 0644, 0, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	attrs, status := fs.ListXAttr("foo", fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	expected := []string{"security.capability", "security.selinux", "user.foo"}
+	if strings.Join(attrs, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected xattrs %v, got %v", expected, attrs)
+	}
+
+	for k, v := range hdr.PAXRecords {
+		data, status := fs.GetXAttr("foo", strings.TrimPrefix(k, "SCHILY.xattr."), fCtx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if string(data) != v {
+			t.Fatalf("expected %q for %s, got %q", v, k, data)
+		}
+	}
+
+	if _, status := fs.GetXAttr("foo", "user.nope", fCtx); status != fuse.ENOATTR {
+		t.Fatalf("expected ENOATTR, got %v", status)
+	}
+	if _, status := fs.GetXAttr("bar", "user.foo", fCtx); status != fuse.ENOATTR {
+		t.Fatalf("expected ENOATTR, got %v", status)
+	}
+	attrs, status = fs.ListXAttr("bar", fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(attrs) != 0 {
+		t.Fatalf("expected no xattrs, got %v", attrs)
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: now},
+		{Typeflag: tar.TypeBlock, Name: "sda", Mode: 0660, Devmajor: 8, Devminor: 0, ModTime: now},
+		{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0644, ModTime: now},
+		{Typeflag: tar.TypeReg, Name: "socket", Mode: 0140644, ModTime: now},
+	} {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	entries, status := fs.OpenDir("", fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	modes := make(map[string]uint32)
+	for _, e := range entries {
+		modes[e.Name] = e.Mode & syscall.S_IFMT
+	}
+
+	for _, tc := range []struct {
+		name string
+		mode uint32
+		rdev uint64
+	}{
+		{"null", syscall.S_IFCHR, unix.Mkdev(1, 3)},
+		{"sda", syscall.S_IFBLK, unix.Mkdev(8, 0)},
+		{"fifo", syscall.S_IFIFO, 0},
+		{"socket", syscall.S_IFSOCK, 0},
+	} {
+		attr, status := fs.GetAttr(tc.name, fCtx)
+		if !status.Ok() {
+			t.Fatalf("%s: %v", tc.name, status)
+		}
+		if attr.Mode&syscall.S_IFMT != tc.mode {
+			t.Fatalf("%s: expected type %o, got %o", tc.name, tc.mode, attr.Mode&syscall.S_IFMT)
+		}
+		if uint64(attr.Rdev) != tc.rdev {
+			t.Fatalf("%s: expected rdev %d, got %d", tc.name, tc.rdev, attr.Rdev)
+		}
+		if modes[tc.name] != tc.mode {
+			t.Fatalf("%s: expected dir entry type %o, got %o", tc.name, tc.mode, modes[tc.name])
+		}
+		if _, status := fs.Open(tc.name, uint32(os.O_RDONLY), fCtx); status != fuse.Status(syscall.ENXIO) {
+			t.Fatalf("%s: expected ENXIO, got %v", tc.name, status)
+		}
+	}
+
+	// named pipes can be copied up without privileges
+	if status := fs.Chmod("fifo", 0600, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	st, err := os.Lstat(filepath.Join(dir, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected a named pipe in the upper dir, got %v", st.Mode())
+	}
+	if _, status := fs.Open("fifo", uint32(os.O_RDONLY), fCtx); status != fuse.Status(syscall.ENXIO) {
+		t.Fatalf("expected ENXIO for the upper dir, got %v", status)
+	}
+}
+
+func TestStat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	mtime := time.Unix(1500000000, 123456789)
+	atime := time.Unix(1500000001, 1)
+	ctime := time.Unix(1500000002, 2)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dir/", Mode: 01777, ModTime: mtime},
+		{Typeflag: tar.TypeDir, Name: "dir/a/", Mode: 0755, ModTime: mtime},
+		{Typeflag: tar.TypeDir, Name: "dir/b/", Mode: 02755, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 04755, Size: 1000, ModTime: mtime, AccessTime: atime, ChangeTime: ctime, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeReg, Name: "ustar", Mode: 0644, ModTime: time.Unix(1500000000, 0), Format: tar.FormatUSTAR},
+	} {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, h.Size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	for _, tc := range []struct {
+		name   string
+		mode   uint32
+		nlink  uint32
+		blocks uint64
+		atime  time.Time
+		mtime  time.Time
+		ctime  time.Time
+	}{
+		// the root is not in the archive, so it has no times
+		{"", fuse.S_IFDIR | 0755, 3, 0, time.Time{}, time.Time{}, time.Time{}},
+		{"dir", fuse.S_IFDIR | syscall.S_ISVTX | 0777, 4, 0, mtime.Truncate(time.Second), mtime.Truncate(time.Second), mtime.Truncate(time.Second)},
+		{"dir/b", fuse.S_IFDIR | syscall.S_ISGID | 0755, 2, 0, mtime.Truncate(time.Second), mtime.Truncate(time.Second), mtime.Truncate(time.Second)},
+		{"dir/file", fuse.S_IFREG | syscall.S_ISUID | 0755, 1, 2, atime, mtime, ctime},
+		{"ustar", fuse.S_IFREG | 0644, 1, 0, time.Unix(1500000000, 0), time.Unix(1500000000, 0), time.Unix(1500000000, 0)},
+	} {
+		attr, status := fs.GetAttr(tc.name, fCtx)
+		if !status.Ok() {
+			t.Fatalf("%s: %v", tc.name, status)
+		}
+		if attr.Mode != tc.mode {
+			t.Fatalf("%s: expected mode %o, got %o", tc.name, tc.mode, attr.Mode)
+		}
+		if attr.Nlink != tc.nlink {
+			t.Fatalf("%s: expected nlink %d, got %d", tc.name, tc.nlink, attr.Nlink)
+		}
+		if attr.Blocks != tc.blocks {
+			t.Fatalf("%s: expected %d blocks, got %d", tc.name, tc.blocks, attr.Blocks)
+		}
+		if tc.name == "" {
+			continue
+		}
+		for _, ts := range []struct {
+			kind     string
+			sec      uint64
+			nsec     uint32
+			expected time.Time
+		}{
+			{"atime", attr.Atime, attr.Atimensec, tc.atime},
+			{"mtime", attr.Mtime, attr.Mtimensec, tc.mtime},
+			{"ctime", attr.Ctime, attr.Ctimensec, tc.ctime},
+		} {
+			if actual := time.Unix(int64(ts.sec), int64(ts.nsec)); !actual.Equal(ts.expected) {
+				t.Fatalf("%s: expected %s %v, got %v", tc.name, ts.kind, ts.expected, actual)
+			}
+		}
+	}
+}
+
+// walkedStore hides the UsageCounter implementation of a store.
+type walkedStore struct {
+	MetadataStore
+}
+
+func TestStatFs(t *testing.T) {
+	data := newIndexTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-statfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index")
+
+	rdr := bytes.NewReader(data)
+	for _, tc := range []struct {
+		name string
+		db   MetadataStore
+		opts []Opt
+	}{
+		{"btree", NewBTreeStore(2), []Opt{WithIndexFile(index)}},
+		// uses the index written by the btree test
+		{"index", nil, []Opt{WithIndexFile(index)}},
+		{"walked", walkedStore{NewBTreeStore(2)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := FromReaderAt(rdr, rdr.Size(), tc.db, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := fs.StatFs("")
+			// the root, foo, foo/bar, foo/link, hardlink, null and xattr,
+			// with 512 bytes of data each for foo/bar and xattr
+			expected := fuse.StatfsOut{
+				Blocks:  1,
+				Files:   7,
+				Bsize:   ioBlockSize,
+				Frsize:  ioBlockSize,
+				NameLen: nameMax,
+			}
+			if *out != expected {
+				t.Fatalf("expected %+v, got %+v", expected, *out)
+			}
+		})
+	}
+
+	upper := filepath.Join(dir, "upper")
+	if err := os.Mkdir(upper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := FromReaderAt(rdr, rdr.Size(), nil, WithIndexFile(index), WithUpperDir(upper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fs.StatFs("")
+	if status := fs.Unlink("xattr", &fuse.Context{}); !status.Ok() {
+		t.Fatal(status)
+	}
+	after := fs.StatFs("")
+	if after.Files-after.Ffree != before.Files-before.Ffree-1 {
+		t.Fatalf("expected one file less after removing a file, got %d and %d", before.Files-before.Ffree, after.Files-after.Ffree)
+	}
+	if after.Bavail == 0 || after.Blocks <= after.Bfree {
+		t.Fatalf("expected free space from the upper dir, got %+v", *after)
+	}
+}
+
 func newTestHeader(name string, mode os.FileMode, size int64, modTime time.Time) *tar.Header {
 	if name != "" && name[len(name)-1] != '/' && mode.IsDir() {
 		name += string(os.PathSeparator)
@@ -106,7 +638,7 @@ func newTestHeader(name string, mode os.FileMode, size int64, modTime time.Time)
 	return &tar.Header{
 		Name:    name,
 		Size:    size,
-		Mode:    int64(mode),
+		Mode:    int64(unixPerm(mode)),
 		ModTime: modTime,
 	}
 }
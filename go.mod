@@ -0,0 +1,13 @@
+module github.com/cpuguy83/tarfs
+
+go 1.21
+
+require (
+	github.com/google/btree v0.0.0-20180124185431-e89373fe6b4a
+	github.com/hanwen/go-fuse/v2 v2.11.0
+	github.com/klauspost/compress v1.17.11
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.9.3
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/sys v0.28.0
+)
@@ -0,0 +1,216 @@
+package tarfs
+
+import (
+	"bufio"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+
+	gzipFlagHCRC    = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+)
+
+var errGzipHeader = errors.New("invalid gzip header")
+
+// gzipReader decompresses a, possibly multi-member, gzip stream.
+// Unlike `compress/gzip` it can be started from a checkpoint in the middle of
+// a member and reports checkpoints as it goes.
+type gzipReader struct {
+	br  bitReader
+	inf inflater
+
+	inMember bool
+	// verify is set when the current member was read from its start, which
+	// means the trailer checksum can be checked.
+	verify bool
+	crc    uint32
+	isize  uint32
+	// members is the number of members started by this reader.
+	members int
+
+	// onCheckpoint, if set, is called at every member start and at block
+	// boundaries at least `span` bytes of output after the previous
+	// checkpoint.
+	onCheckpoint func(checkpoint)
+	span         int64
+	last         int64
+}
+
+func newGzipReader(r io.Reader, base int64) *gzipReader {
+	g := &gzipReader{}
+	g.br.r = bufio.NewReaderSize(r, 64*1024)
+	g.br.base = base
+	g.inf.br = &g.br
+	g.inf.onBlock = g.blockBoundary
+	return g
+}
+
+// resumeGzip creates a gzipReader which starts decompressing at the passed in
+// checkpoint.
+func resumeGzip(ra io.ReaderAt, size int64, cp checkpoint) (*gzipReader, error) {
+	g := newGzipReader(io.NewSectionReader(ra, cp.in, size-cp.in), cp.in)
+	if _, err := g.br.readBits(uint(cp.bits)); err != nil {
+		return nil, errors.Wrap(err, "error seeking to gzip checkpoint")
+	}
+	g.inf.reset()
+	g.inf.setWindow(cp.window)
+	g.inf.out = cp.out
+	g.inMember = true
+	g.members = 1
+	return g, nil
+}
+
+func (g *gzipReader) checkpoint(window []byte) {
+	in, bits := g.br.offset()
+	g.last = g.inf.out
+	g.onCheckpoint(checkpoint{in: in, bits: bits, out: g.inf.out, window: window})
+}
+
+func (g *gzipReader) blockBoundary() {
+	if g.onCheckpoint == nil || g.inf.wlen == 0 {
+		// The start of a member is handled when the header is read.
+		return
+	}
+	if g.inf.out-g.last >= g.span {
+		g.checkpoint(g.inf.window())
+	}
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for {
+		if !g.inMember {
+			if err := g.readHeader(); err != nil {
+				return 0, err
+			}
+			g.inMember = true
+			g.verify = true
+			g.crc = 0
+			g.isize = 0
+			g.inf.reset()
+			if g.onCheckpoint != nil {
+				g.checkpoint(nil)
+			}
+		}
+
+		n, err := g.inf.Read(p)
+		if g.verify {
+			g.crc = crc32.Update(g.crc, crc32.IEEETable, p[:n])
+			g.isize += uint32(n)
+		}
+		if err == io.EOF {
+			g.inMember = false
+			if err := g.readTrailer(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (g *gzipReader) readTrailer() error {
+	g.br.alignByte()
+	var trailer [8]byte
+	for i := range trailer {
+		c, err := g.br.readByte()
+		if err != nil {
+			return errors.Wrap(err, "error reading gzip trailer")
+		}
+		trailer[i] = c
+	}
+	if !g.verify {
+		return nil
+	}
+	crc := uint32(trailer[0]) | uint32(trailer[1])<<8 | uint32(trailer[2])<<16 | uint32(trailer[3])<<24
+	isize := uint32(trailer[4]) | uint32(trailer[5])<<8 | uint32(trailer[6])<<16 | uint32(trailer[7])<<24
+	if crc != g.crc || isize != g.isize {
+		return errors.New("gzip checksum mismatch")
+	}
+	return nil
+}
+
+// readHeader reads a gzip member header.
+// io.EOF is returned when there are no more members in the stream.
+func (g *gzipReader) readHeader() error {
+	id1, err := g.br.readByte()
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+	id2, err := g.br.readByte()
+	if err != nil || id1 != gzipID1 || id2 != gzipID2 {
+		if g.members > 0 {
+			// Like gzip(1), ignore trailing garbage after the last member,
+			// some tools pad the compressed stream.
+			return io.EOF
+		}
+		return errGzipHeader
+	}
+	g.members++
+
+	var hdr [8]byte
+	for i := range hdr {
+		if hdr[i], err = g.br.readByte(); err != nil {
+			return errors.Wrap(err, "error reading gzip header")
+		}
+	}
+	if hdr[0] != gzipDeflate {
+		return errors.Wrap(errGzipHeader, "unsupported compression method")
+	}
+	flags := hdr[1]
+
+	if flags&gzipFlagExtra != 0 {
+		lo, err := g.br.readByte()
+		if err != nil {
+			return err
+		}
+		hi, err := g.br.readByte()
+		if err != nil {
+			return err
+		}
+		if err := g.skip(int(lo) | int(hi)<<8); err != nil {
+			return err
+		}
+	}
+	for _, f := range []byte{gzipFlagName, gzipFlagComment} {
+		if flags&f == 0 {
+			continue
+		}
+		for {
+			c, err := g.br.readByte()
+			if err != nil {
+				return errors.Wrap(err, "error reading gzip header")
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	if flags&gzipFlagHCRC != 0 {
+		return g.skip(2)
+	}
+	return nil
+}
+
+func (g *gzipReader) skip(n int) error {
+	for ; n > 0; n-- {
+		if _, err := g.br.readByte(); err != nil {
+			return errors.Wrap(err, "error reading gzip header")
+		}
+	}
+	return nil
+}
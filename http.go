@@ -0,0 +1,289 @@
+package tarfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements an io.ReaderAt for archives on HTTP servers, so they
+// can be served without downloading them first.
+
+// HTTPReaderAt reads a remote file with HTTP range requests.
+//
+// The file is pinned to the version which was found when the reader was
+// created, with its ETag or last modification time. Reads fail with
+// `ErrRemoteChanged` once the file changes on the server.
+// Concurrent reads of the same part of the file are served by a single
+// request.
+type HTTPReaderAt struct {
+	url          string
+	client       *http.Client
+	retries      int
+	retryDelay   time.Duration
+	size         int64
+	etag         string
+	lastModified string
+
+	mu       sync.Mutex
+	inflight map[*rangeRequest]struct{}
+}
+
+// ErrRemoteChanged is returned by `HTTPReaderAt` when the remote file changed
+// since the reader was created.
+var ErrRemoteChanged = errors.New("remote file changed")
+
+// HTTPOpt is used to configure an `HTTPReaderAt`.
+type HTTPOpt func(*HTTPReaderAt)
+
+// WithHTTPClient sets the client used for requests, the default is
+// `http.DefaultClient`.
+func WithHTTPClient(client *http.Client) HTTPOpt {
+	return func(r *HTTPReaderAt) {
+		r.client = client
+	}
+}
+
+// WithRetries sets how often failed requests are retried, and the delay
+// before the first retry, which is doubled for every following retry.
+// Requests are retried on network errors and server errors, by default 3
+// times starting after 100ms.
+func WithRetries(retries int, delay time.Duration) HTTPOpt {
+	return func(r *HTTPReaderAt) {
+		r.retries = retries
+		r.retryDelay = delay
+	}
+}
+
+// NewHTTPReaderAt returns a reader for the file at the passed in URL.
+// The server must support range requests.
+func NewHTTPReaderAt(url string, opts ...HTTPOpt) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{
+		url:        url,
+		client:     http.DefaultClient,
+		retries:    3,
+		retryDelay: 100 * time.Millisecond,
+		inflight:   make(map[*rangeRequest]struct{}),
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if err := r.stat(); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", url)
+	}
+	return r, nil
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+// stat discovers the size and version of the remote file. Servers which don't
+// answer HEAD requests properly are asked for the first byte of the file
+// instead, the size is then taken from the Content-Range header.
+func (r *HTTPReaderAt) stat() error {
+	resp, err := r.do("HEAD", "", false)
+	if err == nil {
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.Header.Get("Accept-Ranges") == "bytes" {
+			r.size = resp.ContentLength
+			r.pin(resp)
+			return nil
+		}
+	}
+
+	resp, err = r.do("GET", "bytes=0-0", false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		_, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		r.size = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// empty files have no first byte
+		r.size = 0
+	default:
+		return errors.New("server does not support range requests")
+	}
+	r.pin(resp)
+	return nil
+}
+
+// pin records the version of the remote file.
+func (r *HTTPReaderAt) pin(resp *http.Response) {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		r.etag = etag
+		return
+	}
+	r.lastModified = resp.Header.Get("Last-Modified")
+}
+
+// do sends a request, retrying it if it fails. If `pinned` is set the request
+// only succeeds if the file did not change.
+func (r *HTTPReaderAt) do(method, byteRange string, pinned bool) (*http.Response, error) {
+	delay := r.retryDelay
+	for i := 0; ; i++ {
+		req, err := http.NewRequest(method, r.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		if pinned {
+			if r.etag != "" {
+				req.Header.Set("If-Match", r.etag)
+			} else if r.lastModified != "" {
+				req.Header.Set("If-Unmodified-Since", r.lastModified)
+			}
+		}
+
+		resp, err := r.client.Do(req)
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body) // nolint: errcheck
+			resp.Body.Close()                  // nolint: errcheck
+			err = errors.Errorf("unexpected response: %s", resp.Status)
+		}
+		if i >= r.retries {
+			return nil, err
+		}
+		logrus.WithError(err).WithField("url", r.url).WithField("range", byteRange).Debug("retrying request")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// rangeRequest is a request for a part of the file, which concurrent reads of
+// the same part wait for.
+type rangeRequest struct {
+	off  int64
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+// ReadAt reads len(p) bytes from off with a single range request.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	req := r.request(off, end)
+	<-req.done
+	if req.err != nil {
+		return 0, req.err
+	}
+	n := copy(p, req.data[off-req.off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// request returns a request which reads the part of the file from off to end,
+// either one which is already in flight or a new one.
+func (r *HTTPReaderAt) request(off, end int64) *rangeRequest {
+	r.mu.Lock()
+	for req := range r.inflight {
+		if req.off <= off && req.off+int64(len(req.data)) >= end {
+			r.mu.Unlock()
+			return req
+		}
+	}
+	req := &rangeRequest{off: off, data: make([]byte, end-off), done: make(chan struct{})}
+	r.inflight[req] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		req.err = r.fetch(req.off, req.data)
+		r.mu.Lock()
+		delete(r.inflight, req)
+		r.mu.Unlock()
+		close(req.done)
+	}()
+	return req
+}
+
+// fetch reads len(p) bytes from off with a range request.
+func (r *HTTPReaderAt) fetch(off int64, p []byte) error {
+	end := off + int64(len(p)) - 1
+	resp, err := r.do("GET", fmt.Sprintf("bytes=%d-%d", off, end), true)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", r.url)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusPreconditionFailed:
+		return ErrRemoteChanged
+	default:
+		return errors.Errorf("error reading %s: unexpected response: %s", r.url, resp.Status)
+	}
+	if etag := resp.Header.Get("ETag"); r.etag != "" && etag != "" && etag != r.etag {
+		return ErrRemoteChanged
+	}
+	start, last, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", r.url)
+	}
+	if size != r.size {
+		return ErrRemoteChanged
+	}
+	if start != off || last != end {
+		return errors.Errorf("error reading %s: server returned range %d-%d instead of %d-%d", r.url, start, last, off, end)
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return errors.Wrapf(err, "error reading %s", r.url)
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// `bytes <first>-<last>/<size>`.
+func parseContentRange(s string) (first, last, size int64, err error) {
+	invalid := errors.Errorf("invalid Content-Range: %q", s)
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(s, '/')
+	dash := strings.IndexByte(s, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, invalid
+	}
+	if first, err = strconv.ParseInt(s[:dash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if last, err = strconv.ParseInt(s[dash+1:slash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if size, err = strconv.ParseInt(s[slash+1:], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	return first, last, size, nil
+}
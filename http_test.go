@@ -0,0 +1,211 @@
+package tarfs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testHTTPServer serves a file with range requests and counts the requests.
+type testHTTPServer struct {
+	mu       sync.Mutex
+	data     []byte
+	etag     string
+	noHead   bool
+	failures int
+	block    chan struct{}
+	requests map[string]int
+}
+
+func (s *testHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.Method]++
+	data, etag, block := s.data, s.etag, s.block
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Unlock()
+
+	if r.Method == "HEAD" && s.noHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if block != nil && r.Method == "GET" {
+		<-block
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *testHTTPServer) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func newTestHTTPServer(t *testing.T, data []byte) (*testHTTPServer, *httptest.Server) {
+	s := &testHTTPServer{data: data, etag: `"v1"`, requests: make(map[string]int)}
+	return s, httptest.NewServer(s)
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	data := testArchive(t, []testEntry{
+		{"dir", os.ModeDir | 0755, "", nil},
+		{"dir/file", 0644, "hello world", nil},
+	})
+	s, srv := newTestHTTPServer(t, data)
+	defer srv.Close()
+
+	r, err := NewHTTPReaderAt(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), r.Size())
+	}
+
+	fs, err := FromReaderAt(r, r.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, status := fs.Open("dir/file", uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	content := make([]byte, 11)
+	rr, status := f.Read(content, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if string(content) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", content)
+	}
+	rr.Done()
+
+	p := make([]byte, 10)
+	n, err := r.ReadAt(p, int64(len(data)-5))
+	if n != 5 || err != io.EOF {
+		t.Fatalf("expected 5 bytes and EOF at the end of the file, got %d, %v", n, err)
+	}
+	if !bytes.Equal(p[:n], data[len(data)-5:]) {
+		t.Fatal("content does not match")
+	}
+	if _, err := r.ReadAt(p, int64(len(data))); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	s.mu.Lock()
+	s.etag = `"v2"`
+	s.mu.Unlock()
+	if _, err := r.ReadAt(p, 0); err != ErrRemoteChanged {
+		t.Fatalf("expected ErrRemoteChanged, got %v", err)
+	}
+}
+
+func TestHTTPReaderAtNoHead(t *testing.T) {
+	data := testData(1000)
+	s, srv := newTestHTTPServer(t, data)
+	defer srv.Close()
+	s.noHead = true
+	s.etag = ""
+
+	r, err := NewHTTPReaderAt(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), r.Size())
+	}
+	p := make([]byte, 100)
+	if _, err := r.ReadAt(p, 500); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[500:600]) {
+		t.Fatal("content does not match")
+	}
+
+	s.mu.Lock()
+	s.data = testData(2000)
+	s.mu.Unlock()
+	if _, err := r.ReadAt(p, 0); err != ErrRemoteChanged {
+		t.Fatalf("expected ErrRemoteChanged, got %v", err)
+	}
+}
+
+func TestHTTPReaderAtRetries(t *testing.T) {
+	data := testData(1000)
+	s, srv := newTestHTTPServer(t, data)
+	defer srv.Close()
+
+	s.failures = 2
+	r, err := NewHTTPReaderAt(srv.URL, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 100)
+	s.mu.Lock()
+	s.failures = 2
+	s.mu.Unlock()
+	if _, err := r.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[:100]) {
+		t.Fatal("content does not match")
+	}
+
+	s.mu.Lock()
+	s.failures = 3
+	s.mu.Unlock()
+	if _, err := r.ReadAt(p, 0); err == nil {
+		t.Fatal("expected error after running out of retries")
+	}
+}
+
+func TestHTTPReaderAtCoalescing(t *testing.T) {
+	data := testData(1000)
+	s, srv := newTestHTTPServer(t, data)
+	defer srv.Close()
+
+	r, err := NewHTTPReaderAt(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.block = make(chan struct{})
+	s.mu.Unlock()
+	first := r.request(0, 500)
+	if second := r.request(100, 200); second != first {
+		t.Fatal("expected read within an in-flight request to wait for it")
+	}
+	other := r.request(400, 600)
+	if other == first {
+		t.Fatal("expected read outside of an in-flight request to send a new request")
+	}
+	close(s.block)
+	<-first.done
+	<-other.done
+
+	if first.err != nil {
+		t.Fatal(first.err)
+	}
+	if !bytes.Equal(first.data, data[:500]) {
+		t.Fatal("content does not match")
+	}
+	if n := s.count("GET"); n != 2 {
+		t.Fatalf("expected 2 range requests, got %d", n)
+	}
+}
@@ -0,0 +1,195 @@
+package tarfs
+
+import (
+	"encoding/binary"
+)
+
+// This file implements the mapping of the uids and gids of archive entries to
+// host ids, see `WithIDMappings` and `WithOwner`.
+
+// overflowID is reported for ids which are not mapped, like the kernel does
+// for user namespaces (see /proc/sys/kernel/overflowuid).
+const overflowID = 65534
+
+// IDMapping maps a range of ids in the archive to ids on the host, like a line
+// of /proc/<pid>/uid_map or the ranges passed to newuidmap(1).
+type IDMapping struct {
+	// ContainerID is the first id of the range in the archive.
+	ContainerID uint32
+	// HostID is the first host id the range is mapped to.
+	HostID uint32
+	// Size is the number of ids in the range.
+	Size uint32
+}
+
+// WithIDMappings maps the uids and gids of the archive to host ids, e.g. to
+// shift the ids of an archive into the subordinate id range of a rootless
+// container. Ids which are not in any range are reported as the overflow id
+// 65534. nil leaves the uids or gids unchanged.
+//
+// The mapped ids are used for the attributes of entries and permission checks,
+// and the ids in POSIX ACLs and `security.capability` xattrs are mapped as
+// well. Capabilities of the mapped root user are reported as v3 capabilities,
+// so they only apply in its user namespace.
+// Files copied to the upper dir (see `WithUpperDir`) get the mapped ids, and
+// `Export` maps the ids of the files in the upper dir back.
+func WithIDMappings(uids, gids []IDMapping) Opt {
+	return func(c *config) {
+		if uids != nil {
+			c.uids = &idMap{ranges: uids}
+		}
+		if gids != nil {
+			c.gids = &idMap{ranges: gids}
+		}
+	}
+}
+
+// idMap maps ids of the archive to host ids. A nil map leaves ids unchanged.
+type idMap struct {
+	ranges []IDMapping
+	// squash is set if all ids are mapped to `id`, see `WithOwner`
+	squash bool
+	id     uint32
+}
+
+// squashIDs returns a map which maps all ids to `id`, or nil if it is
+// negative.
+func squashIDs(id int) *idMap {
+	if id < 0 {
+		return nil
+	}
+	return &idMap{squash: true, id: uint32(id)}
+}
+
+// toHost maps an id of the archive to a host id.
+func (m *idMap) toHost(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	if m.squash {
+		return m.id
+	}
+	for _, r := range m.ranges {
+		if id >= r.ContainerID && id-r.ContainerID < r.Size {
+			return r.HostID + (id - r.ContainerID)
+		}
+	}
+	return overflowID
+}
+
+// toContainer maps a host id back to an id of the archive. Squashed ids can
+// not be mapped back and are left unchanged.
+func (m *idMap) toContainer(id uint32) uint32 {
+	if m == nil || m.squash {
+		return id
+	}
+	for _, r := range m.ranges {
+		if id >= r.HostID && id-r.HostID < r.Size {
+			return r.ContainerID + (id - r.HostID)
+		}
+	}
+	return overflowID
+}
+
+// Xattrs which hold ids.
+const (
+	xattrCapability = "security.capability"
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// The layout of `security.capability`, see linux/capability.h.
+// Version 3 adds the uid of the root user of the user namespace the
+// capabilities apply in, version 2 capabilities apply to all namespaces.
+const (
+	capRevisionMask = 0xff000000
+	capRevision2    = 0x02000000
+	capRevision3    = 0x03000000
+	capV2Size       = 20
+	capV3Size       = 24
+)
+
+// The layout of POSIX ACL xattrs, see linux/posix_acl_xattr.h.
+const (
+	aclVersion    = 2
+	aclHeaderSize = 4
+	aclEntrySize  = 8
+	aclUser       = 0x02
+	aclGroup      = 0x08
+)
+
+// mapXattr maps the ids in the value of an xattr. Values which are not
+// understood are returned unchanged.
+func mapXattr(name string, value []byte, mapUID, mapGID func(uint32) uint32) []byte {
+	switch name {
+	case xattrCapability:
+		return mapCapability(value, mapUID)
+	case xattrACLAccess, xattrACLDefault:
+		return mapACL(value, mapUID, mapGID)
+	}
+	return value
+}
+
+// mapCapability maps the root id of capabilities. The result is a version 2
+// capability if the root id is mapped to 0, and a version 3 one otherwise.
+func mapCapability(value []byte, mapUID func(uint32) uint32) []byte {
+	if len(value) < 4 {
+		return value
+	}
+	magic := binary.LittleEndian.Uint32(value)
+	var rootID uint32
+	switch {
+	case magic&capRevisionMask == capRevision2 && len(value) == capV2Size:
+	case magic&capRevisionMask == capRevision3 && len(value) == capV3Size:
+		rootID = binary.LittleEndian.Uint32(value[capV2Size:])
+	default:
+		return value
+	}
+
+	out := make([]byte, capV3Size)
+	copy(out, value[:capV2Size])
+	revision := uint32(capRevision2)
+	if rootID = mapUID(rootID); rootID != 0 {
+		revision = capRevision3
+		binary.LittleEndian.PutUint32(out[capV2Size:], rootID)
+	} else {
+		out = out[:capV2Size]
+	}
+	binary.LittleEndian.PutUint32(out, magic&^capRevisionMask|revision)
+	return out
+}
+
+// mapACL maps the ids of the named user and group entries of an ACL.
+func mapACL(value []byte, mapUID, mapGID func(uint32) uint32) []byte {
+	if len(value) < aclHeaderSize || (len(value)-aclHeaderSize)%aclEntrySize != 0 || binary.LittleEndian.Uint32(value) != aclVersion {
+		return value
+	}
+	out := append([]byte(nil), value...)
+	for off := aclHeaderSize; off < len(out); off += aclEntrySize {
+		id := out[off+4 : off+8]
+		switch binary.LittleEndian.Uint16(out[off:]) {
+		case aclUser:
+			binary.LittleEndian.PutUint32(id, mapUID(binary.LittleEndian.Uint32(id)))
+		case aclGroup:
+			binary.LittleEndian.PutUint32(id, mapGID(binary.LittleEndian.Uint32(id)))
+		}
+	}
+	return out
+}
+
+// hostXattr maps the ids in an xattr of an archive entry to host ids.
+func (s *server) hostXattr(name string, value []byte) []byte {
+	if s.uids == nil && s.gids == nil {
+		return value
+	}
+	return mapXattr(name, value, s.uids.toHost, s.gids.toHost)
+}
+
+// containerXattr maps the ids in an xattr of a file in the upper dir back to
+// ids of the archive.
+func (s *server) containerXattr(name string, value []byte) []byte {
+	if s.uids == nil && s.gids == nil {
+		return value
+	}
+	return mapXattr(name, value, s.uids.toContainer, s.gids.toContainer)
+}
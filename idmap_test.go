@@ -0,0 +1,174 @@
+package tarfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var testIDMappings = []IDMapping{
+	{ContainerID: 0, HostID: 100000, Size: 1000},
+	{ContainerID: 1000, HostID: 1000, Size: 1},
+}
+
+func TestIDMap(t *testing.T) {
+	m := &idMap{ranges: testIDMappings}
+	for _, tc := range []struct {
+		container, host uint32
+	}{
+		{0, 100000},
+		{999, 100999},
+		{1000, 1000},
+	} {
+		if id := m.toHost(tc.container); id != tc.host {
+			t.Fatalf("expected %d to be mapped to %d, got %d", tc.container, tc.host, id)
+		}
+		if id := m.toContainer(tc.host); id != tc.container {
+			t.Fatalf("expected %d to be mapped back to %d, got %d", tc.host, tc.container, id)
+		}
+	}
+	if id := m.toHost(1001); id != overflowID {
+		t.Fatalf("expected overflow id for unmapped id, got %d", id)
+	}
+	if id := m.toContainer(0); id != overflowID {
+		t.Fatalf("expected overflow id for unmapped host id, got %d", id)
+	}
+
+	squash := squashIDs(42)
+	if squash.toHost(0) != 42 || squash.toHost(1001) != 42 || squash.toContainer(7) != 7 {
+		t.Fatal("unexpected squashed ids")
+	}
+	if squashIDs(-1) != nil {
+		t.Fatal("expected nil map for negative id")
+	}
+	var none *idMap
+	if none.toHost(7) != 7 || none.toContainer(7) != 7 {
+		t.Fatal("expected nil map to leave ids unchanged")
+	}
+}
+
+func testCapability(revision uint32, rootID uint32) []byte {
+	size := capV2Size
+	if revision == capRevision3 {
+		size = capV3Size
+	}
+	b := make([]byte, size)
+	// effective flag and CAP_NET_BIND_SERVICE
+	binary.LittleEndian.PutUint32(b, revision|1)
+	binary.LittleEndian.PutUint32(b[4:], 1<<10)
+	if revision == capRevision3 {
+		binary.LittleEndian.PutUint32(b[capV2Size:], rootID)
+	}
+	return b
+}
+
+func TestMapCapability(t *testing.T) {
+	m := &idMap{ranges: testIDMappings}
+	v2 := testCapability(capRevision2, 0)
+	v3 := testCapability(capRevision3, 100000)
+
+	if out := mapCapability(v2, m.toHost); !bytes.Equal(out, v3) {
+		t.Fatalf("expected v2 capability to be mapped to %x, got %x", v3, out)
+	}
+	if out := mapCapability(testCapability(capRevision3, 0), m.toHost); !bytes.Equal(out, v3) {
+		t.Fatalf("expected v3 capability to be mapped to %x, got %x", v3, out)
+	}
+	if out := mapCapability(v3, m.toContainer); !bytes.Equal(out, v2) {
+		t.Fatalf("expected capability to be mapped back to %x, got %x", v2, out)
+	}
+	if out := mapCapability(testCapability(capRevision3, 5000), m.toHost); binary.LittleEndian.Uint32(out[capV2Size:]) != overflowID {
+		t.Fatalf("expected overflow root id, got %x", out)
+	}
+
+	invalid := []byte{0x01, 0x00, 0x00, 0x02}
+	if out := mapCapability(invalid, m.toHost); !bytes.Equal(out, invalid) {
+		t.Fatalf("expected invalid capability to be unchanged, got %x", out)
+	}
+}
+
+func TestMapACL(t *testing.T) {
+	acl := func(entries ...[3]uint32) []byte {
+		b := make([]byte, aclHeaderSize, aclHeaderSize+len(entries)*aclEntrySize)
+		binary.LittleEndian.PutUint32(b, aclVersion)
+		for _, e := range entries {
+			entry := make([]byte, aclEntrySize)
+			binary.LittleEndian.PutUint16(entry, uint16(e[0]))
+			binary.LittleEndian.PutUint16(entry[2:], uint16(e[1]))
+			binary.LittleEndian.PutUint32(entry[4:], e[2])
+			b = append(b, entry...)
+		}
+		return b
+	}
+	const userObj, other = 0x01, 0x20
+	in := acl([3]uint32{userObj, 6, ^uint32(0)}, [3]uint32{aclUser, 4, 1}, [3]uint32{aclGroup, 4, 1000}, [3]uint32{other, 4, ^uint32(0)})
+	expected := acl([3]uint32{userObj, 6, ^uint32(0)}, [3]uint32{aclUser, 4, 100001}, [3]uint32{aclGroup, 4, 2000}, [3]uint32{other, 4, ^uint32(0)})
+
+	mapUID := (&idMap{ranges: testIDMappings}).toHost
+	mapGID := squashIDs(2000).toHost
+	if out := mapXattr(xattrACLAccess, in, mapUID, mapGID); !bytes.Equal(out, expected) {
+		t.Fatalf("expected %x, got %x", expected, out)
+	}
+	if out := mapXattr("user.foo", in, mapUID, mapGID); !bytes.Equal(out, in) {
+		t.Fatalf("expected other xattrs to be unchanged, got %x", out)
+	}
+}
+
+func TestIDMappings(t *testing.T) {
+	user := newTestHeader("user", 0600, 0, time.Time{})
+	user.Uid, user.Gid = 1000, 1000
+	unmapped := newTestHeader("unmapped", 0600, 0, time.Time{})
+	unmapped.Uid, unmapped.Gid = 5000, 5000
+	root := newTestHeader("root", 0600, 0, time.Time{})
+	root.PAXRecords = map[string]string{paxSchilyXattr + xattrCapability: string(testCapability(capRevision2, 0))}
+	data := testArchive(t, []testEntry{{hdr: root}, {hdr: user}, {hdr: unmapped}})
+
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithIDMappings(testIDMappings, []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]fuse.Owner{
+		"root":     {Uid: 100000, Gid: 200000},
+		"user":     {Uid: 1000, Gid: 201000},
+		"unmapped": {Uid: overflowID, Gid: 205000},
+	} {
+		attr, status := fs.GetAttr(name, rootContext)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if attr.Owner != expected {
+			t.Fatalf("%s: expected %d:%d, got %d:%d", name, expected.Uid, expected.Gid, attr.Uid, attr.Gid)
+		}
+	}
+
+	// permissions are checked against the mapped owner
+	for _, tc := range []struct {
+		name    string
+		context *fuse.Context
+		status  fuse.Status
+	}{
+		{"root", &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 100000, Gid: 100000}}}, fuse.OK},
+		{"user", &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}}, fuse.OK},
+		{"user", &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 101000, Gid: 1000}}}, fuse.EACCES},
+	} {
+		f, status := fs.Open(tc.name, uint32(os.O_RDONLY), tc.context)
+		if status != tc.status {
+			t.Fatalf("%s (uid %d): expected %v, got %v", tc.name, tc.context.Uid, tc.status, status)
+		}
+		if f != nil {
+			f.Release()
+		}
+	}
+
+	data, status := fs.GetXAttr("root", xattrCapability, rootContext)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if expected := testCapability(capRevision3, 100000); !bytes.Equal(data, expected) {
+		t.Fatalf("expected capability %x, got %x", expected, data)
+	}
+}
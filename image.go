@@ -0,0 +1,490 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements reading the layers of container images from an OCI
+// image layout, or the output of `docker save`.
+
+const (
+	mediaTypeOCIIndex         = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList       = "application/vnd.docker.distribution.manifest.list.v2+json"
+	annotationRefName         = "org.opencontainers.image.ref.name"
+	annotationContainerdImage = "io.containerd.image.name"
+)
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *platform         `json:"platform"`
+}
+
+// ociManifest is either an image index or an image manifest.
+type ociManifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// dockerManifest is an entry in the manifest.json written by `docker save`.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Image is a container image, see `OpenImage`.
+type Image struct {
+	// Layers are the layers of the image, ordered from the bottom layer to
+	// the top layer, which can be passed to `FromLayers`.
+	Layers []Layer
+	src    imageSource
+}
+
+// Close closes the files opened for the image.
+// The layers of the image can not be used after it is closed.
+func (i *Image) Close() error {
+	return i.src.Close()
+}
+
+// OpenImage opens an image from an OCI image layout or the output of
+// `docker save`. `p` is either a directory, or a tar archive, with the image
+// layout or `docker save` output.
+//
+// `ref` selects the image, either by name, e.g. "busybox:latest" or just
+// "latest" for the OCI ref name annotation, or by the digest of its manifest.
+// ref can be empty if there is only one image.
+// For multi-platform images the manifest for the current platform is used.
+func OpenImage(p, ref string) (*Image, error) {
+	src, err := openImageSource(p)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{src: src}
+
+	var layers []string
+	if _, _, err := src.open("index.json"); err == nil {
+		layers, err = ociLayers(src, ref)
+		if err != nil {
+			src.Close() // nolint: errcheck
+			return nil, err
+		}
+	} else {
+		layers, err = dockerLayers(src, ref)
+		if err != nil {
+			src.Close() // nolint: errcheck
+			return nil, err
+		}
+	}
+
+	for _, l := range layers {
+		ra, size, err := src.open(l)
+		if err != nil {
+			src.Close() // nolint: errcheck
+			return nil, errors.Wrapf(err, "error opening layer %s", l)
+		}
+		img.Layers = append(img.Layers, Layer{ReaderAt: ra, Size: size})
+	}
+	return img, nil
+}
+
+func readJSON(src imageSource, name string, v interface{}) error {
+	ra, size, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(io.NewSectionReader(ra, 0, size)).Decode(v); err != nil {
+		return errors.Wrapf(err, "error decoding %s", name)
+	}
+	return nil
+}
+
+func blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, "/\\") {
+		return "", errors.Errorf("invalid digest: %s", digest)
+	}
+	return path.Join("blobs", parts[0], parts[1]), nil
+}
+
+// refMatches checks if the image name matches the reference, which can leave
+// out the registry and repository path as well as the default tag.
+func refMatches(name, ref string) bool {
+	if name == "" {
+		return false
+	}
+	if name == ref || strings.HasSuffix(name, "/"+ref) {
+		return true
+	}
+	if !strings.Contains(path.Base(ref), ":") {
+		return refMatches(name, ref+":latest")
+	}
+	return false
+}
+
+// ociLayers returns the blob paths of the layers of the image in an OCI image
+// layout.
+func ociLayers(src imageSource, ref string) ([]string, error) {
+	var index ociManifest
+	if err := readJSON(src, "index.json", &index); err != nil {
+		return nil, err
+	}
+
+	var (
+		matches []descriptor
+		names   []string
+	)
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[annotationContainerdImage]
+		if name == "" {
+			name = desc.Annotations[annotationRefName]
+		}
+		names = append(names, name)
+		switch {
+		case ref == "":
+			matches = append(matches, desc)
+		case desc.Digest == ref,
+			refMatches(desc.Annotations[annotationContainerdImage], ref),
+			desc.Annotations[annotationRefName] == ref:
+			matches = append(matches, desc)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, errors.Errorf("image %q not found, available images: %s", ref, strings.Join(names, ", "))
+	case len(matches) > 1:
+		return nil, errors.Errorf("found multiple images for %q, available images: %s", ref, strings.Join(names, ", "))
+	}
+	return ociManifestLayers(src, matches[0])
+}
+
+func ociManifestLayers(src imageSource, desc descriptor) ([]string, error) {
+	p, err := blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var m ociManifest
+	if err := readJSON(src, p, &m); err != nil {
+		return nil, err
+	}
+
+	if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList || len(m.Manifests) > 0 {
+		want := hostPlatform()
+		d, ok := selectManifest(m.Manifests, want)
+		if !ok {
+			return nil, errors.Errorf("no manifest for %s in %s", want, desc.Digest)
+		}
+		logrus.WithField("digest", d.Digest).Debug("using manifest")
+		return ociManifestLayers(src, d)
+	}
+
+	layers := make([]string, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		p, err := blobPath(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, p)
+	}
+	return layers, nil
+}
+
+// hostPlatform returns the platform of the host. The variant is only known
+// for ARM.
+func hostPlatform() platform {
+	p := platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	switch runtime.GOARCH {
+	case "arm64":
+		p.Variant = "v8"
+	case "arm":
+		p.Variant = armVariant()
+	}
+	return p
+}
+
+// armVariant returns the variant of a 32-bit ARM CPU from /proc/cpuinfo, or
+// an empty string if it is not known.
+func armVariant() string {
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "CPU architecture" {
+			continue
+		}
+		switch v := strings.TrimSpace(parts[1]); v {
+		case "5", "6", "7":
+			return "v" + v
+		case "8", "AArch64":
+			// 32-bit code runs as ARMv7 on 64-bit CPUs
+			return "v7"
+		}
+		return ""
+	}
+	return ""
+}
+
+// variantLevel returns the level of a variant like "v7", or -1 if it is not
+// in that format.
+func variantLevel(variant string) int {
+	if !strings.HasPrefix(variant, "v") {
+		return -1
+	}
+	level, err := strconv.Atoi(variant[1:])
+	if err != nil {
+		return -1
+	}
+	return level
+}
+
+// selectManifest picks the manifest for a platform from the manifests of a
+// multi-platform image.
+// The variant of the platform is the highest one the manifest can use, so a
+// manifest for an exact match of the variant is preferred, followed by the
+// highest lower variant, e.g. "v6" for "v7", and manifests without a variant.
+// Manifests without a platform are only used if there is no other match.
+func selectManifest(manifests []descriptor, want platform) (descriptor, bool) {
+	if len(manifests) == 1 {
+		return manifests[0], true
+	}
+	best, bestRank := -1, -1
+	for i, d := range manifests {
+		rank := -1
+		switch {
+		case d.Platform == nil:
+			rank = 0
+		case d.Platform.OS != want.OS || d.Platform.Architecture != want.Architecture:
+		case d.Platform.Variant == want.Variant:
+			rank = 1 << 16
+		case d.Platform.Variant == "" || want.Variant == "":
+			rank = 1
+		default:
+			level, max := variantLevel(d.Platform.Variant), variantLevel(want.Variant)
+			if level >= 0 && level < max {
+				rank = 2 + level
+			}
+		}
+		if rank > bestRank {
+			best, bestRank = i, rank
+		}
+	}
+	if best == -1 {
+		return descriptor{}, false
+	}
+	return manifests[best], true
+}
+
+// dockerLayers returns the paths of the layers of the image in `docker save`
+// output.
+func dockerLayers(src imageSource, ref string) ([]string, error) {
+	var manifests []dockerManifest
+	if err := readJSON(src, "manifest.json", &manifests); err != nil {
+		return nil, errors.Wrap(err, "not an OCI image layout or docker save output")
+	}
+
+	var (
+		matches []dockerManifest
+		names   []string
+	)
+	for _, m := range manifests {
+		names = append(names, m.RepoTags...)
+		// There is no manifest digest in manifest.json, the image can only be
+		// selected by the digest of its config.
+		if ref == "" || strings.HasPrefix(ref, "sha256:") && strings.Contains(m.Config, strings.TrimPrefix(ref, "sha256:")) {
+			matches = append(matches, m)
+			continue
+		}
+		for _, tag := range m.RepoTags {
+			if refMatches(tag, ref) {
+				matches = append(matches, m)
+				break
+			}
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, errors.Errorf("image %q not found, available images: %s", ref, strings.Join(names, ", "))
+	case len(matches) > 1:
+		return nil, errors.Errorf("found multiple images for %q, available images: %s", ref, strings.Join(names, ", "))
+	}
+	return matches[0].Layers, nil
+}
+
+// imageSource gives access to the files of an image layout.
+type imageSource interface {
+	open(name string) (io.ReaderAt, int64, error)
+	Close() error
+}
+
+func openImageSource(p string) (imageSource, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return &dirSource{dir: p}, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newTarSource(f, st.Size())
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	return src, nil
+}
+
+// dirSource is an image layout in a directory.
+type dirSource struct {
+	dir   string
+	files []*os.File
+}
+
+func (s *dirSource) open(name string) (io.ReaderAt, int64, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return nil, 0, errors.Errorf("invalid path in image: %s", name)
+	}
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	s.files = append(s.files, f)
+	return f, st.Size(), nil
+}
+
+func (s *dirSource) Close() error {
+	var err error
+	for _, f := range s.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.files = nil
+	return err
+}
+
+type tarFile struct {
+	offset, size int64
+	// link is set for symlinks and hard links
+	link string
+}
+
+// tarSource is an image layout in a, possibly compressed, tar archive.
+type tarSource struct {
+	f      *os.File
+	stream io.ReaderAt
+	files  map[string]tarFile
+}
+
+func newTarSource(f *os.File, size int64) (*tarSource, error) {
+	s := &tarSource{f: f, stream: f, files: make(map[string]tarFile)}
+	format, err := detectCompression(f, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		r      io.Reader
+		offset func() (int64, error)
+	)
+	if format == compressionNone {
+		sr := io.NewSectionReader(f, 0, size)
+		r = sr
+		offset = func() (int64, error) {
+			return sr.Seek(0, io.SeekCurrent)
+		}
+	} else {
+		cra := newCompressedReaderAt(f, size, format)
+		scanner, err := cra.scan()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s stream", format)
+		}
+		cr := &countingReader{r: scanner}
+		r = cr
+		offset = cr.pos
+		s.stream = cra
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading image archive")
+		}
+		pos, err := offset()
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "./"))
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			s.files[name] = tarFile{link: path.Join(path.Dir(name), h.Linkname)}
+		case tar.TypeLink:
+			s.files[name] = tarFile{link: path.Clean(strings.TrimPrefix(h.Linkname, "./"))}
+		case tar.TypeReg:
+			s.files[name] = tarFile{offset: pos, size: h.Size}
+		}
+	}
+}
+
+func (s *tarSource) open(name string) (io.ReaderAt, int64, error) {
+	name = path.Clean(name)
+	for i := 0; i < 16; i++ {
+		f, ok := s.files[name]
+		if !ok {
+			return nil, 0, errors.Wrap(os.ErrNotExist, name)
+		}
+		if f.link == "" {
+			return io.NewSectionReader(s.stream, f.offset, f.size), f.size, nil
+		}
+		name = f.link
+	}
+	return nil, 0, errors.Errorf("too many links: %s", name)
+}
+
+func (s *tarSource) Close() error {
+	return s.f.Close()
+}
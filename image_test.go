@@ -0,0 +1,204 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func imageTestLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		testArchive(t, []testEntry{
+			{"etc", os.ModeDir | 0755, "", nil},
+			{"etc/hostname", 0644, "base", nil},
+			{"etc/removed", 0644, "removed", nil},
+		}),
+		gzipMembers(t, testArchive(t, []testEntry{
+			{"etc", os.ModeDir | 0755, "", nil},
+			{"etc/hostname", 0644, "top", nil},
+			{"etc/.wh.removed", 0644, "", nil},
+		}), 1),
+	}
+}
+
+func checkTestImage(t *testing.T, p, ref string) {
+	img, err := OpenImage(p, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	fs, err := FromLayers(img.Layers, NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readTestFile(t, fs, "etc/hostname"); string(data) != "top" {
+		t.Fatalf("expected content from the top layer, got %q", data)
+	}
+	if names := dirNames(t, fs, "etc"); names != "hostname" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
+
+func writeBlob(t *testing.T, dir string, mediaType string, data []byte) descriptor {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	p := filepath.Join(dir, "blobs", "sha256", hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+}
+
+func writeJSONBlob(t *testing.T, dir string, mediaType string, v interface{}) descriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeBlob(t, dir, mediaType, data)
+}
+
+func TestOpenImageOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var layers []descriptor
+	for _, l := range imageTestLayers(t) {
+		layers = append(layers, writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar", l))
+	}
+	manifest := writeJSONBlob(t, dir, "application/vnd.oci.image.manifest.v1+json", ociManifest{Layers: layers})
+	manifest.Platform = &platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	other := writeJSONBlob(t, dir, "application/vnd.oci.image.manifest.v1+json", ociManifest{})
+	other.Platform = &platform{OS: "plan9", Architecture: "mips"}
+
+	index := writeJSONBlob(t, dir, mediaTypeOCIIndex, ociManifest{
+		MediaType: mediaTypeOCIIndex,
+		Manifests: []descriptor{other, manifest},
+	})
+	index.Annotations = map[string]string{
+		annotationRefName:         "latest",
+		annotationContainerdImage: "docker.io/library/test:latest",
+	}
+	data, err := json.Marshal(ociManifest{Manifests: []descriptor{index}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"", "latest", "test", "library/test:latest", index.Digest} {
+		checkTestImage(t, dir, ref)
+	}
+	if _, err := OpenImage(dir, "other:latest"); err == nil {
+		t.Fatal("expected error for unknown image")
+	}
+}
+
+func TestOpenImageDockerSave(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	layers := imageTestLayers(t)
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   "1234.json",
+		RepoTags: []string{"test:v1"},
+		Layers:   []string{"a/layer.tar", "b/layer.tar"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", manifest},
+		{"a/layer.tar", layers[0]},
+		{"c/layer.tar", layers[1]},
+	} {
+		if err := w.WriteHeader(newTestHeader(f.name, 0644, int64(len(f.data)), time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	// docker save links identical layers to each other
+	if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "b/layer.tar", Linkname: "../c/layer.tar"}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	dir, err := ioutil.TempDir("", "tarfs-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string][]byte{
+		"image.tar":    buf.Bytes(),
+		"image.tar.gz": gzipMembers(t, buf.Bytes(), 1),
+	} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, ref := range []string{"", "test:v1", "sha256:1234"} {
+			checkTestImage(t, p, ref)
+		}
+		if _, err := OpenImage(p, "test"); err == nil {
+			t.Fatal("expected error for unknown tag")
+		}
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	manifest := func(digest string, p *platform) descriptor {
+		return descriptor{Digest: digest, Platform: p}
+	}
+	manifests := []descriptor{
+		manifest("amd64", &platform{OS: "linux", Architecture: "amd64"}),
+		manifest("arm-v5", &platform{OS: "linux", Architecture: "arm", Variant: "v5"}),
+		manifest("arm-v7", &platform{OS: "linux", Architecture: "arm", Variant: "v7"}),
+		manifest("arm-v6", &platform{OS: "linux", Architecture: "arm", Variant: "v6"}),
+		manifest("arm64", &platform{OS: "linux", Architecture: "arm64", Variant: "v8"}),
+	}
+	for _, tc := range []struct {
+		want     platform
+		expected string
+	}{
+		{platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "arm-v7"},
+		{platform{OS: "linux", Architecture: "arm", Variant: "v6"}, "arm-v6"},
+		// the highest variant the platform can run
+		{platform{OS: "linux", Architecture: "arm", Variant: "v8"}, "arm-v7"},
+		{platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "arm64"},
+		{platform{OS: "linux", Architecture: "amd64"}, "amd64"},
+		{platform{OS: "linux", Architecture: "arm", Variant: "v4"}, ""},
+		{platform{OS: "windows", Architecture: "amd64"}, ""},
+	} {
+		d, ok := selectManifest(manifests, tc.want)
+		if ok != (tc.expected != "") || d.Digest != tc.expected {
+			t.Fatalf("%s: expected %q, got %q", tc.want, tc.expected, d.Digest)
+		}
+	}
+
+	// manifests without a platform are used as a fallback
+	manifests = append(manifests, manifest("any", nil))
+	if d, _ := selectManifest(manifests, platform{OS: "windows", Architecture: "amd64"}); d.Digest != "any" {
+		t.Fatalf("expected manifest without platform, got %q", d.Digest)
+	}
+	if d, _ := selectManifest(manifests, platform{OS: "linux", Architecture: "arm", Variant: "v7"}); d.Digest != "arm-v7" {
+		t.Fatalf("expected arm-v7, got %q", d.Digest)
+	}
+}
@@ -0,0 +1,668 @@
+package tarfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements a MetadataStore backed by a memory-mapped index file,
+// see `WithIndexFile`.
+//
+// The index file starts with a header identifying the archive it belongs to
+// and the decompression checkpoints for compressed archives. The header is
+// followed by a record for every entry, sorted by key, and a table with the
+// offset of each record so that entries can be looked up with a binary search
+// without reading the entire index.
+// The file ends with a footer holding the offset of the table and the number
+// of entries.
+//
+// Integers are stored as varints unless noted otherwise.
+//
+//	header:     magic, version, size, mtime, digest, fingerprint, format,
+//	            checkpoints
+//	checkpoint: in, bits, out, window
+//	record:     key, name, mode, uid, gid, atime, mtime, ctime, ino, size,
+//	            data offset, nlink, linkname, devmajor, devminor, hardlink, header,
+//	            length, layer, xattrs, sparse, children
+//	table:      uint64 offset for each record
+//	footer:     uint64 table offset, uint32 number of records, uint64 bytes
+//	            used by the entries (see `Usage`)
+//
+// Strings and byte slices are prefixed with their length, times are stored as
+// seconds and nanoseconds, and the children of a directory as the indexes of
+// their records. The sparse map is stored as the number of fragments plus one,
+// followed by their offsets and lengths, zero is used for files which are not
+// sparse.
+
+const (
+	indexMagic   = "tarfsidx"
+	indexVersion = 7
+	footerSize   = 20
+	// fingerprintSize is the amount of data at the start and at the end of
+	// the archive which is hashed to tell archives of the same size apart.
+	fingerprintSize = 64 << 10
+)
+
+var (
+	errStaleIndex   = errors.New("index does not match the archive")
+	errIndexCorrupt = errors.New("index file is corrupt")
+)
+
+// indexKey identifies the archive an index belongs to.
+type indexKey struct {
+	size    int64
+	modTime int64
+	digest  string
+	// fingerprint is a hash of the start and the end of the archive, which
+	// catches most other archives of the same size without a digest.
+	fingerprint string
+	format      compression
+}
+
+func newIndexKey(ra io.ReaderAt, size int64, cfg config, format compression) (indexKey, error) {
+	k := indexKey{size: size, digest: cfg.digest, format: format}
+	if !cfg.modTime.IsZero() {
+		k.modTime = cfg.modTime.UnixNano()
+	}
+	fp, err := archiveFingerprint(ra, size)
+	if err != nil {
+		return k, err
+	}
+	k.fingerprint = fp
+	return k, nil
+}
+
+// archiveFingerprint hashes the first and the last `fingerprintSize` bytes of
+// the archive. For tar archives the end holds the last entries, and for
+// compressed archives the checksum and size of the uncompressed data.
+func archiveFingerprint(ra io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	head := size
+	if head > fingerprintSize {
+		head = fingerprintSize
+	}
+	tail := size - fingerprintSize
+	if tail < head {
+		tail = head
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(ra, 0, head)); err != nil {
+		return "", errors.Wrap(err, "error reading archive")
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(ra, tail, size-tail)); err != nil {
+		return "", errors.Wrap(err, "error reading archive")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeKeys adds the key of the entry and all its children to keys.
+func storeKeys(db MetadataStore, key string, keys *[]string) {
+	fi := db.Get(key)
+	if fi == nil {
+		return
+	}
+	*keys = append(*keys, key)
+	if !fi.Mode().IsDir() {
+		return
+	}
+	for _, e := range db.Entries(key) {
+		storeKeys(db, filepath.Join(key, filepath.Base(e.Name())), keys)
+	}
+}
+
+// writeIndexFile writes the metadata from db, and the decompression
+// checkpoints of the archive, to an index file.
+// The index is written to a temporary file first so an existing index is
+// only replaced once the new one is complete.
+func writeIndexFile(path string, db MetadataStore, key indexKey, checkpoints []checkpoint) error {
+	var keys []string
+	storeKeys(db, "/", &keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
+	pos := make(map[string]int, len(keys))
+	for i, k := range keys {
+		pos[k] = i
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error creating index file")
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	defer f.Close()           // nolint: errcheck
+
+	w := &indexEncoder{w: bufio.NewWriter(f)}
+	w.raw([]byte(indexMagic))
+	w.uvarint(indexVersion)
+	w.varint(key.size)
+	w.varint(key.modTime)
+	w.str(key.digest)
+	w.str(key.fingerprint)
+	w.uvarint(uint64(key.format))
+	w.uvarint(uint64(len(checkpoints)))
+	for _, cp := range checkpoints {
+		w.varint(cp.in)
+		w.uvarint(uint64(cp.bits))
+		w.varint(cp.out)
+		w.bytes(cp.window)
+	}
+
+	offsets := make([]int64, 0, len(keys))
+	var usage Usage
+	for _, k := range keys {
+		offsets = append(offsets, w.n)
+		fi := db.Get(k)
+		usage.add(entryUsage(fi))
+		var n node
+		if an := asNode(fi); an != nil {
+			n = *an
+		}
+		dataOffset := fi.Inode()
+		if n.stat != nil {
+			dataOffset = n.stat.DataOffset
+		}
+
+		w.str(k)
+		w.str(fi.Name())
+		w.uvarint(uint64(fi.Mode()))
+		owner := fi.Owner()
+		w.uvarint(uint64(owner.UID))
+		w.uvarint(uint64(owner.GID))
+		w.time(fi.AccessTime())
+		w.time(fi.ModTime())
+		w.time(fi.ChangeTime())
+		w.varint(fi.Inode())
+		w.varint(fi.Size())
+		w.varint(dataOffset)
+		w.uvarint(uint64(fi.Nlink()))
+		w.str(fi.Linkname())
+		major, minor := fi.Device()
+		w.uvarint(uint64(major))
+		w.uvarint(uint64(minor))
+		w.str(n.hardlink)
+		w.varint(n.header)
+		w.varint(n.length)
+		w.uvarint(uint64(n.layer))
+
+		xattrs := fi.Xattrs()
+		names := make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.uvarint(uint64(len(names)))
+		for _, name := range names {
+			w.str(name)
+			w.bytes(xattrs[name])
+		}
+
+		var sparse []SparseEntry
+		if n.stat != nil {
+			sparse = n.stat.Sparse
+		}
+		if sparse == nil {
+			w.uvarint(0)
+		} else {
+			w.uvarint(uint64(len(sparse)) + 1)
+			for _, e := range sparse {
+				w.varint(e.Offset)
+				w.varint(e.Length)
+			}
+		}
+
+		if !fi.Mode().IsDir() {
+			w.uvarint(0)
+			continue
+		}
+		entries := db.Entries(k)
+		w.uvarint(uint64(len(entries)))
+		for _, e := range entries {
+			w.uvarint(uint64(pos[filepath.Join(k, filepath.Base(e.Name()))]))
+		}
+	}
+
+	table := w.n
+	var buf [8]byte
+	for _, off := range offsets {
+		binary.LittleEndian.PutUint64(buf[:], uint64(off))
+		w.raw(buf[:])
+	}
+	binary.LittleEndian.PutUint64(buf[:], uint64(table))
+	w.raw(buf[:])
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(offsets)))
+	w.raw(buf[:4])
+	binary.LittleEndian.PutUint64(buf[:], usage.Bytes)
+	w.raw(buf[:])
+
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		return errors.Wrap(w.err, "error writing index file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "error writing index file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), path), "error writing index file")
+}
+
+// WriteIndex reads an archive and writes its index to the passed in path.
+// The index holds the metadata of the archive, and the decompression
+// checkpoints for compressed archives, and can be used to serve the archive
+// with `FromIndex` without reading it again.
+//
+// The index is tied to the size and compression of the archive, a hash of the
+// start and end of the archive, and the digest set with `WithDigest`. Other
+// options are ignored.
+// stargz archives carry their own index and are rejected, see `FromReaderAt`.
+func WriteIndex(ra io.ReaderAt, size int64, path string, opts ...Opt) error {
+	cfg := newConfig(opts)
+	format, err := detectCompression(ra, size)
+	if err != nil {
+		return err
+	}
+	db := NewBTreeStore(4)
+	a, err := indexArchive(ra, size, format, db, nil)
+	if err != nil {
+		return err
+	}
+	if a.toc {
+		return errors.New("stargz archives are indexed from their table of contents")
+	}
+	key, err := newIndexKey(ra, size, cfg, format)
+	if err != nil {
+		return err
+	}
+	return writeIndexFile(path, db, key, a.checkpoints)
+}
+
+// fileStore is a read-only MetadataStore for a memory-mapped index file.
+// Entries added to the store, such as whiteouts, are only kept in memory.
+type fileStore struct {
+	mu    sync.RWMutex
+	data  []byte
+	table int
+	count int
+	// checkpoints reference the decompression windows in data.
+	checkpoints []checkpoint
+	added       map[string]FileInfo
+	// usage is the usage of the indexed entries, updated as entries are
+	// added
+	usage Usage
+}
+
+// openIndexFile opens the index file at path, an error is returned if the
+// index does not belong to the archive identified by key.
+func openIndexFile(path string, key indexKey) (*fileStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < int64(len(indexMagic)+footerSize) {
+		return nil, errors.New("index file is truncated")
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(st.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "error mapping index file")
+	}
+
+	s := &fileStore{data: data, added: make(map[string]FileInfo)}
+	if err := s.load(key); err != nil {
+		unix.Munmap(data) // nolint: errcheck
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) load(key indexKey) error {
+	d := &indexDecoder{b: s.data}
+	if string(d.raw(len(indexMagic))) != indexMagic {
+		return errors.New("not a tarfs index file")
+	}
+	if v := d.uvarint(); d.err == nil && v != indexVersion {
+		return errors.Errorf("unsupported index version: %d", v)
+	}
+	var k indexKey
+	k.size = d.varint()
+	k.modTime = d.varint()
+	k.digest = d.str()
+	k.fingerprint = d.str()
+	k.format = compression(d.uvarint())
+	if d.err != nil {
+		return d.err
+	}
+	if k != key {
+		return errStaleIndex
+	}
+
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		cp := checkpoint{
+			in:   d.varint(),
+			bits: uint8(d.uvarint()),
+			out:  d.varint(),
+		}
+		// The window is not copied, it is only read when resuming
+		// decompression, which is not done after the store is closed.
+		if w := d.bytes(); len(w) > 0 {
+			cp.window = w
+		}
+		s.checkpoints = append(s.checkpoints, cp)
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	footer := s.data[len(s.data)-footerSize:]
+	table := binary.LittleEndian.Uint64(footer)
+	count := binary.LittleEndian.Uint32(footer[8:])
+	if table < uint64(d.off) || table+uint64(count)*8 != uint64(len(s.data)-footerSize) {
+		return errIndexCorrupt
+	}
+	s.table = int(table)
+	s.count = int(count)
+	s.usage = Usage{Entries: uint64(count), Bytes: binary.LittleEndian.Uint64(footer[12:])}
+	for i := 0; i < s.count; i++ {
+		if s.offset(i) >= s.table {
+			return errIndexCorrupt
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) offset(i int) int {
+	return int(binary.LittleEndian.Uint64(s.data[s.table+i*8:]))
+}
+
+func (s *fileStore) key(i int) string {
+	d := &indexDecoder{b: s.data, off: s.offset(i)}
+	return d.str()
+}
+
+// find returns the index of the record for key, or -1 if there is none.
+func (s *fileStore) find(key string) int {
+	i := sort.Search(s.count, func(i int) bool {
+		return !keyLess(s.key(i), key)
+	})
+	if i < s.count && s.key(i) == key {
+		return i
+	}
+	return -1
+}
+
+// record decodes the entry at index i and returns it along with the indexes
+// of its children.
+func (s *fileStore) record(i int) (*node, []int, error) {
+	d := &indexDecoder{b: s.data, off: s.offset(i)}
+	d.str()
+	n := &node{name: d.str(), stat: &StatT{}}
+	n.stat.Mode = uint32(d.uvarint())
+	n.stat.Owner.UID = uint32(d.uvarint())
+	n.stat.Owner.GID = uint32(d.uvarint())
+	n.stat.Atime = d.time()
+	n.stat.Mtime = d.time()
+	n.stat.Ctime = d.time()
+	n.stat.Ino = d.varint()
+	n.stat.Size = d.varint()
+	n.stat.DataOffset = d.varint()
+	n.stat.Nlink = uint32(d.uvarint())
+	n.stat.Linkname = d.str()
+	n.stat.Devmajor = uint32(d.uvarint())
+	n.stat.Devminor = uint32(d.uvarint())
+	n.hardlink = d.str()
+	n.header = d.varint()
+	n.length = d.varint()
+	n.layer = int(d.uvarint())
+	if count := d.uvarint(); count > 0 && d.err == nil {
+		n.stat.Xattrs = make(map[string][]byte)
+		for j := uint64(0); j < count && d.err == nil; j++ {
+			name := d.str()
+			n.stat.Xattrs[name] = append([]byte(nil), d.bytes()...)
+		}
+	}
+	if count := d.uvarint(); count > 0 && d.err == nil {
+		n.stat.Sparse = []SparseEntry{}
+		for j := uint64(1); j < count && d.err == nil; j++ {
+			n.stat.Sparse = append(n.stat.Sparse, SparseEntry{Offset: d.varint(), Length: d.varint()})
+		}
+	}
+
+	var children []int
+	count := d.uvarint()
+	for j := uint64(0); j < count && d.err == nil; j++ {
+		c := d.uvarint()
+		if c >= uint64(s.count) {
+			return nil, nil, errIndexCorrupt
+		}
+		children = append(children, int(c))
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return n, children, nil
+}
+
+func (s *fileStore) Get(key string) FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(key)
+}
+
+func (s *fileStore) get(key string) FileInfo {
+	if fi, ok := s.added[key]; ok {
+		return fi
+	}
+	if s.data == nil {
+		return nil
+	}
+	i := s.find(key)
+	if i < 0 {
+		return nil
+	}
+	n, _, err := s.record(i)
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Error("error reading index")
+		return nil
+	}
+	return n
+}
+
+func (s *fileStore) Add(key string, fi FileInfo) error {
+	s.mu.Lock()
+	s.usage.sub(entryUsage(s.get(key)))
+	s.usage.add(entryUsage(fi))
+	s.added[key] = fi
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fileStore) Usage() Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usage
+}
+
+// Entries returns the indexed children of the entry, replaced by the entries
+// added for them, followed by the children which were added to the store.
+func (s *fileStore) Entries(key string) []FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		entries []FileInfo
+		indexed = make(map[string]struct{})
+	)
+	i := -1
+	if s.data != nil {
+		i = s.find(key)
+	}
+	if i >= 0 {
+		_, children, err := s.record(i)
+		if err != nil {
+			logrus.WithError(err).WithField("key", key).Error("error reading index")
+			return nil
+		}
+		entries = make([]FileInfo, 0, len(children))
+		for _, c := range children {
+			k := s.key(c)
+			indexed[k] = struct{}{}
+			if fi, ok := s.added[k]; ok {
+				entries = append(entries, fi)
+				continue
+			}
+			n, _, err := s.record(c)
+			if err != nil {
+				logrus.WithError(err).WithField("key", key).Error("error reading index")
+				return nil
+			}
+			entries = append(entries, n)
+		}
+	}
+
+	var added []string
+	for k := range s.added {
+		if _, ok := indexed[k]; !ok && k != key && filepath.Dir(k) == key {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for _, k := range added {
+		entries = append(entries, s.added[k])
+	}
+	return entries
+}
+
+// Close unmaps the index file.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil
+	}
+	err := unix.Munmap(s.data)
+	s.data = nil
+	return err
+}
+
+type indexEncoder struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *indexEncoder) raw(p []byte) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.w.Write(p)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *indexEncoder) uvarint(v uint64) {
+	e.raw(e.buf[:binary.PutUvarint(e.buf[:], v)])
+}
+
+func (e *indexEncoder) varint(v int64) {
+	e.raw(e.buf[:binary.PutVarint(e.buf[:], v)])
+}
+
+func (e *indexEncoder) bytes(p []byte) {
+	e.uvarint(uint64(len(p)))
+	e.raw(p)
+}
+
+func (e *indexEncoder) str(s string) {
+	e.bytes([]byte(s))
+}
+
+func (e *indexEncoder) time(t time.Time) {
+	e.varint(t.Unix())
+	e.uvarint(uint64(t.Nanosecond()))
+}
+
+// indexDecoder reads values from an index file, all reads after the first
+// error return zero values.
+type indexDecoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *indexDecoder) raw(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b)-d.off {
+		d.err = errIndexCorrupt
+		return nil
+	}
+	p := d.b[d.off : d.off+n]
+	d.off += n
+	return p
+}
+
+func (d *indexDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b[d.off:])
+	if n <= 0 {
+		d.err = errIndexCorrupt
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *indexDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		d.err = errIndexCorrupt
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *indexDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = errIndexCorrupt
+		return nil
+	}
+	return d.raw(int(n))
+}
+
+func (d *indexDecoder) str() string {
+	return string(d.bytes())
+}
+
+func (d *indexDecoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	return time.Unix(sec, int64(nsec))
+}
@@ -0,0 +1,324 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+)
+
+func newIndexTestArchive(t *testing.T) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		newTestHeader("foo", os.ModeDir|0755, 0, now),
+		newTestHeader("foo/bar", 0644, 3, now),
+		{Typeflag: tar.TypeSymlink, Name: "foo/link", Linkname: "bar", Mode: 0777, ModTime: now},
+		{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "foo/bar", ModTime: now},
+		{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: now},
+		{Typeflag: tar.TypeReg, Name: "xattr", Mode: 0644, Size: 5, ModTime: now, PAXRecords: map[string]string{paxSchilyXattr + "user.foo": "bar"}},
+	} {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			w.Write(testData(int(h.Size)))
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func compareFS(t *testing.T, expected, actual pathfs.FileSystem, name string) {
+	fCtx := &fuse.Context{}
+	a1, status := expected.GetAttr(name, fCtx)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	a2, status := actual.GetAttr(name, fCtx)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	if *a1 != *a2 {
+		t.Fatalf("%s: attributes do not match: %v != %v", name, a1, a2)
+	}
+
+	x1, _ := expected.ListXAttr(name, fCtx)
+	x2, _ := actual.ListXAttr(name, fCtx)
+	if !reflect.DeepEqual(x1, x2) {
+		t.Fatalf("%s: xattrs do not match: %v != %v", name, x1, x2)
+	}
+
+	switch a1.Mode & syscall.S_IFMT {
+	case fuse.S_IFDIR:
+		if names1, names2 := dirNames(t, expected, name), dirNames(t, actual, name); names1 != names2 {
+			t.Fatalf("%s: entries do not match: %s != %s", name, names1, names2)
+		}
+		entries, _ := expected.OpenDir(name, fCtx)
+		for _, e := range entries {
+			compareFS(t, expected, actual, filepath.Join(name, e.Name))
+		}
+	case fuse.S_IFLNK:
+		l1, _ := expected.Readlink(name, fCtx)
+		l2, _ := actual.Readlink(name, fCtx)
+		if l1 != l2 {
+			t.Fatalf("%s: link does not match: %s != %s", name, l1, l2)
+		}
+	case fuse.S_IFREG:
+		if !bytes.Equal(readTestFile(t, expected, name), readTestFile(t, actual, name)) {
+			t.Fatalf("%s: content does not match", name)
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	data := newIndexTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"uncompressed", data},
+		{"gzip", gzipMembers(t, data, 2)},
+		{"zstd", zstdFrames(t, data, 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			index := filepath.Join(dir, tc.name+".idx")
+			rdr := bytes.NewReader(tc.archive)
+			expected, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithIndexFile(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(index); err != nil {
+				t.Fatal(err)
+			}
+
+			// The archive must not be indexed again, which would fail on the
+			// nil store.
+			actual, err := FromReaderAt(rdr, rdr.Size(), nil, WithIndexFile(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareFS(t, expected, actual, "")
+
+			out := bytes.NewBuffer(nil)
+			if err := Export(actual, out, ExportFull); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatal("export from the index does not match the archive")
+			}
+		})
+	}
+}
+
+func TestIndexFileStale(t *testing.T) {
+	data := newIndexTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "idx")
+
+	rdr := bytes.NewReader(data)
+	if _, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithIndexFile(index), WithDigest("sha256:foo")); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newIndexKey(rdr, rdr.Size(), config{digest: "sha256:foo"}, compressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openIndexFile(index, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	key.digest = "sha256:bar"
+	if _, err := openIndexFile(index, key); err != errStaleIndex {
+		t.Fatalf("expected stale index, got: %v", err)
+	}
+	db := NewBTreeStore(2)
+	if _, err := FromReaderAt(rdr, rdr.Size(), db, WithIndexFile(index), WithDigest("sha256:bar")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Get("/foo/bar") == nil {
+		t.Fatal("expected archive to be indexed again")
+	}
+	if _, err := openIndexFile(index, key); err != nil {
+		t.Fatalf("expected index to be replaced: %v", err)
+	}
+
+	// truncated index
+	st, err := os.Stat(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(index, st.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openIndexFile(index, key); err == nil {
+		t.Fatal("expected error for truncated index")
+	}
+	db = NewBTreeStore(2)
+	if _, err := FromReaderAt(rdr, rdr.Size(), db, WithIndexFile(index), WithDigest("sha256:bar")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Get("/foo/bar") == nil {
+		t.Fatal("expected archive to be indexed again")
+	}
+}
+
+func TestIndexFileOtherArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "idx")
+
+	// archives of the same size, without a digest to tell them apart
+	first := testArchive(t, []testEntry{{"file", 0644, "first", nil}})
+	second := testArchive(t, []testEntry{{"file", 0644, "other", nil}})
+	if len(first) != len(second) {
+		t.Fatal("expected archives of the same size")
+	}
+	rdr := bytes.NewReader(first)
+	if _, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithIndexFile(index)); err != nil {
+		t.Fatal(err)
+	}
+	rdr = bytes.NewReader(second)
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithIndexFile(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, fs, "file"); string(content) != "other" {
+		t.Fatalf("expected the index of the other archive not to be used, got %q", content)
+	}
+}
+
+func TestIndexFileAdd(t *testing.T) {
+	data := newIndexTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "idx")
+
+	rdr := bytes.NewReader(data)
+	if err := WriteIndex(rdr, rdr.Size(), index); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newIndexKey(rdr, rdr.Size(), config{}, compressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openIndexFile(index, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	bar := idx.Get("/foo/bar")
+	if err := idx.Add("/foo/bar", &whiteout{FileInfo: bar}); err != nil {
+		t.Fatal(err)
+	}
+	added := &node{name: "new", stat: &StatT{Mode: uint32(0644)}}
+	if err := idx.Add("/foo/new", added); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range idx.Entries("/foo") {
+		name := filepath.Base(e.Name())
+		if isWhiteout(e) {
+			name += " (whiteout)"
+		}
+		names = append(names, name)
+	}
+	if expected := []string{"bar (whiteout)", "link", "new"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected entries %v, got %v", expected, names)
+	}
+}
+
+func TestFromIndex(t *testing.T) {
+	data := newIndexTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"uncompressed", data},
+		{"gzip", gzipMembers(t, data, 1)},
+		{"zstd", zstdFrames(t, data, 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			index := filepath.Join(dir, tc.name+".idx")
+			rdr := bytes.NewReader(tc.archive)
+			if err := WriteIndex(rdr, rdr.Size(), index, WithDigest("sha256:foo")); err != nil {
+				t.Fatal(err)
+			}
+
+			cr := &countingReaderAt{ra: rdr}
+			actual, err := FromIndex(cr, rdr.Size(), index, WithDigest("sha256:foo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// only the header, and the start and end for the fingerprint
+			if n := cr.count(); n > 3 {
+				t.Fatalf("expected the archive not to be read, got %d reads", n)
+			}
+			expected, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareFS(t, expected, actual, "")
+
+			if _, err := FromIndex(rdr, rdr.Size(), index); errors.Cause(err) != errStaleIndex {
+				t.Fatalf("expected stale index without the digest, got %v", err)
+			}
+			if _, err := FromIndex(rdr, rdr.Size()-1, index, WithDigest("sha256:foo")); errors.Cause(err) != errStaleIndex {
+				t.Fatalf("expected stale index for a different size, got %v", err)
+			}
+
+			// A different blob of the same size and compression, without a
+			// digest to tell them apart.
+			if err := WriteIndex(rdr, rdr.Size(), index); err != nil {
+				t.Fatal(err)
+			}
+			other := append([]byte(nil), tc.archive...)
+			other[len(other)/2] ^= 0xff
+			if _, err := FromIndex(bytes.NewReader(other), int64(len(other)), index); errors.Cause(err) != errStaleIndex {
+				t.Fatalf("expected stale index for a different archive, got %v", err)
+			}
+		})
+	}
+
+	headers, content := stargzTestHeaders()
+	sgz := newStargz(t, headers, content, stargzOpts{chunkSize: 1000})
+	if err := WriteIndex(bytes.NewReader(sgz), int64(len(sgz)), filepath.Join(dir, "stargz.idx")); err == nil {
+		t.Fatal("expected error for stargz archive")
+	}
+}
@@ -0,0 +1,568 @@
+package tarfs
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// This is a small DEFLATE (RFC 1951) decoder.
+// The standard library decoder works great for streaming, but it does not
+// expose block boundaries or allow decoding to be resumed from the middle of a
+// stream, both of which are needed to build a random access index for gzip
+// streams (see zlib's examples/zran.c for the original idea).
+
+const (
+	maxCodeLen = 15
+	windowSize = 1 << 15
+	windowMask = windowSize - 1
+	fastBits   = 9
+)
+
+var errCorruptDeflate = errors.New("corrupt deflate stream")
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	codeLenOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLit, fixedDist huffman
+)
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	if err := fixedLit.build(lengths[:]); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	if err := fixedDist.build(lengths[:30]); err != nil {
+		panic(err)
+	}
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// bitReader reads a little-endian bit stream.
+type bitReader struct {
+	r     byteReader
+	base  int64 // offset of the first byte read from r
+	n     int64 // number of bytes read from r
+	bits  uint64
+	nbits uint
+}
+
+// fill tries to make at least `n` bits available.
+func (b *bitReader) fill(n uint) error {
+	for b.nbits < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		b.bits |= uint64(c) << b.nbits
+		b.nbits += 8
+		b.n++
+	}
+	return nil
+}
+
+func (b *bitReader) readBits(n uint) (uint32, error) {
+	if err := b.fill(n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	v := uint32(b.bits & (1<<n - 1))
+	b.bits >>= n
+	b.nbits -= n
+	return v, nil
+}
+
+func (b *bitReader) readByte() (byte, error) {
+	v, err := b.readBits(8)
+	return byte(v), err
+}
+
+// alignByte discards any bits left over from the current byte.
+func (b *bitReader) alignByte() {
+	drop := b.nbits % 8
+	b.bits >>= drop
+	b.nbits -= drop
+}
+
+// offset returns the offset of the next unread bit as the offset of the byte
+// it is in and the number of bits of that byte which were already consumed.
+func (b *bitReader) offset() (int64, uint8) {
+	pos := b.n*8 - int64(b.nbits)
+	return b.base + pos/8, uint8(pos % 8)
+}
+
+// huffman is a canonical huffman decoding table.
+type huffman struct {
+	count  [maxCodeLen + 1]uint16
+	symbol []uint16
+	// fast resolves codes of up to fastBits bits in one lookup, indexed by the
+	// next fastBits bits of the stream.
+	// Each entry is `symbol | length<<12`, zero entries need the slow path.
+	fast [1 << fastBits]uint16
+}
+
+func (h *huffman) build(lengths []uint8) error {
+	for i := range h.count {
+		h.count[i] = 0
+	}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+
+	left := 1
+	for l := 1; l <= maxCodeLen; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return errors.Wrap(errCorruptDeflate, "over-subscribed huffman code")
+		}
+	}
+
+	var offs [maxCodeLen + 1]uint16
+	for l := 1; l < maxCodeLen; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	if cap(h.symbol) < len(lengths) {
+		h.symbol = make([]uint16, len(lengths))
+	}
+	h.symbol = h.symbol[:len(lengths)]
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	for i := range h.fast {
+		h.fast[i] = 0
+	}
+	code, idx := 0, 0
+	for l := uint(1); l <= fastBits; l++ {
+		for i := 0; i < int(h.count[l]); i++ {
+			entry := h.symbol[idx] | uint16(l)<<12
+			for j := reverseBits(code, l); j < 1<<fastBits; j += 1 << l {
+				h.fast[j] = entry
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+func reverseBits(v int, n uint) int {
+	r := 0
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+func (h *huffman) decode(b *bitReader) (int, error) {
+	// Not being able to fill is fine here, the stream may end with a code
+	// shorter than fastBits.
+	b.fill(fastBits) // nolint: errcheck
+	if e := h.fast[b.bits&(1<<fastBits-1)]; e != 0 && uint(e>>12) <= b.nbits {
+		b.bits >>= e >> 12
+		b.nbits -= uint(e >> 12)
+		return int(e & 0xfff), nil
+	}
+
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeLen; l++ {
+		bit, err := b.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+(code-first)]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errors.Wrap(errCorruptDeflate, "invalid huffman code")
+}
+
+type inflateState int
+
+const (
+	stateBlockHeader inflateState = iota
+	stateStored
+	stateHuffman
+	stateEnd
+)
+
+// inflater decodes a single raw deflate stream.
+type inflater struct {
+	br *bitReader
+
+	win  [windowSize]byte
+	wpos int // next write position in win
+	wlen int // number of valid bytes in win
+
+	// out is the total number of bytes produced.
+	out int64
+
+	state    inflateState
+	final    bool
+	stored   int
+	lit      *huffman
+	dist     *huffman
+	copyLen  int
+	copyDist int
+
+	dynLit, dynDist, codeLen huffman
+
+	// onBlock, if set, is called at every block boundary before the next
+	// block header is read.
+	onBlock func()
+}
+
+// reset prepares the inflater for a new deflate stream.
+// The output counter is kept.
+func (f *inflater) reset() {
+	f.wpos = 0
+	f.wlen = 0
+	f.state = stateBlockHeader
+	f.final = false
+	f.copyLen = 0
+}
+
+// window returns a copy of the last (up to windowSize) bytes of output.
+func (f *inflater) window() []byte {
+	w := make([]byte, f.wlen)
+	start := (f.wpos - f.wlen) & windowMask
+	n := copy(w, f.win[start:])
+	if n < f.wlen {
+		copy(w[n:], f.win[:f.wpos])
+	}
+	return w
+}
+
+// setWindow primes the inflater with previous output so that back references
+// from a stream resumed at a block boundary can be resolved.
+func (f *inflater) setWindow(w []byte) {
+	if len(w) > windowSize {
+		w = w[len(w)-windowSize:]
+	}
+	copy(f.win[:], w)
+	f.wlen = len(w)
+	f.wpos = len(w) & windowMask
+}
+
+func (f *inflater) put(c byte) {
+	f.win[f.wpos] = c
+	f.advance(1)
+}
+
+// write adds `b` to the window.
+func (f *inflater) write(b []byte) {
+	for len(b) > 0 {
+		n := copy(f.win[f.wpos:], b)
+		f.advance(n)
+		b = b[n:]
+	}
+}
+
+func (f *inflater) advance(n int) {
+	f.wpos = (f.wpos + n) & windowMask
+	f.wlen += n
+	if f.wlen > windowSize {
+		f.wlen = windowSize
+	}
+	f.out += int64(n)
+}
+
+// Read returns decoded data, io.EOF is returned after the final block.
+func (f *inflater) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if f.copyLen > 0 {
+			n += f.copyMatch(p[n:])
+			continue
+		}
+
+		switch f.state {
+		case stateEnd:
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		case stateBlockHeader:
+			if f.final {
+				f.state = stateEnd
+				continue
+			}
+			if f.onBlock != nil {
+				f.onBlock()
+			}
+			if err := f.readBlockHeader(); err != nil {
+				return n, err
+			}
+		case stateStored:
+			if f.stored == 0 {
+				f.state = stateBlockHeader
+				continue
+			}
+			m, err := f.readStored(p[n:])
+			n += m
+			if err != nil {
+				return n, err
+			}
+		case stateHuffman:
+			sym, err := f.lit.decode(f.br)
+			if err != nil {
+				return n, err
+			}
+			switch {
+			case sym < 256:
+				f.put(byte(sym))
+				p[n] = byte(sym)
+				n++
+			case sym == 256:
+				f.state = stateBlockHeader
+			default:
+				if err := f.readMatch(sym); err != nil {
+					return n, err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// copyMatch copies as much of the pending match as fits into p.
+func (f *inflater) copyMatch(p []byte) int {
+	n := 0
+	for f.copyLen > 0 && n < len(p) {
+		src := (f.wpos - f.copyDist) & windowMask
+		// Copy in chunks which neither wrap around the window nor overlap
+		// with the data being written.
+		k := f.copyLen
+		for _, max := range []int{len(p) - n, windowSize - src, windowSize - f.wpos, f.copyDist} {
+			if k > max {
+				k = max
+			}
+		}
+		copy(f.win[f.wpos:f.wpos+k], f.win[src:src+k])
+		copy(p[n:], f.win[f.wpos:f.wpos+k])
+		f.advance(k)
+		f.copyLen -= k
+		n += k
+	}
+	return n
+}
+
+// readStored copies as much of the current stored block as fits into p.
+func (f *inflater) readStored(p []byte) (int, error) {
+	if len(p) > f.stored {
+		p = p[:f.stored]
+	}
+	n := 0
+	// Drain whatever is left in the bit buffer before reading directly from
+	// the underlying reader.
+	for ; n < len(p) && f.br.nbits >= 8; n++ {
+		c, err := f.br.readByte()
+		if err != nil {
+			return n, err
+		}
+		p[n] = c
+	}
+	if n < len(p) {
+		m, err := io.ReadFull(f.br.r, p[n:])
+		f.br.n += int64(m)
+		n += m
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			f.write(p[:n])
+			f.stored -= n
+			return n, err
+		}
+	}
+	f.write(p[:n])
+	f.stored -= n
+	return n, nil
+}
+
+func (f *inflater) readMatch(sym int) error {
+	sym -= 257
+	if sym >= len(lengthBase) {
+		return errors.Wrap(errCorruptDeflate, "invalid length symbol")
+	}
+	extra, err := f.br.readBits(uint(lengthExtra[sym]))
+	if err != nil {
+		return err
+	}
+	length := int(lengthBase[sym]) + int(extra)
+
+	sym, err = f.dist.decode(f.br)
+	if err != nil {
+		return err
+	}
+	if sym >= len(distBase) {
+		return errors.Wrap(errCorruptDeflate, "invalid distance symbol")
+	}
+	extra, err = f.br.readBits(uint(distExtra[sym]))
+	if err != nil {
+		return err
+	}
+	dist := int(distBase[sym]) + int(extra)
+	if dist > f.wlen {
+		return errors.Wrap(errCorruptDeflate, "distance too far back")
+	}
+	f.copyLen = length
+	f.copyDist = dist
+	return nil
+}
+
+func (f *inflater) readBlockHeader() error {
+	hdr, err := f.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	f.final = hdr&1 == 1
+
+	switch hdr >> 1 {
+	case 0:
+		f.br.alignByte()
+		length, err := f.br.readBits(16)
+		if err != nil {
+			return err
+		}
+		nlength, err := f.br.readBits(16)
+		if err != nil {
+			return err
+		}
+		if length != ^nlength&0xffff {
+			return errors.Wrap(errCorruptDeflate, "stored block length mismatch")
+		}
+		f.stored = int(length)
+		f.state = stateStored
+	case 1:
+		f.lit = &fixedLit
+		f.dist = &fixedDist
+		f.state = stateHuffman
+	case 2:
+		if err := f.readDynamicTables(); err != nil {
+			return err
+		}
+		f.lit = &f.dynLit
+		f.dist = &f.dynDist
+		f.state = stateHuffman
+	default:
+		return errors.Wrap(errCorruptDeflate, "invalid block type")
+	}
+	return nil
+}
+
+func (f *inflater) readDynamicTables() error {
+	v, err := f.br.readBits(14)
+	if err != nil {
+		return err
+	}
+	nlen := int(v&0x1f) + 257
+	ndist := int(v>>5&0x1f) + 1
+	ncode := int(v>>10) + 4
+	if nlen > 286 || ndist > 30 {
+		return errors.Wrap(errCorruptDeflate, "too many length or distance codes")
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := f.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLenOrder[i]] = uint8(l)
+	}
+	if err := f.codeLen.build(lengths[:19]); err != nil {
+		return err
+	}
+	for i := 0; i < 19; i++ {
+		lengths[i] = 0
+	}
+
+	for i := 0; i < nlen+ndist; {
+		sym, err := f.codeLen.decode(f.br)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var (
+			l      uint8
+			repeat uint32
+		)
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errors.Wrap(errCorruptDeflate, "repeat with no previous length")
+			}
+			l = lengths[i-1]
+			repeat, err = f.br.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.br.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = f.br.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(repeat) > nlen+ndist {
+			return errors.Wrap(errCorruptDeflate, "too many code lengths")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errors.Wrap(errCorruptDeflate, "missing end-of-block code")
+	}
+
+	if err := f.dynLit.build(lengths[:nlen]); err != nil {
+		return err
+	}
+	return f.dynDist.build(lengths[nlen : nlen+ndist])
+}
@@ -0,0 +1,271 @@
+package tarfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+)
+
+// This file implements an io/fs adapter, so the content of an archive can be
+// read from Go code without mounting it.
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a
+// name, like MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+// NewIOFS returns an `fs.FS` which serves the same content as the passed in
+// filesystem, which must be created by this package.
+//
+// The returned filesystem also implements `fs.ReadDirFS`, `fs.ReadFileFS`,
+// `fs.StatFS` and `fs.SubFS`. Symlinks are followed within the archive, and
+// opened files implement `io.ReaderAt` and `io.Seeker`.
+//
+// Writable filesystems (see `WithUpperDir`) are not supported.
+func NewIOFS(fsys pathfs.FileSystem) (fs.FS, error) {
+	s, ok := fsys.(*server)
+	if !ok {
+		return nil, errors.New("filesystem was not created by tarfs")
+	}
+	if s.upper != nil {
+		return nil, errors.New("writable filesystems are not supported by the io/fs adapter")
+	}
+	return &ioFS{s: s}, nil
+}
+
+type ioFS struct {
+	s *server
+	// dir is the directory the filesystem is rooted at, see Sub.
+	dir string
+}
+
+// resolve returns the entry for a name, along with its name in the archive.
+// Symlinks are followed, including in the directories leading to the entry.
+func (f *ioFS) resolve(op, name string) (string, FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	todo := splitPath(path.Join(f.dir, name))
+	var (
+		cur   string
+		fi    = f.s.lookup("")
+		links int
+	)
+	for len(todo) > 0 {
+		if !fi.Mode().IsDir() {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		elem := todo[0]
+		todo = todo[1:]
+		if elem == ".." {
+			// Links can't point above the root of the archive, like with
+			// chroot.
+			cur = parentName(cur)
+			fi = f.s.lookup(cur)
+			continue
+		}
+		next := path.Join(cur, elem)
+		nfi := f.s.lookup(next)
+		if nfi == nil {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if nfi.Mode()&os.ModeSymlink == 0 {
+			cur, fi = next, nfi
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+		}
+		target := nfi.Linkname()
+		if path.IsAbs(target) {
+			cur, fi = "", f.s.lookup("")
+		}
+		todo = append(splitPath(target), todo...)
+	}
+	return cur, fi, nil
+}
+
+// splitPath returns the elements of a slash separated path.
+func splitPath(p string) []string {
+	var elems []string
+	for _, e := range strings.Split(p, "/") {
+		if e != "" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+func (f *ioFS) Open(name string) (fs.File, error) {
+	full, fi, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info := &ioFileInfo{FileInfo: fi, name: path.Base(name)}
+	switch {
+	case fi.Mode().IsDir():
+		return &ioDir{fs: f, info: info, name: full}, nil
+	case fi.Mode().IsRegular():
+		if err := f.s.verifyFile(fi); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &ioFile{SectionReader: f.s.data(fi), info: info}, nil
+	}
+	// device nodes, named pipes and sockets have no content
+	return &ioFile{SectionReader: io.NewSectionReader(strings.NewReader(""), 0, 0), info: info}, nil
+}
+
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	_, fi, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &ioFileInfo{FileInfo: fi, name: path.Base(name)}, nil
+}
+
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, fi, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return f.readDir(full), nil
+}
+
+// readDir returns the entries of a directory, sorted by name.
+func (f *ioFS) readDir(name string) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, e := range f.s.db.Entries(fuseNameToKey(name)) {
+		base := path.Base(e.Name())
+		if f.s.lookup(path.Join(name, base)) == nil {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(&ioFileInfo{FileInfo: e, name: base}))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	_, fi, err := f.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	if !fi.Mode().IsRegular() {
+		return []byte{}, nil
+	}
+	if err := f.s.verifyFile(fi); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	data := make([]byte, fi.Size())
+	if _, err := f.s.data(fi).ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (f *ioFS) Sub(dir string) (fs.FS, error) {
+	full, fi, err := f.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &ioFS{s: f.s, dir: full}, nil
+}
+
+// ioFileInfo implements fs.FileInfo for archive entries, which have the full
+// path as their name.
+type ioFileInfo struct {
+	FileInfo
+	name string
+}
+
+func (fi *ioFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *ioFileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+// Sys returns the `*StatT` of entries read by this package.
+func (fi *ioFileInfo) Sys() interface{} {
+	if n := asNode(fi.FileInfo); n != nil {
+		return n.stat
+	}
+	return nil
+}
+
+// ioFile is an opened file, which is read directly from the archive.
+type ioFile struct {
+	*io.SectionReader
+	info *ioFileInfo
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *ioFile) Close() error {
+	return nil
+}
+
+// ioDir is an opened directory.
+type ioDir struct {
+	fs      *ioFS
+	info    *ioFileInfo
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: syscall.EISDIR}
+}
+
+func (d *ioDir) Close() error {
+	return nil
+}
+
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.entries = d.fs.readDir(d.name)
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,155 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// newIOFSTestArchive returns a test archive, optionally with symlinks which
+// can't be resolved. Those are left out for fstest.TestFS, which expects all
+// entries to be readable.
+func newIOFSTestArchive(t *testing.T, broken bool) []byte {
+	entries := []testEntry{
+		{"dir", os.ModeDir | 0755, "", nil},
+		{"dir/file", 0644, string(testData(100)), nil},
+		{"dir/sub", os.ModeDir | 0755, "", nil},
+		{"dir/sub/empty", 0644, "", nil},
+		{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: "dir/sub/up", Linkname: "../file"}},
+		{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: "abs", Linkname: "/dir/sub"}},
+		{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "../../dir/file"}},
+		{hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "dir/file"}},
+		{hdr: &tar.Header{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+	}
+	if broken {
+		entries = append(entries,
+			testEntry{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: "loop", Linkname: "loop"}},
+			testEntry{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: "dangling", Linkname: "nope"}},
+		)
+	}
+	return testArchive(t, entries)
+}
+
+func newTestIOFS(t *testing.T, broken bool) fs.FS {
+	data := newIOFSTestArchive(t, broken)
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewIOFS(tfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestIOFS(t *testing.T) {
+	fsys := newTestIOFS(t, false)
+	if err := fstest.TestFS(fsys, "dir/file", "dir/sub/empty", "dir/sub/up", "hardlink", "null", "escape"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "abs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "empty", "up"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dir/sub/up", "hardlink", "escape", "abs/up"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(data, testData(100)) {
+			t.Fatalf("%s: content does not match", name)
+		}
+	}
+
+	fsys = newTestIOFS(t, true)
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"loop", syscall.ELOOP},
+		{"dangling", fs.ErrNotExist},
+		{"dir/file/nope", syscall.ENOTDIR},
+		{"/dir", fs.ErrInvalid},
+		{"dir/../dir", fs.ErrInvalid},
+	} {
+		if _, err := fs.Stat(fsys, tc.name); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestIOFSFile(t *testing.T) {
+	fsys := newTestIOFS(t, false)
+	f, err := fsys.Open("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		t.Fatal("expected files to implement io.ReaderAt")
+	}
+	p := make([]byte, 10)
+	if _, err := ra.ReadAt(p, 50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, testData(100)[50:60]) {
+		t.Fatal("content does not match")
+	}
+
+	seeker, ok := f.(io.Seeker)
+	if !ok {
+		t.Fatal("expected files to implement io.Seeker")
+	}
+	if _, err := seeker.Seek(90, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, testData(100)[90:]) {
+		t.Fatal("content does not match")
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Sys().(*StatT); !ok {
+		t.Fatalf("expected *StatT from Sys, got %T", st.Sys())
+	}
+}
+
+func TestIOFSWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := newIOFSTestArchive(t, false)
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewIOFS(tfs); err == nil {
+		t.Fatal("expected error for writable filesystem")
+	}
+}
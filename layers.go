@@ -0,0 +1,349 @@
+package tarfs
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+)
+
+// Layer is an archive which is used as a layer of a filesystem, see
+// `FromLayers`.
+type Layer struct {
+	io.ReaderAt
+	Size int64
+}
+
+// layerStream is the uncompressed stream of a layer.
+// The data offsets of entries are shifted by `base`, the offset of the layer
+// in the concatenated streams of all layers.
+type layerStream struct {
+	io.ReaderAt
+	base int64
+	// toc is set for layers which were indexed from a table of contents,
+	// their streams only hold the content of files and no tar headers.
+	toc bool
+}
+
+// data returns a reader for the content of an archive entry, which is verified
+// if the server verifies file contents.
+func (s *server) data(fi FileInfo) *io.SectionReader {
+	sr := s.rawData(fi)
+	if !s.verified(fi) {
+		return sr
+	}
+	return io.NewSectionReader(newVerifiedReaderAt(s.verify, fi.Name(), dataOffset(fi), fi.Size(), sr), 0, fi.Size())
+}
+
+// dataOffset returns the offset of the content of an entry in the
+// concatenated streams of all layers.
+// Entries which were not read by this package have no data offset, for those
+// the inode number is used as the offset.
+func dataOffset(fi FileInfo) int64 {
+	if n := asNode(fi); n != nil && n.stat != nil {
+		return n.stat.DataOffset
+	}
+	return fi.Inode()
+}
+
+// rawData returns a reader for the content of an archive entry.
+func (s *server) rawData(fi FileInfo) *io.SectionReader {
+	var (
+		layer  int
+		off    = dataOffset(fi)
+		sparse []SparseEntry
+	)
+	if n := asNode(fi); n != nil {
+		layer = n.layer
+		if n.stat != nil {
+			sparse = n.stat.Sparse
+		}
+	}
+	if layer >= len(s.layers) {
+		return io.NewSectionReader(errReaderAt{errors.Errorf("invalid layer %d for %s", layer, fi.Name())}, 0, fi.Size())
+	}
+	l := s.layers[layer]
+	off -= l.base
+	if sparse != nil {
+		return io.NewSectionReader(newSparseReaderAt(l, off, sparse), 0, fi.Size())
+	}
+	return io.NewSectionReader(l, off, fi.Size())
+}
+
+type errReaderAt struct {
+	err error
+}
+
+func (r errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, r.err
+}
+
+// FromLayers creates a new tarfs server which serves the passed in archives
+// stacked on top of each other, like the layers of a container image.
+// Layers are ordered from the bottom to the top, entries in a layer replace
+// the entries with the same name in the layers below it.
+//
+// OCI style whiteouts are applied, a `.wh.<name>` entry removes `<name>` from
+// the layers below and a `.wh..wh..opq` entry hides the content a directory
+// has in the layers below. The whiteout entries themselves are not part of
+// the filesystem.
+//
+// The merged metadata of all layers is stored in the passed in metadata store.
+// As with `FromReaderAt`, compressed layers are supported. Index files (see
+// `WithIndexFile`) are not supported for layered filesystems.
+func FromLayers(layers []Layer, db MetadataStore, opts ...Opt) (pathfs.FileSystem, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("no layers")
+	}
+	cfg := newConfig(opts)
+	var digests contentDigests
+	if cfg.computeDigests {
+		digests = make(contentDigests)
+	}
+	m := newLayerMerger()
+	streams := make([]layerStream, 0, len(layers))
+	var base int64
+	for i, l := range layers {
+		format, err := detectCompression(l, l.Size)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading layer %d", i)
+		}
+		ldb := &layerStore{MetadataStore: NewBTreeStore(2)}
+		var ldigests contentDigests
+		if digests != nil {
+			ldigests = make(contentDigests)
+		}
+		a, err := indexArchive(l, l.Size, format, ldb, ldigests)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading layer %d", i)
+		}
+		// The data offsets of the layer are shifted like the ones of its
+		// entries, see `layerMerger.apply`.
+		for off, fd := range ldigests {
+			digests[off+base] = fd
+		}
+		if err := m.apply(ldb, i, base); err != nil {
+			return nil, errors.Wrapf(err, "error reading layer %d", i)
+		}
+		streams = append(streams, layerStream{ReaderAt: a.stream, base: base, toc: a.toc})
+		base += a.size
+	}
+	if err := m.store(db); err != nil {
+		return nil, err
+	}
+	s := newServer(db, streams, opts...)
+	if digests != nil {
+		s.verify.add(digests)
+	}
+	return s, nil
+}
+
+// layerStore is the metadata store of a single layer. Layers don't need to
+// have the parent directories of their entries, or the targets of their hard
+// links, if those are in the layers below. The indexer leaves them to
+// `layerMerger.apply`.
+type layerStore struct {
+	MetadataStore
+	// missingDirs are the parent directories which are not in the layer.
+	missingDirs map[string]struct{}
+	// links has the hard links whose target is not in the layer.
+	links *linkResolver
+}
+
+// mergedEntry is an entry in the merged tree of all layers.
+type mergedEntry struct {
+	n        *node
+	children map[string]*mergedEntry
+	// order is the order the children were added in
+	order []string
+}
+
+func (e *mergedEntry) remove(name string) {
+	if _, ok := e.children[name]; !ok {
+		return
+	}
+	delete(e.children, name)
+	for i, n := range e.order {
+		if n == name {
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			break
+		}
+	}
+}
+
+type layerMerger struct {
+	root *mergedEntry
+	// lastIno is the highest inode number of the merged layers
+	lastIno int64
+}
+
+func newLayerMerger() *layerMerger {
+	return &layerMerger{
+		root:    &mergedEntry{children: make(map[string]*mergedEntry)},
+		lastIno: rootIno,
+	}
+}
+
+// get returns the merged entry for the passed in key.
+func (m *layerMerger) get(key string) *mergedEntry {
+	e := m.root
+	for _, name := range strings.Split(strings.Trim(key, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		e = e.children[name]
+		if e == nil {
+			return nil
+		}
+	}
+	return e
+}
+
+// apply merges the entries of a layer on top of the layers which were
+// already merged.
+// Parent directories and hard link targets which are not in the layer are
+// looked up in the merged layers.
+func (m *layerMerger) apply(ldb *layerStore, layer int, base int64) error {
+	var keys []string
+	storeKeys(ldb, "/", &keys)
+	// Entries in missing directories are only reachable from those, which
+	// have no metadata.
+	missingDirs := make([]string, 0, len(ldb.missingDirs))
+	for dir := range ldb.missingDirs {
+		missingDirs = append(missingDirs, dir)
+	}
+	sort.Strings(missingDirs)
+	for _, dir := range missingDirs {
+		keys = append(keys, dir)
+		for _, e := range ldb.Get(dir).(*dirNode).entries {
+			storeKeys(ldb, filepath.Join(dir, filepath.Base(e.Name())), &keys)
+		}
+	}
+
+	// Whiteouts only apply to the layers below, so they are handled before
+	// the entries of the layer are added.
+	for _, key := range keys {
+		name := filepath.Base(key)
+		switch {
+		case name == whiteoutOpaque:
+			if dir := m.get(filepath.Dir(key)); dir != nil {
+				dir.children = make(map[string]*mergedEntry)
+				dir.order = nil
+			}
+		case strings.HasPrefix(name, whiteoutPrefix):
+			if dir := m.get(filepath.Dir(key)); dir != nil {
+				dir.remove(strings.TrimPrefix(name, whiteoutPrefix))
+			}
+		}
+	}
+
+	// The inode numbers of the layer follow the ones of the layers below.
+	inoBase := m.lastIno - rootIno
+	shifted := make(map[*StatT]struct{})
+	var missing []string
+	for _, key := range keys {
+		if strings.HasPrefix(filepath.Base(key), whiteoutPrefix) {
+			continue
+		}
+		if _, ok := ldb.missingDirs[key]; ok {
+			if dir := m.get(key); dir == nil || dir.children == nil {
+				missing = append(missing, key)
+			}
+			continue
+		}
+		n := asNode(ldb.Get(key))
+		n.layer = layer
+		// Hard links share their stat, which must only be shifted once.
+		if _, ok := shifted[n.stat]; !ok {
+			n.stat.DataOffset += base
+			if key != "/" {
+				n.stat.Ino += inoBase
+			}
+			if n.stat.Ino > m.lastIno {
+				m.lastIno = n.stat.Ino
+			}
+			shifted[n.stat] = struct{}{}
+		}
+
+		if key == "/" {
+			if n.length != 0 || m.root.n == nil {
+				m.root.n = n
+			}
+			continue
+		}
+
+		parent := m.get(filepath.Dir(key))
+		if parent == nil || parent.children == nil {
+			// The parent was replaced by a non-directory.
+			continue
+		}
+		name := filepath.Base(key)
+		existing, ok := parent.children[name]
+		if ok && existing.n.Mode().IsDir() && n.Mode().IsDir() {
+			existing.n = n
+			continue
+		}
+		if !ok {
+			parent.order = append(parent.order, name)
+		}
+		e := &mergedEntry{n: n}
+		if n.Mode().IsDir() {
+			e.children = make(map[string]*mergedEntry)
+		}
+		parent.children[name] = e
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("missing directory entries: %s", strings.Join(missing, ","))
+	}
+	return m.resolveLinks(ldb.links)
+}
+
+// resolveLinks points the hard links of a layer at their targets in the
+// merged layers.
+func (m *layerMerger) resolveLinks(links *linkResolver) error {
+	if links == nil {
+		return nil
+	}
+	for target := range links.pending {
+		if links.isPending(target) {
+			// The target is a link itself, it is resolved with its own
+			// target.
+			continue
+		}
+		if e := m.get(target); e != nil && e.children == nil {
+			links.resolve(target, e.n)
+		}
+	}
+	if missing := links.missing(); len(missing) != 0 {
+		return errors.Errorf("missing hard link targets: %s", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// store adds the merged entries to db.
+func (m *layerMerger) store(db MetadataStore) error {
+	_, err := m.storeEntry(db, "/", m.root)
+	return err
+}
+
+func (m *layerMerger) storeEntry(db MetadataStore, key string, e *mergedEntry) (FileInfo, error) {
+	if e.children == nil {
+		return e.n, db.Add(key, e.n)
+	}
+	dir := &dirNode{node: e.n}
+	for _, name := range e.order {
+		child, err := m.storeEntry(db, filepath.Join(key, name), e.children[name])
+		if err != nil {
+			return nil, err
+		}
+		dir.entries = append(dir.entries, child)
+	}
+	dir.stat.Nlink = dirNlink(dir.entries)
+	if err := db.Add(key, dir); err != nil {
+		return nil, errors.Wrapf(err, "error adding node entry to db: %s", key)
+	}
+	return dir, nil
+}
@@ -0,0 +1,186 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type testEntry struct {
+	name string
+	mode os.FileMode
+	data string
+	// hdr is written instead of a header for name and mode if it is set,
+	// e.g. for links or xattrs. The size is set from data, and the
+	// modification time if it is not set.
+	hdr *tar.Header
+}
+
+func testArchive(t *testing.T, entries []testEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, e := range entries {
+		h := e.hdr
+		if h == nil {
+			h = newTestHeader(e.name, e.mode, 0, now)
+		}
+		h.Size = int64(len(e.data))
+		if h.ModTime.IsZero() {
+			h.ModTime = now
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestFromLayers(t *testing.T) {
+	layers := [][]byte{
+		testArchive(t, []testEntry{
+			{"foo", os.ModeDir | 0755, "", nil},
+			{"foo/a", 0644, "a", nil},
+			{"foo/b", 0644, "b", nil},
+			{"bar", os.ModeDir | 0755, "", nil},
+			{"bar/x", 0644, "x", nil},
+			{"baz", 0644, "baz", nil},
+		}),
+		testArchive(t, []testEntry{
+			{"foo", os.ModeDir | 0750, "", nil},
+			{"foo/.wh.a", 0644, "", nil},
+			{"foo/c", 0644, "c", nil},
+			{"bar", os.ModeDir | 0755, "", nil},
+			{"bar/.wh..wh..opq", 0644, "", nil},
+			{"bar/y", 0644, "y", nil},
+			{"baz", os.ModeDir | 0755, "", nil},
+			{"baz/z", 0644, "z", nil},
+		}),
+		gzipMembers(t, testArchive(t, []testEntry{
+			{"foo", os.ModeDir | 0750, "", nil},
+			{"foo/b", 0644, "b2", nil},
+		}), 1),
+	}
+
+	var ll []Layer
+	for _, l := range layers {
+		ll = append(ll, Layer{ReaderAt: bytes.NewReader(l), Size: int64(len(l))})
+	}
+	fs, err := FromLayers(ll, NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, expected := range map[string]string{
+		"":    "bar,baz,foo",
+		"foo": "b,c",
+		"bar": "y",
+		"baz": "z",
+	} {
+		if names := dirNames(t, fs, dir); names != expected {
+			t.Fatalf("%s: expected entries %s, got %s", dir, expected, names)
+		}
+	}
+
+	inodes := make(map[uint64]string)
+	for name, expected := range map[string]string{
+		"foo/b": "b2",
+		"foo/c": "c",
+		"bar/y": "y",
+		"baz/z": "z",
+	} {
+		if data := readTestFile(t, fs, name); string(data) != expected {
+			t.Fatalf("%s: expected %q, got %q", name, expected, data)
+		}
+		attr, status := fs.GetAttr(name, &fuse.Context{})
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if other, ok := inodes[attr.Ino]; ok {
+			t.Fatalf("%s has the same inode as %s", name, other)
+		}
+		inodes[attr.Ino] = name
+	}
+
+	attr, status := fs.GetAttr("foo", &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if attr.Mode&0777 != 0750 {
+		t.Fatalf("expected directory metadata from the top layer, got %o", attr.Mode&0777)
+	}
+	if _, status := fs.GetAttr("foo/.wh.a", &fuse.Context{}); status != fuse.ENOENT {
+		t.Fatalf("expected whiteouts to be hidden, got %v", status)
+	}
+
+	_, entries := readExport(t, fs, ExportFull)
+	if names := entryNames(entries); names != "foo/c,bar/,bar/y,baz/,baz/z,foo/,foo/b" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
+
+func testLayers(t *testing.T, layers ...[]testEntry) []Layer {
+	var ll []Layer
+	for _, entries := range layers {
+		data := testArchive(t, entries)
+		ll = append(ll, Layer{ReaderAt: bytes.NewReader(data), Size: int64(len(data))})
+	}
+	return ll
+}
+
+func TestFromLayersLowerEntries(t *testing.T) {
+	lower := []testEntry{
+		{"foo", os.ModeDir | 0755, "", nil},
+		{"foo/a", 0644, "a", nil},
+	}
+	fs, err := FromLayers(testLayers(t, lower, []testEntry{
+		// the parent directory and link target are in the layer below
+		{"foo/b", 0644, "b", nil},
+		{hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "foo/a"}},
+		{hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "foo/link", Linkname: "link"}},
+	}), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := dirNames(t, fs, "foo"); names != "a,b,link" {
+		t.Fatalf("expected entries a,b,link, got %s", names)
+	}
+	target, status := fs.GetAttr("foo/a", &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if target.Nlink != 3 {
+		t.Fatalf("expected 3 links, got %d", target.Nlink)
+	}
+	for _, name := range []string{"link", "foo/link"} {
+		attr, status := fs.GetAttr(name, &fuse.Context{})
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if attr.Ino != target.Ino {
+			t.Fatalf("%s: expected inode %d, got %d", name, target.Ino, attr.Ino)
+		}
+		if data := readTestFile(t, fs, name); string(data) != "a" {
+			t.Fatalf("%s: expected %q, got %q", name, "a", data)
+		}
+	}
+
+	for name, upper := range map[string]testEntry{
+		"missing directory":   {"bar/b", 0644, "b", nil},
+		"missing link target": {hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "foo/nope"}},
+		"directory link":      {hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "foo"}},
+	} {
+		if _, err := FromLayers(testLayers(t, lower, []testEntry{upper}), NewBTreeStore(2)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
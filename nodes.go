@@ -0,0 +1,604 @@
+package tarfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements the node based filesystem, which serves a server
+// through the go-fuse node API.
+// The kernel refers to entries by node ids which stay the same for as long as
+// it references the entries, and the nodes it looked up are kept in a tree.
+//
+// For read-only filesystems the tree is built from the metadata store: each
+// node holds its archive entry, and names are looked up in the entries of the
+// directory node they are in.
+// In writable filesystems entries move between the archive and the upper dir,
+// so operations are passed to the server with the path of the node instead,
+// see `overlayNode`.
+
+// NewNodeFS returns the root node of a node based filesystem which serves the
+// passed in filesystem, which must be created by this package.
+// The filesystem is mounted with `fs.Mount`, or served with `fs.NewNodeFS`,
+// using the options from `NodeOptions`.
+//
+// Archive entries are served with their inode numbers from the metadata
+// store, and hard links to the same entry share a node. Entries which only
+// exist in the upper dir of writable filesystems (see `WithUpperDir`) get
+// inode numbers assigned by go-fuse, which are kept while the kernel knows the
+// entry, also when archive entries are copied to the upper dir.
+// Directory listings are returned with `Readdirplus`, using the same lookups.
+func NewNodeFS(tfs pathfs.FileSystem) (fs.InodeEmbedder, error) {
+	s, ok := tfs.(*server)
+	if !ok {
+		return nil, errors.New("filesystem was not created by tarfs")
+	}
+	if s.upper != nil {
+		return &overlayNode{s: s}, nil
+	}
+	root := s.db.Get("/")
+	if root == nil {
+		return nil, errors.New("archive has no root directory")
+	}
+	return &tarNode{s: s, key: "/", fi: root}, nil
+}
+
+// NodeOptions returns the mount options for the filesystem returned by
+// `NewNodeFS`.
+// The content of read-only filesystems never changes, so the kernel may cache
+// lookups and attributes for the lifetime of the mount. Writable filesystems
+// use the default timeouts of go-fuse.
+// Modes are served as they are in the archive, also if no permission bits
+// are set.
+func NodeOptions(tfs pathfs.FileSystem) *fs.Options {
+	timeout := time.Second
+	var negative *time.Duration
+	if s, ok := tfs.(*server); ok && s.upper == nil {
+		timeout = nodeTimeout
+		negative = &timeout
+	}
+	return &fs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: negative,
+		NullPermissions: true,
+		RootStableAttr:  &fs.StableAttr{Ino: rootIno},
+	}
+}
+
+// nodeTimeout is the cache timeout for entries of read-only filesystems.
+const nodeTimeout = 24 * time.Hour
+
+// tarNode is a node of a read-only filesystem, for the archive entry `fi`
+// which is stored as `key` in the metadata store.
+type tarNode struct {
+	fs.Inode
+	s   *server
+	key string
+	fi  FileInfo
+}
+
+var (
+	_ fs.NodeLookuper    = (*tarNode)(nil)
+	_ fs.NodeGetattrer   = (*tarNode)(nil)
+	_ fs.NodeOpendirer   = (*tarNode)(nil)
+	_ fs.NodeReaddirer   = (*tarNode)(nil)
+	_ fs.NodeOpener      = (*tarNode)(nil)
+	_ fs.NodeReadlinker  = (*tarNode)(nil)
+	_ fs.NodeAccesser    = (*tarNode)(nil)
+	_ fs.NodeGetxattrer  = (*tarNode)(nil)
+	_ fs.NodeListxattrer = (*tarNode)(nil)
+	_ fs.NodeStatfser    = (*tarNode)(nil)
+	_ fs.NodeOnForgetter = (*tarNode)(nil)
+	_ fs.NodeLseeker     = (*tarNode)(nil)
+)
+
+// attr returns the attributes of the node, as the server reports them.
+func (n *tarNode) attr() *fuse.Attr {
+	return n.s.fileAttr(n.fi)
+}
+
+// allowed checks if the caller has the requested access to the node, unless
+// permissions are checked by the kernel.
+func (n *tarNode) allowed(ctx context.Context, mask uint32) bool {
+	return n.s.defaultPermissions || accessAllowed(n.attr(), fuseContext(ctx), mask)
+}
+
+// OnForget is called for the root node when the filesystem is unmounted.
+func (n *tarNode) OnForget() {
+	if n.IsRoot() {
+		n.s.OnUnmount()
+	}
+}
+
+func (n *tarNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	key := filepath.Join(n.key, name)
+	logrus.WithField("name", key).Debug("Lookup")
+	if !n.fi.Mode().IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	if !n.allowed(ctx, accessExec) {
+		return nil, syscall.EACCES
+	}
+	fi := n.s.db.Get(key)
+	if fi == nil {
+		return nil, syscall.ENOENT
+	}
+	child := &tarNode{s: n.s, key: key, fi: fi}
+	out.Attr = *child.attr()
+	// Hard links have the same inode number, go-fuse returns the node
+	// which was created for the first of them.
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT, Ino: out.Attr.Ino}), 0
+}
+
+func (n *tarNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = *n.attr()
+	return 0
+}
+
+func (n *tarNode) Opendir(ctx context.Context) syscall.Errno {
+	if !n.allowed(ctx, accessRead) {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+func (n *tarNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	logrus.WithField("name", n.key).Debug("Readdir")
+	var entries []fuse.DirEntry
+	for _, e := range n.s.db.Entries(n.key) {
+		entries = append(entries, dirEntry(e))
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *tarNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	logrus.WithField("name", n.key).Debug("Open")
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !n.allowed(ctx, openMask(flags)) {
+		return nil, 0, syscall.EACCES
+	}
+	if n.fi.Mode()&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		// Device nodes, named pipes and sockets are opened by the kernel.
+		return nil, 0, syscall.ENXIO
+	}
+	f, status := n.s.openFile(n.fi)
+	if !status.Ok() {
+		return nil, 0, toErrno(status)
+	}
+	// The content of the archive never changes.
+	return &nodeFile{File: f}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// Lseek reports the holes of sparse files for SEEK_DATA and SEEK_HOLE, other
+// seeks are handled by the kernel.
+func (n *tarNode) Lseek(ctx context.Context, f fs.FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	pos, err := seekData(n.fi, int64(off), int(whence))
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	return uint64(pos), 0
+}
+
+func (n *tarNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.fi.Mode()&os.ModeSymlink == 0 {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.fi.Linkname()), 0
+}
+
+func (n *tarNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	if mask&accessWrite != 0 {
+		return syscall.EROFS
+	}
+	if !n.allowed(ctx, mask&(accessRead|accessExec)) {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+func (n *tarNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	v, ok := n.fi.Xattrs()[attr]
+	if !ok {
+		return 0, toErrno(fuse.ENOATTR)
+	}
+	return copyXattr(dest, n.s.hostXattr(attr, v))
+}
+
+func (n *tarNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var data []byte
+	for _, a := range xattrNames(n.fi) {
+		data = append(append(data, a...), 0)
+	}
+	return copyXattr(dest, data)
+}
+
+func (n *tarNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	*out = *n.s.StatFs("")
+	return 0
+}
+
+// overlayNode is a node of a writable filesystem. The server resolves the
+// path of the node, as entries are copied to the upper dir, removed or
+// renamed.
+type overlayNode struct {
+	fs.Inode
+	s *server
+}
+
+var (
+	_ fs.NodeLookuper      = (*overlayNode)(nil)
+	_ fs.NodeGetattrer     = (*overlayNode)(nil)
+	_ fs.NodeSetattrer     = (*overlayNode)(nil)
+	_ fs.NodeOpendirer     = (*overlayNode)(nil)
+	_ fs.NodeReaddirer     = (*overlayNode)(nil)
+	_ fs.NodeOpener        = (*overlayNode)(nil)
+	_ fs.NodeCreater       = (*overlayNode)(nil)
+	_ fs.NodeMkdirer       = (*overlayNode)(nil)
+	_ fs.NodeMknoder       = (*overlayNode)(nil)
+	_ fs.NodeSymlinker     = (*overlayNode)(nil)
+	_ fs.NodeLinker        = (*overlayNode)(nil)
+	_ fs.NodeUnlinker      = (*overlayNode)(nil)
+	_ fs.NodeRmdirer       = (*overlayNode)(nil)
+	_ fs.NodeRenamer       = (*overlayNode)(nil)
+	_ fs.NodeReadlinker    = (*overlayNode)(nil)
+	_ fs.NodeAccesser      = (*overlayNode)(nil)
+	_ fs.NodeGetxattrer    = (*overlayNode)(nil)
+	_ fs.NodeListxattrer   = (*overlayNode)(nil)
+	_ fs.NodeSetxattrer    = (*overlayNode)(nil)
+	_ fs.NodeRemovexattrer = (*overlayNode)(nil)
+	_ fs.NodeStatfser      = (*overlayNode)(nil)
+	_ fs.NodeLseeker       = (*overlayNode)(nil)
+	_ fs.NodeOnForgetter   = (*overlayNode)(nil)
+)
+
+// path returns the name of the node for the server. Nodes which were removed
+// get a name which does not exist.
+func (n *overlayNode) path() string {
+	return n.Path(n.Root())
+}
+
+func (n *overlayNode) childPath(name string) string {
+	return filepath.Join(n.path(), name)
+}
+
+// OnForget is called for the root node when the filesystem is unmounted.
+func (n *overlayNode) OnForget() {
+	if n.IsRoot() {
+		n.s.OnUnmount()
+	}
+}
+
+func (n *overlayNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	attr, status := n.s.GetAttr(n.childPath(name), fuseContext(ctx))
+	if !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.newChild(ctx, name, attr, out), 0
+}
+
+// newChild returns the node for the entry `name` with the passed in
+// attributes.
+func (n *overlayNode) newChild(ctx context.Context, name string, attr *fuse.Attr, out *fuse.EntryOut) *fs.Inode {
+	out.Attr = *attr
+	id := fs.StableAttr{Mode: attr.Mode & syscall.S_IFMT, Ino: attr.Ino}
+	if n.s.upper != nil && attr.Nlink > 1 && id.Mode != syscall.S_IFDIR {
+		// Hard links from the archive are copied to the upper dir one at a
+		// time, so each of them needs its own node to be changed through.
+		id.Ino = 0
+	}
+	if id.Ino == 0 {
+		// Entries in the upper dir have no inode number which is unique
+		// within the filesystem, keep the node the kernel knows them by.
+		if child := n.GetChild(name); child != nil && child.StableAttr().Mode == id.Mode {
+			return child
+		}
+	}
+	return n.NewInode(ctx, &overlayNode{s: n.s}, id)
+}
+
+// lookupCreated returns the node for an entry which was just created.
+func (n *overlayNode) lookupCreated(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	attr, status := n.s.attr(n.childPath(name), fuseContext(ctx))
+	if !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.newChild(ctx, name, attr, out), 0
+}
+
+func (n *overlayNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// Files which are open can be removed, their attributes are only
+	// available through the file.
+	if nf, ok := f.(*nodeFile); ok {
+		if status := nf.GetAttr(&out.Attr); status.Ok() {
+			return 0
+		}
+	}
+	attr, status := n.s.GetAttr(n.path(), fuseContext(ctx))
+	if !status.Ok() {
+		return toErrno(status)
+	}
+	out.Attr = *attr
+	return 0
+}
+
+func (n *overlayNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	name, fctx := n.path(), fuseContext(ctx)
+	if mode, ok := in.GetMode(); ok {
+		if status := n.s.Chmod(name, mode, fctx); !status.Ok() {
+			return toErrno(status)
+		}
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		if status := n.s.Chown(name, uid, gid, fctx); !status.Ok() {
+			return toErrno(status)
+		}
+	}
+	if size, ok := in.GetSize(); ok {
+		var status fuse.Status
+		if nf, ok := f.(*nodeFile); ok {
+			status = nf.Truncate(size)
+		} else {
+			status = n.s.Truncate(name, size, fctx)
+		}
+		if !status.Ok() {
+			return toErrno(status)
+		}
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		var a, m *time.Time
+		if aok {
+			a = &atime
+		}
+		if mok {
+			m = &mtime
+		}
+		if status := n.s.Utimens(name, a, m, fctx); !status.Ok() {
+			return toErrno(status)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *overlayNode) Opendir(ctx context.Context) syscall.Errno {
+	_, status := n.s.checkAccess(n.path(), accessRead, fuseContext(ctx))
+	return toErrno(status)
+}
+
+func (n *overlayNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, status := n.s.readDir(n.path(), fuseContext(ctx))
+	if !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *overlayNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	f, status := n.s.Open(n.path(), flags, fuseContext(ctx))
+	if !status.Ok() {
+		return nil, 0, toErrno(status)
+	}
+	var fuseFlags uint32
+	if n.s.upper == nil {
+		// The content of the archive never changes.
+		fuseFlags = fuse.FOPEN_KEEP_CACHE
+	}
+	return &nodeFile{File: f}, fuseFlags, 0
+}
+
+// Lseek reports the holes of sparse files for SEEK_DATA and SEEK_HOLE, from
+// the archive or from the file in the upper dir.
+func (n *overlayNode) Lseek(ctx context.Context, f fs.FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	name := n.path()
+	if !n.s.inUpper(name) {
+		fi := n.s.lookup(name)
+		if fi == nil {
+			return 0, syscall.ENOENT
+		}
+		pos, err := seekData(fi, int64(off), int(whence))
+		if err != nil {
+			return 0, fs.ToErrno(err)
+		}
+		return uint64(pos), 0
+	}
+
+	uf, err := os.Open(n.s.upperPath(name))
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	defer uf.Close() // nolint: errcheck
+	pos, err := unix.Seek(int(uf.Fd()), int64(off), int(whence))
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	return uint64(pos), 0
+}
+
+func (n *overlayNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	f, status := n.s.Create(n.childPath(name), flags, mode, fuseContext(ctx))
+	if !status.Ok() {
+		return nil, nil, 0, toErrno(status)
+	}
+	child, errno := n.lookupCreated(ctx, name, out)
+	if errno != 0 {
+		f.Release()
+		return nil, nil, 0, errno
+	}
+	return child, &nodeFile{File: f}, 0, 0
+}
+
+func (n *overlayNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if status := n.s.Mkdir(n.childPath(name), mode, fuseContext(ctx)); !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.lookupCreated(ctx, name, out)
+}
+
+func (n *overlayNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if status := n.s.Mknod(n.childPath(name), mode, dev, fuseContext(ctx)); !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.lookupCreated(ctx, name, out)
+}
+
+func (n *overlayNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if status := n.s.Symlink(target, n.childPath(name), fuseContext(ctx)); !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.lookupCreated(ctx, name, out)
+}
+
+func (n *overlayNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	oldName := target.EmbeddedInode().Path(n.Root())
+	if status := n.s.Link(oldName, n.childPath(name), fuseContext(ctx)); !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return n.lookupCreated(ctx, name, out)
+}
+
+func (n *overlayNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.s.Unlink(n.childPath(name), fuseContext(ctx)))
+}
+
+func (n *overlayNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.s.Rmdir(n.childPath(name), fuseContext(ctx)))
+}
+
+func (n *overlayNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		// Exchanging entries, or renaming only if the new name does not
+		// exist, is not supported.
+		return syscall.EINVAL
+	}
+	newPath := filepath.Join(newParent.EmbeddedInode().Path(n.Root()), newName)
+	return toErrno(n.s.Rename(n.childPath(name), newPath, fuseContext(ctx)))
+}
+
+func (n *overlayNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, status := n.s.Readlink(n.path(), fuseContext(ctx))
+	if !status.Ok() {
+		return nil, toErrno(status)
+	}
+	return []byte(target), 0
+}
+
+func (n *overlayNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return toErrno(n.s.Access(n.path(), mask, fuseContext(ctx)))
+}
+
+func (n *overlayNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	data, status := n.s.GetXAttr(n.path(), attr, fuseContext(ctx))
+	if !status.Ok() {
+		return 0, toErrno(status)
+	}
+	return copyXattr(dest, data)
+}
+
+func (n *overlayNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	attrs, status := n.s.ListXAttr(n.path(), fuseContext(ctx))
+	if !status.Ok() {
+		return 0, toErrno(status)
+	}
+	var data []byte
+	for _, a := range attrs {
+		data = append(append(data, a...), 0)
+	}
+	return copyXattr(dest, data)
+}
+
+// copyXattr copies an xattr value or list to the buffer of the caller, which
+// may be empty to get the size.
+func copyXattr(dest, data []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), 0
+}
+
+func (n *overlayNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return toErrno(n.s.SetXAttr(n.path(), attr, data, int(flags), fuseContext(ctx)))
+}
+
+func (n *overlayNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return toErrno(n.s.RemoveXAttr(n.path(), attr, fuseContext(ctx)))
+}
+
+func (n *overlayNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	*out = *n.s.StatFs("")
+	return 0
+}
+
+// nodeFile serves the files returned by the server through the node API.
+type nodeFile struct {
+	nodefs.File
+}
+
+var (
+	_ fs.FileReader    = (*nodeFile)(nil)
+	_ fs.FileWriter    = (*nodeFile)(nil)
+	_ fs.FileFlusher   = (*nodeFile)(nil)
+	_ fs.FileFsyncer   = (*nodeFile)(nil)
+	_ fs.FileReleaser  = (*nodeFile)(nil)
+	_ fs.FileAllocater = (*nodeFile)(nil)
+)
+
+func (f *nodeFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	rr, status := f.File.Read(dest, off)
+	return rr, toErrno(status)
+}
+
+func (f *nodeFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, status := f.File.Write(data, off)
+	return n, toErrno(status)
+}
+
+func (f *nodeFile) Flush(ctx context.Context) syscall.Errno {
+	return toErrno(f.File.Flush())
+}
+
+func (f *nodeFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return toErrno(f.File.Fsync(int(flags)))
+}
+
+func (f *nodeFile) Release(ctx context.Context) syscall.Errno {
+	f.File.Release()
+	return 0
+}
+
+func (f *nodeFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	return toErrno(f.File.Allocate(off, size, mode))
+}
+
+// fuseContext returns the caller of an operation of the node API in the form
+// the server takes it.
+func fuseContext(ctx context.Context) *fuse.Context {
+	if c, ok := ctx.(*fuse.Context); ok {
+		return c
+	}
+	c := &fuse.Context{Cancel: ctx.Done()}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		c.Caller = *caller
+	}
+	return c
+}
+
+func toErrno(status fuse.Status) syscall.Errno {
+	return syscall.Errno(status)
+}
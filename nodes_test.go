@@ -0,0 +1,296 @@
+package tarfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+// newTestNodeFS returns the node filesystem for tfs, as the kernel talks to
+// it.
+func newTestNodeFS(t *testing.T, tfs pathfs.FileSystem) (fuse.RawFileSystem, *fs.Inode) {
+	root, err := NewNodeFS(tfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.NewNodeFS(root, NodeOptions(tfs)), root.EmbeddedInode()
+}
+
+// lookupNode looks up all components of name, starting at the root node.
+func lookupNode(raw fuse.RawFileSystem, name string) (fuse.EntryOut, fuse.Status) {
+	out := fuse.EntryOut{NodeId: fuse.FUSE_ROOT_ID}
+	if name == "" {
+		return out, fuse.OK
+	}
+	for _, component := range strings.Split(name, "/") {
+		parent := out.NodeId
+		out = fuse.EntryOut{}
+		if status := raw.Lookup(nil, &fuse.InHeader{NodeId: parent}, component, &out); !status.Ok() {
+			return out, status
+		}
+		if out.NodeId == 0 {
+			// negative entry
+			return out, fuse.ENOENT
+		}
+	}
+	return out, fuse.OK
+}
+
+func mustLookupNode(t *testing.T, raw fuse.RawFileSystem, name string) fuse.EntryOut {
+	out, status := lookupNode(raw, name)
+	if !status.Ok() {
+		t.Fatalf("%s: lookup failed: %v", name, status)
+	}
+	return out
+}
+
+// readDirPlus lists a directory with READDIRPLUS, which looks up all its
+// entries.
+func readDirPlus(t *testing.T, raw fuse.RawFileSystem, id uint64) {
+	var open fuse.OpenOut
+	if status := raw.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}}, &open); !status.Ok() {
+		t.Fatal(status)
+	}
+	buf := make([]byte, 64<<10)
+	in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh, Size: uint32(len(buf))}
+	if status := raw.ReadDirPlus(nil, in, fuse.NewDirEntryList(buf, 0)); !status.Ok() {
+		t.Fatal(status)
+	}
+	raw.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh})
+}
+
+// readNode reads the content of a file through the node filesystem.
+func readNode(t *testing.T, raw fuse.RawFileSystem, id uint64, size int) []byte {
+	var open fuse.OpenOut
+	if status := raw.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}, Flags: uint32(os.O_RDONLY)}, &open); !status.Ok() {
+		t.Fatal(status)
+	}
+	defer raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh})
+	buf := make([]byte, size)
+	rr, status := raw.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh, Size: uint32(size)}, buf)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := rr.Bytes(buf)
+	return data
+}
+
+// compareNodes checks that the node filesystem serves the same content as the
+// path based filesystem.
+func compareNodes(t *testing.T, raw fuse.RawFileSystem, root *fs.Inode, tfs pathfs.FileSystem, name string) {
+	fCtx := &fuse.Context{}
+	out := mustLookupNode(t, raw, name)
+	if name != "" {
+		if again := mustLookupNode(t, raw, name); again.NodeId != out.NodeId {
+			t.Fatalf("%s: expected the same node for repeated lookups, got %d and %d", name, out.NodeId, again.NodeId)
+		}
+	}
+	header := fuse.InHeader{NodeId: out.NodeId}
+
+	expected, status := tfs.GetAttr(name, fCtx)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	var attr fuse.AttrOut
+	if status := raw.GetAttr(nil, &fuse.GetAttrIn{InHeader: header}, &attr); !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	if attr.Attr != *expected {
+		t.Fatalf("%s: attributes do not match: %v != %v", name, expected, &attr.Attr)
+	}
+	if name != "" && out.Attr != *expected {
+		t.Fatalf("%s: lookup attributes do not match: %v != %v", name, expected, &out.Attr)
+	}
+
+	x, _ := tfs.ListXAttr(name, fCtx)
+	var list []byte
+	for _, a := range x {
+		list = append(append(list, a...), 0)
+	}
+	buf := make([]byte, 1024)
+	n, status := raw.ListXAttr(nil, &header, buf)
+	if !status.Ok() || !bytes.Equal(buf[:n], list) {
+		t.Fatalf("%s: xattrs do not match: %q != %q (%v)", name, list, buf[:n], status)
+	}
+
+	switch attr.Mode & syscall.S_IFMT {
+	case fuse.S_IFDIR:
+		entries, _ := tfs.OpenDir(name, fCtx)
+		readDirPlus(t, raw, out.NodeId)
+		in := root
+		if name != "" {
+			for _, component := range strings.Split(name, "/") {
+				in = in.GetChild(component)
+			}
+		}
+		for _, e := range entries {
+			if in.GetChild(e.Name) == nil {
+				t.Fatalf("%s: expected %s to be looked up by READDIRPLUS", name, e.Name)
+			}
+			compareNodes(t, raw, root, tfs, path.Join(name, e.Name))
+		}
+	case fuse.S_IFLNK:
+		l1, _ := tfs.Readlink(name, fCtx)
+		l2, _ := raw.Readlink(nil, &header)
+		if l1 != string(l2) {
+			t.Fatalf("%s: link does not match: %s != %s", name, l1, l2)
+		}
+	case fuse.S_IFREG:
+		if !bytes.Equal(readNode(t, raw, out.NodeId, int(attr.Size)), readTestFile(t, tfs, name)) {
+			t.Fatalf("%s: content does not match", name)
+		}
+		var open fuse.OpenOut
+		if status := raw.Open(nil, &fuse.OpenIn{InHeader: header, Flags: uint32(os.O_WRONLY)}, &open); status != fuse.EROFS {
+			t.Fatalf("%s: expected EROFS opening for write, got %v", name, status)
+		}
+	}
+}
+
+func TestNodeFS(t *testing.T) {
+	data := newIndexTestArchive(t)
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, root := newTestNodeFS(t, tfs)
+	compareNodes(t, raw, root, tfs, "")
+
+	link, target := mustLookupNode(t, raw, "hardlink"), mustLookupNode(t, raw, "foo/bar")
+	if link.NodeId != target.NodeId || link.Ino != target.Ino {
+		t.Fatalf("expected hard links to share a node, got %d (%d) and %d (%d)", link.NodeId, link.Ino, target.NodeId, target.Ino)
+	}
+	if _, status := lookupNode(raw, "foo/nope"); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for a missing entry, got %v", status)
+	}
+	if _, status := lookupNode(raw, "foo/bar/baz"); status != fuse.ENOTDIR {
+		t.Fatalf("expected ENOTDIR for an entry in a file, got %v", status)
+	}
+
+	xattr := mustLookupNode(t, raw, "xattr")
+	buf := make([]byte, 16)
+	n, status := raw.GetXAttr(nil, &fuse.InHeader{NodeId: xattr.NodeId}, "user.foo", buf)
+	if !status.Ok() || string(buf[:n]) != "bar" {
+		t.Fatalf("expected xattr value bar, got %q: %v", buf[:n], status)
+	}
+	if _, status := raw.GetXAttr(nil, &fuse.InHeader{NodeId: xattr.NodeId}, "user.nope", buf); status != fuse.ENOATTR {
+		t.Fatalf("expected ENOATTR for a missing xattr, got %v", status)
+	}
+}
+
+func TestNodeFSProgressive(t *testing.T) {
+	data := newIndexTestArchive(t)
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithProgressiveIndexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := newTestNodeFS(t, tfs)
+	out := mustLookupNode(t, raw, "foo/bar")
+	if !bytes.Equal(readNode(t, raw, out.NodeId, 3), testData(3)) {
+		t.Fatal("unexpected content")
+	}
+	<-Ready(tfs)
+	if _, status := lookupNode(raw, "foo/nope"); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for a missing entry, got %v", status)
+	}
+}
+
+func TestNodeFSWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := newIndexTestArchive(t)
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := newTestNodeFS(t, tfs)
+	foo := mustLookupNode(t, raw, "foo")
+
+	// Hard links are copied up one at a time, so they get their own nodes.
+	bar := mustLookupNode(t, raw, "foo/bar")
+	if link := mustLookupNode(t, raw, "hardlink"); link.NodeId == bar.NodeId {
+		t.Fatal("expected hard links to have their own nodes in writable filesystems")
+	}
+
+	// Writing copies the entry to the upper dir, the node stays the same.
+	var open fuse.OpenOut
+	header := fuse.InHeader{NodeId: bar.NodeId}
+	if status := raw.Open(nil, &fuse.OpenIn{InHeader: header, Flags: uint32(os.O_WRONLY)}, &open); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := raw.Write(nil, &fuse.WriteIn{InHeader: header, Fh: open.Fh, Size: 3}, []byte("new")); !status.Ok() {
+		t.Fatal(status)
+	}
+	raw.Release(nil, &fuse.ReleaseIn{InHeader: header, Fh: open.Fh})
+	if again := mustLookupNode(t, raw, "foo/bar"); again.NodeId != bar.NodeId || again.Ino != bar.Ino {
+		t.Fatalf("expected the node to stay the same after copy up, got %d (%d) and %d (%d)", bar.NodeId, bar.Ino, again.NodeId, again.Ino)
+	}
+	if data := readNode(t, raw, bar.NodeId, 3); string(data) != "new" {
+		t.Fatalf("expected new content, got %q", data)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "foo/bar")); err != nil || string(data) != "new" {
+		t.Fatalf("expected new content in the upper dir, got %q: %v", data, err)
+	}
+
+	var created fuse.CreateOut
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: foo.NodeId}, Flags: uint32(os.O_WRONLY), Mode: 0644}
+	if status := raw.Create(nil, in, "new", &created); !status.Ok() {
+		t.Fatal(status)
+	}
+	raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: created.NodeId}, Fh: created.Fh})
+	if again := mustLookupNode(t, raw, "foo/new"); again.NodeId != created.NodeId || again.Ino != created.Ino {
+		t.Fatalf("expected the same node for the created file, got %d (%d) and %d (%d)", created.NodeId, created.Ino, again.NodeId, again.Ino)
+	}
+
+	rename := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: foo.NodeId}, Newdir: fuse.FUSE_ROOT_ID}
+	if status := raw.Rename(nil, rename, "new", "renamed"); !status.Ok() {
+		t.Fatal(status)
+	}
+	if renamed := mustLookupNode(t, raw, "renamed"); renamed.NodeId != created.NodeId {
+		t.Fatalf("expected the renamed file to keep its node, got %d and %d", created.NodeId, renamed.NodeId)
+	}
+	if _, status := lookupNode(raw, "foo/new"); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for the old name, got %v", status)
+	}
+
+	var mkdir fuse.EntryOut
+	if status := raw.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: foo.NodeId}, Mode: 0755}, "dir", &mkdir); !status.Ok() {
+		t.Fatal(status)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "foo/dir")); err != nil || !fi.IsDir() {
+		t.Fatalf("expected directory in the upper dir: %v", err)
+	}
+
+	if status := raw.Unlink(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "hardlink"); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := lookupNode(raw, "hardlink"); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for the removed entry, got %v", status)
+	}
+	entries, _ := tfs.OpenDir("", &fuse.Context{})
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"foo", "null", "renamed", "xattr"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected entries %v, got %v", expected, names)
+	}
+}
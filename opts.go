@@ -0,0 +1,116 @@
+package tarfs
+
+import (
+	"os"
+	"time"
+)
+
+// Opt is used to configure a tarfs server.
+type Opt func(*config)
+
+type config struct {
+	upperDir           string
+	indexFile          string
+	digest             string
+	modTime            time.Time
+	defaultPermissions bool
+	cache              *CacheConfig
+	manifest           Manifest
+	computeDigests     bool
+	progressive        bool
+	// uids and gids map the owner of entries, see idmap.go
+	uids, gids *idMap
+	umask      os.FileMode
+}
+
+func newConfig(opts []Opt) config {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// WithUpperDir makes the server writable.
+// Changes to the filesystem are written to the passed in directory, files from
+// the archive are copied there before they are modified. Files which are not
+// modified keep being read from the archive.
+//
+// Files removed from the archive are tracked as whiteouts in the metadata
+// store, and stored as OCI style `.wh.<name>` files in the upper dir so they
+// stay hidden when the upper dir is used again. Names starting with `.wh.`
+// can not be created in the filesystem.
+//
+// See `Export` for writing the changes back out to a tar archive.
+func WithUpperDir(dir string) Opt {
+	return func(c *config) {
+		c.upperDir = dir
+	}
+}
+
+// WithIndexFile stores the metadata of the archive in the passed in file.
+// If the file holds a valid index for the archive the next time it is
+// used, the index is memory-mapped and used as the metadata store instead of
+// reading the entire archive again, and the metadata store passed to
+// `FromFile` or `FromReaderAt` is not used.
+//
+// The index is tied to the size of the archive, the modification time when
+// the archive is opened with `FromFile`, the digest set with `WithDigest`, and
+// a hash of the start and end of the archive. Indexes which don't match the
+// archive are rebuilt. Without a digest an archive which only differs from the
+// indexed one in the middle is not detected.
+func WithIndexFile(path string) Opt {
+	return func(c *config) {
+		c.indexFile = path
+	}
+}
+
+// WithDigest sets the digest of the archive, e.g. the digest of an OCI layer.
+// This is used to check that an index file belongs to the archive, see
+// `WithIndexFile`.
+func WithDigest(digest string) Opt {
+	return func(c *config) {
+		c.digest = digest
+	}
+}
+
+// WithDefaultPermissions leaves permission checks to the kernel instead of
+// checking them in the server, which is faster and also covers entries
+// cached by the kernel.
+// The filesystem must be mounted with the `default_permissions` mount
+// option, otherwise permissions are not checked at all.
+func WithDefaultPermissions() Opt {
+	return func(c *config) {
+		c.defaultPermissions = true
+	}
+}
+
+// WithOwner reports all entries of the archive as owned by uid and gid,
+// instead of the owner stored in the archive. A negative uid or gid keeps the
+// one from the archive.
+// This squashes all ids to a single one, the same way `WithIDMappings` maps
+// ids, and permissions are checked against the reported owner.
+func WithOwner(uid, gid int) Opt {
+	return func(c *config) {
+		if uid >= 0 {
+			c.uids = squashIDs(uid)
+		}
+		if gid >= 0 {
+			c.gids = squashIDs(gid)
+		}
+	}
+}
+
+// WithUmask clears the permission bits which are set in umask from the mode of
+// all entries of the archive.
+func WithUmask(umask os.FileMode) Opt {
+	return func(c *config) {
+		c.umask = umask.Perm()
+	}
+}
+
+func withModTime(t time.Time) Opt {
+	return func(c *config) {
+		c.modTime = t
+	}
+}
@@ -0,0 +1,682 @@
+package tarfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements the writable mode of the server.
+// Entries in the upper dir always take precedence over entries in the
+// archive. Archive entries are copied to the upper dir before they are
+// changed, and are marked with a whiteout in the metadata store when removed.
+// Whiteouts are also stored in the upper dir as OCI style `.wh.<name>` files,
+// so they are picked up again when the upper dir is re-used.
+
+// whiteout marks an archive entry as removed.
+type whiteout struct {
+	FileInfo
+}
+
+func isWhiteout(fi FileInfo) bool {
+	_, ok := fi.(*whiteout)
+	return ok
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// copyUpPrefix is the prefix of the temporary files the content of
+	// files is copied to, see `prepareCopyUp`.
+	copyUpPrefix = whiteoutPrefix + whiteoutPrefix + ".tmp."
+)
+
+// isReserved returns true for names which are used for whiteouts in the upper
+// dir.
+func isReserved(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), whiteoutPrefix)
+}
+
+func whiteoutName(name string) string {
+	return filepath.Join(parentName(name), whiteoutPrefix+filepath.Base(name))
+}
+
+// loadWhiteouts adds whiteouts for the markers found in the upper dir.
+// A directory in the upper dir which replaces a removed archive directory
+// hides all the entries of the archive directory.
+func (s *server) loadWhiteouts() error {
+	return filepath.Walk(s.upperDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !isReserved(p) {
+			return nil
+		}
+		if strings.HasPrefix(filepath.Base(p), copyUpPrefix) {
+			// left over from an interrupted copy up
+			return os.Remove(p)
+		}
+		rel, err := filepath.Rel(s.upperDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(filepath.Dir(rel), strings.TrimPrefix(filepath.Base(rel), whiteoutPrefix))
+		fi := s.lookup(name)
+		if fi == nil {
+			return nil
+		}
+		if fi.Mode().IsDir() && s.inUpper(name) {
+			for _, e := range s.db.Entries(fuseNameToKey(name)) {
+				s.hide(filepath.Join(name, filepath.Base(e.Name())))
+			}
+		}
+		s.hide(name)
+		return nil
+	})
+}
+
+// lookup gets the archive entry for the passed in name.
+// nil is returned if the entry does not exist or was removed.
+func (s *server) lookup(name string) FileInfo {
+	fi := s.db.Get(fuseNameToKey(name))
+	if fi == nil || isWhiteout(fi) {
+		return nil
+	}
+	return fi
+}
+
+func (s *server) inUpper(name string) bool {
+	if s.upper == nil || isReserved(name) {
+		return false
+	}
+	_, err := os.Lstat(s.upperPath(name))
+	return err == nil
+}
+
+func (s *server) exists(name string) bool {
+	return s.inUpper(name) || s.lookup(name) != nil
+}
+
+func (s *server) upperPath(name string) string {
+	return filepath.Join(s.upperDir, name)
+}
+
+func (s *server) upperAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	attr, status := s.upper.GetAttr(name, context)
+	if attr != nil {
+		// The inode number comes from the filesystem of the upper dir, which
+		// could clash with inode numbers from the archive.
+		attr.Ino = 0
+	}
+	return attr, status
+}
+
+// removeFromArchive hides the archive entry for `name`, if any.
+// The caller must hold s.mu.
+func (s *server) removeFromArchive(name string) {
+	if !s.hide(name) {
+		return
+	}
+	if status := s.copyUpLocked(parentName(name)); !status.Ok() {
+		logrus.WithField("name", name).WithField("status", status).Error("error storing whiteout")
+		return
+	}
+	err := s.addToUpperDir(parentName(name), func() error {
+		f, err := os.OpenFile(s.upperPath(whiteoutName(name)), os.O_WRONLY|os.O_CREATE, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("name", name).Error("error storing whiteout")
+	}
+}
+
+// hide adds a whiteout for the archive entry to the metadata store.
+func (s *server) hide(name string) bool {
+	fi := s.lookup(name)
+	if fi == nil {
+		return false
+	}
+	logrus.WithField("name", name).Debug("adding whiteout")
+	if err := s.db.Add(fuseNameToKey(name), &whiteout{FileInfo: fi}); err != nil {
+		logrus.WithError(err).WithField("name", name).Error("error adding whiteout")
+		return false
+	}
+	return true
+}
+
+// removeWhiteouts removes the whiteout markers from a directory in the upper
+// dir.
+func (s *server) removeWhiteouts(name string) error {
+	d, err := os.Open(s.upperPath(name))
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close() // nolint: errcheck
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if !isReserved(n) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.upperPath(name), n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parentName(name string) string {
+	dir := filepath.Dir(name)
+	if dir == "." || dir == string(os.PathSeparator) {
+		return ""
+	}
+	return dir
+}
+
+func (s *server) copyUp(name string) fuse.Status {
+	data := s.prepareCopyUp(name)
+	defer removeCopyUpData(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copyUpFrom(name, data)
+}
+
+// copyUpLocked copies the archive entry for `name`, and any missing parent
+// directories, to the upper dir.
+// The caller must hold s.mu.
+func (s *server) copyUpLocked(name string) fuse.Status {
+	return s.copyUpFrom(name, "")
+}
+
+// copyUpFrom is `copyUpLocked` with the content of regular files from `data`,
+// as returned by `prepareCopyUp`. The content is copied while holding s.mu if
+// `data` is empty.
+func (s *server) copyUpFrom(name, data string) fuse.Status {
+	if name == "" {
+		return fuse.ToStatus(os.MkdirAll(s.upperDir, 0755))
+	}
+	if isReserved(name) {
+		return fuse.EINVAL
+	}
+	if s.inUpper(name) {
+		return fuse.OK
+	}
+	fi := s.lookup(name)
+	if fi == nil {
+		return fuse.ENOENT
+	}
+	if status := s.copyUpLocked(parentName(name)); !status.Ok() {
+		return status
+	}
+
+	logrus.WithField("name", name).Debug("copy up")
+	p := s.upperPath(name)
+	mode := fi.Mode()
+	err := s.addToUpperDir(parentName(name), func() error {
+		switch {
+		case mode.IsDir():
+			// The mode is set once the directory was copied, the mode
+			// from the archive may not allow writing to it.
+			return os.Mkdir(p, 0700)
+		case mode&os.ModeSymlink != 0:
+			return os.Symlink(fi.Linkname(), p)
+		case mode.IsRegular():
+			if data == "" {
+				tmp, err := s.copyDataTemp(fi)
+				if err != nil {
+					return err
+				}
+				defer removeCopyUpData(tmp)
+				data = tmp
+			}
+			return os.Rename(data, p)
+		case isSpecial(mode):
+			// Creating device nodes needs privileges, without them only
+			// named pipes and sockets can be copied up.
+			major, minor := fi.Device()
+			return unix.Mknod(p, fuseMode(mode), int(unix.Mkdev(major, minor)))
+		default:
+			return syscall.ENOSYS
+		}
+	})
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	// Preserving ownership needs privileges we may not have, and not all
+	// filesystems support all xattrs, so these are best effort.
+	// Files in the upper dir are served as they are, so they get the mapped
+	// ids.
+	owner := fi.Owner()
+	os.Lchown(p, int(s.uids.toHost(owner.UID)), int(s.gids.toHost(owner.GID))) // nolint: errcheck
+	if mode&os.ModeSymlink == 0 {
+		for k, v := range fi.Xattrs() {
+			setXattr(p, k, s.hostXattr(k, v)) // nolint: errcheck
+		}
+		// The special bits are set after the owner, chown(2) clears them.
+		if err := os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return fuse.ToStatus(err)
+		}
+		if err := os.Chtimes(p, fi.AccessTime(), fi.ModTime()); err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	return fuse.OK
+}
+
+// addToUpperDir calls add, which adds an entry to the directory `dir` in the
+// upper dir. Directories are copied up with their mode from the archive,
+// which may not allow their owner to add entries, so the directory is made
+// writable for the owner until the entry was added.
+func (s *server) addToUpperDir(dir string, add func() error) error {
+	p := s.upperPath(dir)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&0300 == 0300 {
+		return add()
+	}
+	if err := os.Chmod(p, fi.Mode()|0300); err != nil {
+		return err
+	}
+	defer os.Chmod(p, fi.Mode()) // nolint: errcheck
+	return add()
+}
+
+// prepareCopyUp copies the content of the archive entry for `name` to a
+// temporary file in the upper dir, if it is a regular file which was not
+// copied up yet. This is done without holding s.mu, so copying large files
+// does not block other changes.
+// An empty name is returned if there is nothing to copy, or if copying failed,
+// in which case `copyUpFrom` tries again and returns the error.
+func (s *server) prepareCopyUp(name string) string {
+	if isReserved(name) || s.inUpper(name) {
+		return ""
+	}
+	fi := s.lookup(name)
+	if fi == nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+	data, err := s.copyDataTemp(fi)
+	if err != nil {
+		return ""
+	}
+	return data
+}
+
+// copyDataTemp copies the content of an archive entry to a new temporary file
+// in the upper dir.
+func (s *server) copyDataTemp(fi FileInfo) (string, error) {
+	if err := os.MkdirAll(s.upperDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(s.upperDir, copyUpPrefix)
+	if err != nil {
+		return "", err
+	}
+	err = s.copyFileData(f, fi)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name()) // nolint: errcheck
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// removeCopyUpData removes a temporary file from `prepareCopyUp` which was not
+// moved into place.
+func removeCopyUpData(data string) {
+	if data != "" {
+		os.Remove(data) // nolint: errcheck
+	}
+}
+
+// copyFileData copies the content of an archive entry to f.
+// Only the data of sparse files is written so the holes are kept.
+func (s *server) copyFileData(f *os.File, fi FileInfo) error {
+	if err := s.verifyFile(fi); err != nil {
+		return err
+	}
+	n := asNode(fi)
+	if n == nil || n.stat == nil || n.stat.Sparse == nil {
+		_, err := io.Copy(f, s.data(fi))
+		return err
+	}
+
+	r := s.data(fi)
+	for _, e := range n.stat.Sparse {
+		if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, io.NewSectionReader(r, e.Offset, e.Length)); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(fi.Size())
+}
+
+func (s *server) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	logrus.WithField("name", name).Debug("Create")
+	if s.upper == nil {
+		return s.FileSystem.Create(name, flags, mode, context)
+	}
+
+	if isReserved(name) {
+		return nil, fuse.EINVAL
+	}
+	data := s.prepareCopyUp(name)
+	defer removeCopyUpData(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkCreate(name, context); !status.Ok() {
+		return nil, status
+	}
+	if status := s.copyUpLocked(parentName(name)); !status.Ok() {
+		return nil, status
+	}
+	if !s.inUpper(name) && s.lookup(name) != nil {
+		if status := s.copyUpFrom(name, data); !status.Ok() {
+			return nil, status
+		}
+	}
+	return s.upper.Create(name, flags, mode, context)
+}
+
+func (s *server) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Mkdir")
+	if s.upper == nil {
+		return s.FileSystem.Mkdir(name, mode, context)
+	}
+
+	if isReserved(name) {
+		return fuse.EINVAL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkCreate(name, context); !status.Ok() {
+		return status
+	}
+	if s.exists(name) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := s.copyUpLocked(parentName(name)); !status.Ok() {
+		return status
+	}
+	return s.upper.Mkdir(name, mode, context)
+}
+
+func (s *server) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Mknod")
+	if s.upper == nil {
+		return s.FileSystem.Mknod(name, mode, dev, context)
+	}
+
+	if isReserved(name) {
+		return fuse.EINVAL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkCreate(name, context); !status.Ok() {
+		return status
+	}
+	if s.exists(name) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := s.copyUpLocked(parentName(name)); !status.Ok() {
+		return status
+	}
+	return s.upper.Mknod(name, mode, dev, context)
+}
+
+func (s *server) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", linkName).Debug("Symlink")
+	if s.upper == nil {
+		return s.FileSystem.Symlink(value, linkName, context)
+	}
+
+	if isReserved(linkName) {
+		return fuse.EINVAL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkCreate(linkName, context); !status.Ok() {
+		return status
+	}
+	if s.exists(linkName) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := s.copyUpLocked(parentName(linkName)); !status.Ok() {
+		return status
+	}
+	return s.upper.Symlink(value, linkName, context)
+}
+
+func (s *server) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", newName).WithField("target", oldName).Debug("Link")
+	if s.upper == nil {
+		return s.FileSystem.Link(oldName, newName, context)
+	}
+
+	if isReserved(newName) {
+		return fuse.EINVAL
+	}
+	data := s.prepareCopyUp(oldName)
+	defer removeCopyUpData(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, status := s.checkAccess(oldName, 0, context); !status.Ok() {
+		return status
+	}
+	if status := s.checkCreate(newName, context); !status.Ok() {
+		return status
+	}
+	if s.exists(newName) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := s.copyUpFrom(oldName, data); !status.Ok() {
+		return status
+	}
+	if status := s.copyUpLocked(parentName(newName)); !status.Ok() {
+		return status
+	}
+	return s.upper.Link(oldName, newName, context)
+}
+
+func (s *server) Unlink(name string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Unlink")
+	if s.upper == nil {
+		return s.FileSystem.Unlink(name, context)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkRemove(name, context); !status.Ok() {
+		return status
+	}
+	fi := s.lookup(name)
+	if s.inUpper(name) {
+		if status := s.upper.Unlink(name, context); !status.Ok() {
+			return status
+		}
+	} else if fi == nil {
+		return fuse.ENOENT
+	} else if fi.Mode().IsDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	s.removeFromArchive(name)
+	return fuse.OK
+}
+
+func (s *server) Rmdir(name string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Rmdir")
+	if s.upper == nil {
+		return s.FileSystem.Rmdir(name, context)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkRemove(name, context); !status.Ok() {
+		return status
+	}
+	entries, status := s.readDir(name, context)
+	if !status.Ok() {
+		return status
+	}
+	if len(entries) != 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if s.inUpper(name) {
+		if err := s.removeWhiteouts(name); err != nil {
+			return fuse.ToStatus(err)
+		}
+		if status := s.upper.Rmdir(name, context); !status.Ok() {
+			return status
+		}
+	}
+	s.removeFromArchive(name)
+	return fuse.OK
+}
+
+func (s *server) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", oldName).WithField("new", newName).Debug("Rename")
+	if s.upper == nil {
+		return s.FileSystem.Rename(oldName, newName, context)
+	}
+
+	if isReserved(newName) {
+		return fuse.EINVAL
+	}
+	data := s.prepareCopyUp(oldName)
+	defer removeCopyUpData(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.checkRemove(oldName, context); !status.Ok() {
+		return status
+	}
+	if s.exists(newName) {
+		if status := s.checkRemove(newName, context); !status.Ok() {
+			return status
+		}
+	} else if status := s.checkCreate(newName, context); !status.Ok() {
+		return status
+	}
+	// Like overlayfs without redirects, renaming directories from the archive
+	// is not supported. Callers such as mv(1) fall back to copying.
+	for _, name := range []string{oldName, newName} {
+		if fi := s.lookup(name); fi != nil && fi.Mode().IsDir() {
+			return fuse.Status(syscall.EXDEV)
+		}
+	}
+	if status := s.copyUpFrom(oldName, data); !status.Ok() {
+		return status
+	}
+	if status := s.copyUpLocked(parentName(newName)); !status.Ok() {
+		return status
+	}
+	if status := s.upper.Rename(oldName, newName, context); !status.Ok() {
+		return status
+	}
+	s.removeFromArchive(oldName)
+	return fuse.OK
+}
+
+func (s *server) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Truncate")
+	if s.upper == nil {
+		return s.FileSystem.Truncate(name, size, context)
+	}
+	if _, status := s.checkAccess(name, accessWrite, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.Truncate(name, size, context)
+}
+
+func (s *server) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Chmod")
+	if s.upper == nil {
+		return s.FileSystem.Chmod(name, mode, context)
+	}
+	if status := s.checkOwner(name, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.Chmod(name, mode, context)
+}
+
+func (s *server) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Chown")
+	if s.upper == nil {
+		return s.FileSystem.Chown(name, uid, gid, context)
+	}
+	if status := s.checkChown(name, uid, gid, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.Chown(name, uid, gid, context)
+}
+
+func (s *server) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Utimens")
+	if s.upper == nil {
+		return s.FileSystem.Utimens(name, atime, mtime, context)
+	}
+	if status := s.checkUtimens(name, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.Utimens(name, atime, mtime, context)
+}
+
+func (s *server) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).WithField("attr", attr).Debug("SetXAttr")
+	if s.upper == nil {
+		return s.FileSystem.SetXAttr(name, attr, data, flags, context)
+	}
+	if _, status := s.checkAccess(name, accessWrite, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.SetXAttr(name, attr, data, flags, context)
+}
+
+func (s *server) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).WithField("attr", attr).Debug("RemoveXAttr")
+	if s.upper == nil {
+		return s.FileSystem.RemoveXAttr(name, attr, context)
+	}
+	if _, status := s.checkAccess(name, accessWrite, context); !status.Ok() {
+		return status
+	}
+	if status := s.copyUp(name); !status.Ok() {
+		return status
+	}
+	return s.upper.RemoveXAttr(name, attr, context)
+}
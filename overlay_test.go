@@ -0,0 +1,275 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+func newOverlayTestFS(t *testing.T) (pathfs.FileSystem, string) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+		data []byte
+	}{
+		{"foo", os.ModeDir | 0755, nil},
+		{"foo/bar", 0644, []byte("bar")},
+		{"foo/baz", 0644, []byte("baz")},
+		{"quux", os.ModeDir | 0755, nil},
+		{"quux/hello", 0644, []byte("hello")},
+	} {
+		if err := w.WriteHeader(newTestHeader(f.name, f.mode, int64(len(f.data)), time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return fs, dir
+}
+
+func readTestFile(t *testing.T, fs pathfs.FileSystem, name string) []byte {
+	attr, status := fs.GetAttr(name, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	f, status := fs.Open(name, uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	defer f.Release()
+
+	buf := make([]byte, attr.Size)
+	rr, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	defer rr.Done()
+	data, _ := rr.Bytes(buf)
+	return data
+}
+
+func dirNames(t *testing.T, fs pathfs.FileSystem, name string) string {
+	entries, status := fs.OpenDir(name, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatalf("%s: %v", name, status)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestOverlayWrite(t *testing.T) {
+	fs, dir := newOverlayTestFS(t)
+	defer os.RemoveAll(dir)
+	fCtx := &fuse.Context{}
+
+	// modify a file from the archive
+	f, status := fs.Open("foo/bar", uint32(os.O_WRONLY), fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := f.Write([]byte("BAR!"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+
+	if data := readTestFile(t, fs, "foo/bar"); string(data) != "BAR!" {
+		t.Fatalf("expected modified content, got %q", data)
+	}
+	if data := readTestFile(t, fs, "foo/baz"); string(data) != "baz" {
+		t.Fatalf("expected original content, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo/baz")); !os.IsNotExist(err) {
+		t.Fatalf("unmodified file should not be copied up: %v", err)
+	}
+
+	// new files
+	f, status = fs.Create("foo/new", uint32(os.O_WRONLY), 0644, fCtx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("new"), 0)
+	f.Release()
+	if status := fs.Mkdir("newdir", 0755, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Mkdir("foo", 0755, fCtx); status != fuse.Status(syscall.EEXIST) {
+		t.Fatalf("expected EEXIST, got %v", status)
+	}
+	if names := dirNames(t, fs, "foo"); names != "bar,baz,new" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	if names := dirNames(t, fs, ""); names != "foo,newdir,quux" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+
+	if status := fs.Truncate("quux/hello", 2, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if data := readTestFile(t, fs, "quux/hello"); string(data) != "he" {
+		t.Fatalf("expected truncated content, got %q", data)
+	}
+
+	if status := fs.Rename("foo/baz", "newdir/baz", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if data := readTestFile(t, fs, "newdir/baz"); string(data) != "baz" {
+		t.Fatalf("expected renamed content, got %q", data)
+	}
+	if _, status := fs.GetAttr("foo/baz", fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT for renamed file, got %v", status)
+	}
+	if status := fs.Rename("quux", "quux2", fCtx); status != fuse.Status(syscall.EXDEV) {
+		t.Fatalf("expected EXDEV when renaming archive dir, got %v", status)
+	}
+}
+
+func TestOverlayRemove(t *testing.T) {
+	fs, dir := newOverlayTestFS(t)
+	defer os.RemoveAll(dir)
+	fCtx := &fuse.Context{}
+
+	if status := fs.Rmdir("quux", fCtx); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Fatalf("expected ENOTEMPTY, got %v", status)
+	}
+	if status := fs.Unlink("quux", fCtx); status != fuse.Status(syscall.EISDIR) {
+		t.Fatalf("expected EISDIR, got %v", status)
+	}
+	if status := fs.Unlink("quux/hello", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("quux/hello", fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", status)
+	}
+	if _, status := fs.GetAttr("quux/hello", fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", status)
+	}
+	if _, status := fs.Open("quux/hello", uint32(os.O_RDONLY), fCtx); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", status)
+	}
+	if status := fs.Rmdir("quux", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if names := dirNames(t, fs, ""); names != "foo" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+
+	// Recreating a removed directory must not bring back its old content.
+	if status := fs.Mkdir("quux", 0755, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if names := dirNames(t, fs, "quux"); names != "" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+
+	// A file that was copied up and then removed.
+	if status := fs.Chmod("foo/bar", 0600, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("foo/bar", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if names := dirNames(t, fs, "foo"); names != "baz" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	if err := w.WriteHeader(newTestHeader("foo", 0644, 0, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	rdr := bytes.NewReader(buf.Bytes())
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fCtx := &fuse.Context{}
+	if status := fs.Unlink("foo", fCtx); status.Ok() {
+		t.Fatal("expected unlink to fail on a read-only server")
+	}
+	if _, status := fs.Open("foo", uint32(os.O_RDWR), fCtx); status.Ok() {
+		t.Fatal("expected open for writing to fail on a read-only server")
+	}
+	if _, status := fs.GetAttr("foo", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+}
+
+func TestOverlayReadonlyDir(t *testing.T) {
+	data := testArchive(t, []testEntry{
+		{"ro", os.ModeDir | 0555, "", nil},
+		{"ro/a", 0644, "a", nil},
+		{"ro/b", 0644, "b", nil},
+	})
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rdr := bytes.NewReader(data)
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fCtx := &fuse.Context{}
+
+	if status := fs.Truncate("ro/a", 0, fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("ro/b", fCtx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if names := dirNames(t, fs, "ro"); names != "a" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "ro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0555 {
+		t.Fatalf("expected the mode from the archive, got %v", fi.Mode())
+	}
+
+	// The content is copied to a temporary file, which is moved into place.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries in the upper dir: %v", entries)
+	}
+}
@@ -0,0 +1,290 @@
+package tarfs
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements the permission checks of the server.
+// Permissions are checked like the kernel does it for local filesystems,
+// unless they are left to the kernel, see `WithDefaultPermissions`.
+
+// Access bits, as used by access(2).
+const (
+	accessExec  = 1
+	accessWrite = 2
+	accessRead  = 4
+)
+
+// accessAllowed checks if the caller has the requested access, a mask of the
+// access bits, to a file with the passed in attributes.
+// Like with CAP_DAC_OVERRIDE root can read and write everything, and execute
+// directories and files which have any execute bit set.
+func accessAllowed(attr *fuse.Attr, context *fuse.Context, mask uint32) bool {
+	if context.Uid == 0 {
+		return mask&accessExec == 0 || attr.Mode&syscall.S_IFMT == syscall.S_IFDIR || attr.Mode&0111 != 0
+	}
+
+	var perm uint32
+	switch {
+	case attr.Uid == context.Uid:
+		perm = attr.Mode >> 6
+	case attr.Mode>>3&mask == attr.Mode&mask:
+		// group and other have the same access, no need to look up the
+		// groups of the caller
+		perm = attr.Mode
+	case inGroup(attr.Gid, context):
+		perm = attr.Mode >> 3
+	default:
+		perm = attr.Mode
+	}
+	return perm&mask == mask
+}
+
+// isOwner checks if the caller owns a file, or is root.
+func isOwner(attr *fuse.Attr, context *fuse.Context) bool {
+	return context.Uid == 0 || attr.Uid == context.Uid
+}
+
+func inGroup(gid uint32, context *fuse.Context) bool {
+	if gid == context.Gid {
+		return true
+	}
+	for _, g := range groups.get(context.Pid) {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// groupCacheTTL is how long the groups of a process are cached. A
+	// process changing its groups takes up to this long to be noticed.
+	groupCacheTTL = time.Second
+	// maxCachedGroups is the number of processes groups are cached for.
+	maxCachedGroups = 1024
+)
+
+// groups caches the supplementary groups of the processes calling the
+// filesystem, so they are not read from /proc for every permission check.
+var groups = &groupCache{entries: make(map[uint32]cachedGroups)}
+
+type groupCache struct {
+	mu      sync.Mutex
+	entries map[uint32]cachedGroups
+}
+
+type cachedGroups struct {
+	groups  []uint32
+	expires time.Time
+}
+
+func (c *groupCache) get(pid uint32) []uint32 {
+	if pid == 0 {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[pid]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.groups
+	}
+
+	e = cachedGroups{groups: supplementaryGroups(pid), expires: now.Add(groupCacheTTL)}
+	c.mu.Lock()
+	if len(c.entries) >= maxCachedGroups {
+		for p, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, p)
+			}
+		}
+		if len(c.entries) >= maxCachedGroups {
+			c.entries = make(map[uint32]cachedGroups)
+		}
+	}
+	c.entries[pid] = e
+	c.mu.Unlock()
+	return e.groups
+}
+
+// supplementaryGroups returns the supplementary groups of a process.
+// The groups are read from /proc, on systems without it no groups are
+// returned.
+func supplementaryGroups(pid uint32) []uint32 {
+	if pid == 0 {
+		return nil
+	}
+	f, err := os.Open("/proc/" + strconv.FormatUint(uint64(pid), 10) + "/status")
+	if err != nil {
+		return nil
+	}
+	defer f.Close() // nolint: errcheck
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// attr returns the attributes of an entry, without checking permissions.
+func (s *server) attr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if s.inUpper(name) {
+		return s.upperAttr(name, context)
+	}
+	fi := s.lookup(name)
+	if fi == nil {
+		return nil, fuse.ENOENT
+	}
+	return s.fileAttr(fi), fuse.OK
+}
+
+// checkAccess checks if the caller may search the directory holding `name`,
+// and has the requested access to `name` itself.
+// The attributes of `name` are returned if it exists.
+//
+// Only the parent directory is checked: the kernel resolves paths one
+// component at a time, and the lookup of each component checks the directory
+// it is looked up in, so the directories above were checked by the lookups
+// leading to `name`. Callers using the server directly with paths need to do
+// the same.
+func (s *server) checkAccess(name string, mask uint32, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if !s.defaultPermissions && name != "" {
+		dir, status := s.attr(parentName(name), context)
+		if !status.Ok() {
+			return nil, status
+		}
+		if dir.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return nil, fuse.ENOTDIR
+		}
+		if !accessAllowed(dir, context, accessExec) {
+			return nil, fuse.EACCES
+		}
+	}
+
+	attr, status := s.attr(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !s.defaultPermissions && !accessAllowed(attr, context, mask) {
+		return nil, fuse.EACCES
+	}
+	return attr, fuse.OK
+}
+
+// checkRemove checks if the caller may remove `name` from its parent
+// directory, which needs write access to the directory. In directories with
+// the sticky bit set only the owner of the entry or the directory may remove
+// it.
+func (s *server) checkRemove(name string, context *fuse.Context) fuse.Status {
+	if s.defaultPermissions {
+		return fuse.OK
+	}
+	dir, status := s.checkAccess(parentName(name), accessWrite|accessExec, context)
+	if !status.Ok() {
+		return status
+	}
+	attr, status := s.attr(name, context)
+	if !status.Ok() {
+		return status
+	}
+	if dir.Mode&syscall.S_ISVTX != 0 && !isOwner(attr, context) && !isOwner(dir, context) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// checkCreate checks if the caller may create `name` in its parent directory.
+func (s *server) checkCreate(name string, context *fuse.Context) fuse.Status {
+	_, status := s.checkAccess(parentName(name), accessWrite|accessExec, context)
+	return status
+}
+
+// checkOwner checks if the caller may change the mode of `name`, which only
+// its owner may do.
+func (s *server) checkOwner(name string, context *fuse.Context) fuse.Status {
+	attr, status := s.checkAccess(name, 0, context)
+	if !status.Ok() {
+		return status
+	}
+	if !s.defaultPermissions && !isOwner(attr, context) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkChown checks if the caller may change the owner of `name`.
+// Only root may change the owning user, the owner may change the group to one
+// of its own groups. An id of -1 leaves it unchanged, like with chown(2).
+func (s *server) checkChown(name string, uid, gid uint32, context *fuse.Context) fuse.Status {
+	attr, status := s.checkAccess(name, 0, context)
+	if !status.Ok() || s.defaultPermissions || context.Uid == 0 {
+		return status
+	}
+	if attr.Uid != context.Uid || (uid != ^uint32(0) && uid != attr.Uid) {
+		return fuse.EPERM
+	}
+	if gid != ^uint32(0) && gid != attr.Gid && !inGroup(gid, context) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkUtimens checks if the caller may change the timestamps of `name`,
+// which needs write access or ownership of the file.
+func (s *server) checkUtimens(name string, context *fuse.Context) fuse.Status {
+	attr, status := s.checkAccess(name, 0, context)
+	if !status.Ok() || s.defaultPermissions || isOwner(attr, context) {
+		return status
+	}
+	if !accessAllowed(attr, context, accessWrite) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// openMask returns the access needed to open a file with the passed in flags.
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch int(flags) & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = accessRead
+	case syscall.O_WRONLY:
+		mask = accessWrite
+	default:
+		mask = accessRead | accessWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= accessWrite
+	}
+	return mask
+}
+
+func (s *server) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	logrus.WithField("name", name).Debug("Access")
+	if mode&accessWrite != 0 && s.upper == nil {
+		return fuse.EROFS
+	}
+	_, status := s.checkAccess(name, mode&(accessRead|accessWrite|accessExec), context)
+	return status
+}
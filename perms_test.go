@@ -0,0 +1,284 @@
+package tarfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+func newPermsTestFS(t *testing.T, opts ...Opt) pathfs.FileSystem {
+	data := testArchive(t, []testEntry{
+		{"open", os.ModeDir | 0755, "", nil},
+		{"open/private", 0600, "private", nil},
+		{"open/group", 0640, "group", nil},
+		{"open/public", 0644, "public", nil},
+		{"open/script", 0750, "script", nil},
+		{"closed", os.ModeDir | 0750, "", nil},
+		{"closed/file", 0644, "file", nil},
+		{"noread", os.ModeDir | 0711, "", nil},
+		{"noread/file", 0644, "file", nil},
+		{"sticky", os.ModeDir | os.ModeSticky | 0777, "", nil},
+		{"sticky/file", 0666, "file", nil},
+	})
+	rdr := bytes.NewReader(data)
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// All entries of the test archive are owned by root.
+var (
+	rootContext  = &fuse.Context{}
+	groupContext = &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 0}}}
+	otherContext = &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}}
+)
+
+func TestPermissions(t *testing.T) {
+	fs := newPermsTestFS(t)
+
+	for _, tc := range []struct {
+		name    string
+		context *fuse.Context
+		flags   int
+		status  fuse.Status
+	}{
+		{"open/public", otherContext, os.O_RDONLY, fuse.OK},
+		{"open/private", otherContext, os.O_RDONLY, fuse.EACCES},
+		{"open/private", groupContext, os.O_RDONLY, fuse.EACCES},
+		{"open/private", rootContext, os.O_RDONLY, fuse.OK},
+		{"open/group", groupContext, os.O_RDONLY, fuse.OK},
+		{"open/group", otherContext, os.O_RDONLY, fuse.EACCES},
+		{"closed/file", groupContext, os.O_RDONLY, fuse.OK},
+		{"closed/file", otherContext, os.O_RDONLY, fuse.EACCES},
+		{"noread/file", otherContext, os.O_RDONLY, fuse.OK},
+		{"open/public", rootContext, os.O_WRONLY, fuse.EROFS},
+	} {
+		f, status := fs.Open(tc.name, uint32(tc.flags), tc.context)
+		if status != tc.status {
+			t.Fatalf("%s (uid %d, gid %d): expected %v, got %v", tc.name, tc.context.Uid, tc.context.Gid, tc.status, status)
+		}
+		if f != nil {
+			f.Release()
+		}
+	}
+
+	if _, status := fs.GetAttr("closed/file", otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES for stat without search permission, got %v", status)
+	}
+	if _, status := fs.GetAttr("closed/file", groupContext); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := fs.OpenDir("noread", otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES for listing a directory without read permission, got %v", status)
+	}
+	if _, status := fs.OpenDir("noread", rootContext); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		mode    uint32
+		context *fuse.Context
+		status  fuse.Status
+	}{
+		{"open/public", accessRead, otherContext, fuse.OK},
+		{"open/public", accessExec, otherContext, fuse.EACCES},
+		{"open/public", accessExec, rootContext, fuse.EACCES},
+		{"open/script", accessExec, rootContext, fuse.OK},
+		{"open/script", accessRead | accessExec, groupContext, fuse.OK},
+		{"open/script", accessRead, otherContext, fuse.EACCES},
+		{"open/public", accessWrite, rootContext, fuse.EROFS},
+		{"closed", accessExec, groupContext, fuse.OK},
+		{"closed", accessExec, otherContext, fuse.EACCES},
+		{"nope", accessRead, rootContext, fuse.ENOENT},
+	} {
+		if status := fs.Access(tc.name, tc.mode, tc.context); status != tc.status {
+			t.Fatalf("%s (mode %d, uid %d): expected %v, got %v", tc.name, tc.mode, tc.context.Uid, tc.status, status)
+		}
+	}
+}
+
+func TestPermissionsWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the root directory is served from the upper dir
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := newPermsTestFS(t, WithUpperDir(dir))
+
+	if _, status := fs.Open("open/public", uint32(os.O_WRONLY), otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	if _, status := fs.Create("open/new", uint32(os.O_WRONLY), 0644, otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	if status := fs.Unlink("open/public", otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	if status := fs.Chmod("open/public", 0777, otherContext); status != fuse.EPERM {
+		t.Fatalf("expected EPERM, got %v", status)
+	}
+	if status := fs.Chown("open/public", 1000, 1000, otherContext); status != fuse.EPERM {
+		t.Fatalf("expected EPERM, got %v", status)
+	}
+	if status := fs.Truncate("open/public", 0, otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+
+	if status := fs.Mkdir("open/dir", 0755, otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	if status := fs.Mkdir("open/dir", 0755, rootContext); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("open/public", rootContext); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	// anyone may create files in the sticky directory, but only remove their
+	// own
+	if status := fs.Unlink("sticky/file", otherContext); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	if status := fs.Mkdir("sticky/dir", 0755, otherContext); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("sticky/file", rootContext); !status.Ok() {
+		t.Fatal(status)
+	}
+}
+
+func TestDefaultPermissions(t *testing.T) {
+	fs := newPermsTestFS(t, WithDefaultPermissions())
+	f, status := fs.Open("closed/file", uint32(os.O_RDONLY), otherContext)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status := fs.Access("open/private", accessRead, otherContext); !status.Ok() {
+		t.Fatal(status)
+	}
+}
+
+func TestNodePermissions(t *testing.T) {
+	fs := newPermsTestFS(t)
+	raw, _ := newTestNodeFS(t, fs)
+	header := func(name string, ctx *fuse.Context) fuse.InHeader {
+		return fuse.InHeader{NodeId: mustLookupNode(t, raw, name).NodeId, Caller: ctx.Caller}
+	}
+
+	var out fuse.EntryOut
+	closed := header("closed", otherContext)
+	if status := raw.Lookup(nil, &closed, "file", &out); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	closed = header("closed", groupContext)
+	if status := raw.Lookup(nil, &closed, "file", &out); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	var open fuse.OpenOut
+	if status := raw.Open(nil, &fuse.OpenIn{InHeader: header("open/private", otherContext), Flags: uint32(os.O_RDONLY)}, &open); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+	for _, tc := range []struct {
+		context *fuse.Context
+		mask    uint32
+		status  fuse.Status
+	}{
+		{otherContext, accessRead, fuse.EACCES},
+		{rootContext, accessRead, fuse.OK},
+		{rootContext, accessWrite, fuse.EROFS},
+	} {
+		if status := raw.Access(nil, &fuse.AccessIn{InHeader: header("open/private", tc.context), Mask: tc.mask}); status != tc.status {
+			t.Fatalf("access %d (uid %d): expected %v, got %v", tc.mask, tc.context.Uid, tc.status, status)
+		}
+	}
+	if status := raw.OpenDir(nil, &fuse.OpenIn{InHeader: header("noread", otherContext)}, &open); status != fuse.EACCES {
+		t.Fatalf("expected EACCES, got %v", status)
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("no /proc")
+	}
+	expected, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []int
+	for _, g := range supplementaryGroups(uint32(os.Getpid())) {
+		groups = append(groups, int(g))
+	}
+	sort.Ints(expected)
+	sort.Ints(groups)
+	if len(expected) != 0 || len(groups) != 0 {
+		if !reflect.DeepEqual(groups, expected) {
+			t.Fatalf("expected groups %v, got %v", expected, groups)
+		}
+	}
+}
+
+func TestOwnerAndUmask(t *testing.T) {
+	fs := newPermsTestFS(t, WithOwner(1000, -1), WithUmask(0027))
+
+	attr, status := fs.GetAttr("open/public", rootContext)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if attr.Uid != 1000 || attr.Gid != 0 || attr.Mode != fuse.S_IFREG|0640 {
+		t.Fatalf("expected 1000:0 and mode 0640, got %d:%d and %o", attr.Uid, attr.Gid, attr.Mode)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		context *fuse.Context
+		status  fuse.Status
+	}{
+		// the owner from the archive is replaced
+		{"open/private", otherContext, fuse.OK},
+		// the umask removes access for others
+		{"open/public", &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 2000, Gid: 2000}}}, fuse.EACCES},
+		{"open/group", groupContext, fuse.OK},
+	} {
+		if _, status := fs.Open(tc.name, uint32(os.O_RDONLY), tc.context); status != tc.status {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.status, status)
+		}
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	pid := uint32(os.Getpid())
+	c := &groupCache{entries: make(map[uint32]cachedGroups)}
+	c.entries[pid] = cachedGroups{groups: []uint32{4242}, expires: time.Now().Add(time.Minute)}
+	if groups := c.get(pid); !reflect.DeepEqual(groups, []uint32{4242}) {
+		t.Fatalf("expected cached groups, got %v", groups)
+	}
+
+	c.entries[pid] = cachedGroups{groups: []uint32{4242}, expires: time.Now().Add(-time.Second)}
+	if groups := c.get(pid); !reflect.DeepEqual(groups, supplementaryGroups(pid)) {
+		t.Fatalf("expected groups to be read again, got %v", groups)
+	}
+
+	for i := 0; i < maxCachedGroups; i++ {
+		c.entries[pid+uint32(i)+1] = cachedGroups{expires: time.Now().Add(time.Minute)}
+	}
+	c.get(pid + maxCachedGroups + 1)
+	if len(c.entries) > maxCachedGroups {
+		t.Fatalf("expected at most %d cached entries, got %d", maxCachedGroups, len(c.entries))
+	}
+}
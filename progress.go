@@ -0,0 +1,267 @@
+package tarfs
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements serving an archive while it is still being indexed,
+// see `WithProgressiveIndexing`.
+
+// errUnmounted stops indexing an archive once its filesystem is unmounted.
+var errUnmounted = errors.New("filesystem was unmounted")
+
+// WithProgressiveIndexing makes `FromReaderAt` return right away and index
+// the archive in the background, so large archives can be mounted without
+// waiting for the entire archive to be read.
+//
+// Looking up an entry which was not indexed yet blocks until it is found, or
+// until the archive was indexed, in which case it does not exist. Listing a
+// directory blocks until the archive was indexed, as entries may be found
+// anywhere in the archive. See `Ready` and `WaitIndexed` for waiting until the
+// archive was indexed.
+//
+// Writable filesystems (see `WithUpperDir`), and archives for which digests
+// are computed (see `WithComputedDigests`), are always indexed before the
+// server is returned.
+func WithProgressiveIndexing() Opt {
+	return func(c *config) {
+		c.progressive = true
+	}
+}
+
+// Ready returns a channel which is closed once the archive served by fs was
+// indexed, see `WithProgressiveIndexing`. For filesystems which were indexed
+// before they were returned the channel is closed already.
+func Ready(fs pathfs.FileSystem) <-chan struct{} {
+	if ps := progressOf(fs); ps != nil {
+		return ps.ready
+	}
+	ready := make(chan struct{})
+	close(ready)
+	return ready
+}
+
+// WaitIndexed waits until the archive served by fs was indexed, and returns
+// the error indexing the archive failed with. Entries which were found before
+// the error keep being served.
+func WaitIndexed(fs pathfs.FileSystem) error {
+	ps := progressOf(fs)
+	if ps == nil {
+		return nil
+	}
+	<-ps.ready
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.err
+}
+
+func progressOf(fs pathfs.FileSystem) *progressStore {
+	if s, ok := fs.(*server); ok {
+		if ps, ok := s.db.(*progressStore); ok {
+			return ps
+		}
+	}
+	return nil
+}
+
+// indexProgressively creates a server for an archive which is indexed in the
+// background.
+func indexProgressively(ra io.ReaderAt, size int64, format compression, db MetadataStore, key indexKey, cfg config, opts []Opt) (pathfs.FileSystem, error) {
+	ps := newProgressStore(db)
+	a, index, err := openArchive(ra, size, format, ps, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := newServer(ps, []layerStream{{ReaderAt: a.stream, toc: a.toc}}, opts...)
+	if index == nil {
+		ps.done(nil)
+		return s, nil
+	}
+
+	go func() {
+		err := index()
+		switch {
+		case errors.Cause(err) == errUnmounted:
+			logrus.Debug("stopped indexing archive")
+		case err != nil:
+			logrus.WithError(err).Error("error indexing archive")
+		default:
+			logrus.Debug("archive indexed")
+		}
+		if err == nil && cfg.indexFile != "" {
+			if err := writeIndexFile(cfg.indexFile, db, key, a.checkpoints); err != nil {
+				logrus.WithError(err).WithField("index", cfg.indexFile).Warn("error writing index file")
+			}
+		}
+		ps.done(err)
+	}()
+	return s, nil
+}
+
+// progressStore is the metadata store of an archive which is served while it
+// is indexed. The indexer adds entries to the underlying store while holding
+// the lock, lookups wait for entries which were not found yet.
+type progressStore struct {
+	MetadataStore
+
+	mu   sync.RWMutex
+	cond *sync.Cond
+	// x is the indexer which adds entries to the store
+	x       *tarIndexer
+	indexed bool
+	closed  bool
+	err     error
+	ready   chan struct{}
+
+	// walkedUsage is the usage of stores which don't implement UsageCounter
+	usageOnce   sync.Once
+	walkedUsage Usage
+}
+
+func newProgressStore(db MetadataStore) *progressStore {
+	s := &progressStore{MetadataStore: db, ready: make(chan struct{})}
+	s.cond = sync.NewCond(s.mu.RLocker())
+	return s
+}
+
+// lock is called by the indexer before it changes any entries.
+func (s *progressStore) lock() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errUnmounted
+	}
+	return nil
+}
+
+// unlock wakes up lookups waiting for new entries.
+func (s *progressStore) unlock() {
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// done marks the archive as indexed.
+func (s *progressStore) done(err error) {
+	s.mu.Lock()
+	s.indexed, s.err = true, err
+	s.mu.Unlock()
+	close(s.ready)
+	s.cond.Broadcast()
+}
+
+// visible returns whether an entry was indexed. Directories which were only
+// seen as the parent of other entries, and hard links to entries which were
+// not found yet, were not.
+func (s *progressStore) visible(key string, fi FileInfo) bool {
+	if fi == nil {
+		return false
+	}
+	if n := asNode(fi); n != nil && n.stat == nil {
+		return false
+	}
+	return s.x == nil || !s.x.links.isPending(key)
+}
+
+// Get waits until the entry for key was indexed, or until the archive was
+// indexed. Until then a copy of the entry is returned, as link counts change
+// while the archive is indexed. Directories have a link count of 1 until
+// then, which tools such as find take as an unknown number of
+// subdirectories.
+func (s *progressStore) Get(key string) FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for {
+		fi := s.MetadataStore.Get(key)
+		if s.visible(key, fi) {
+			if s.indexed {
+				return fi
+			}
+			return snapshot(fi)
+		}
+		if s.indexed {
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *progressStore) Add(key string, fi FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MetadataStore.Add(key, fi)
+}
+
+// Entries waits until the archive was indexed. If indexing failed entries
+// which were not indexed completely are left out.
+func (s *progressStore) Entries(key string) []FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for !s.indexed {
+		s.cond.Wait()
+	}
+	entries := s.MetadataStore.Entries(key)
+	if s.err == nil {
+		return entries
+	}
+	visible := make([]FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if s.visible(filepath.Join(key, filepath.Base(e.Name())), e) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// Usage returns the usage of the entries which were indexed so far. Stores
+// which don't keep track of it are walked once the archive was indexed.
+func (s *progressStore) Usage() Usage {
+	if c, ok := s.MetadataStore.(UsageCounter); ok {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return c.Usage()
+	}
+	<-s.ready
+	s.usageOnce.Do(func() {
+		var keys []string
+		storeKeys(s, "/", &keys)
+		for _, k := range keys {
+			s.walkedUsage.add(entryUsage(s.Get(k)))
+		}
+	})
+	return s.walkedUsage
+}
+
+// Close stops indexing the archive and closes the underlying store.
+func (s *progressStore) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	if c, ok := s.MetadataStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// snapshot copies an entry which is still being indexed.
+func snapshot(fi FileInfo) FileInfo {
+	var n *node
+	switch fi := fi.(type) {
+	case *node:
+		n = fi
+	case *dirNode:
+		// The entries are only listed once the archive was indexed.
+		return &dirNode{node: snapshot(fi.node).(*node)}
+	default:
+		return fi
+	}
+	c := *n
+	stat := *n.stat
+	c.stat = &stat
+	return &c
+}
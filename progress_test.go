@@ -0,0 +1,163 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// gatedReaderAt blocks reads past `gate` until `open` is closed.
+type gatedReaderAt struct {
+	ra   io.ReaderAt
+	size int64
+	gate int64
+	open chan struct{}
+}
+
+func (r *gatedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.gate {
+		<-r.open
+	}
+	return r.ra.ReadAt(p, off)
+}
+
+// newGatedArchive returns an archive where "d/late" is only found once the
+// gate is opened.
+func newGatedArchive(t *testing.T) *gatedReaderAt {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		newTestHeader("a", 0644, 1, now),
+		{Typeflag: tar.TypeLink, Name: "link", Linkname: "d/late", ModTime: now},
+		newTestHeader("d", os.ModeDir|0755, 0, now),
+	} {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("a")[:h.Size])
+	}
+	w.Flush()
+	gate := int64(buf.Len())
+	if err := w.WriteHeader(newTestHeader("d/late", 0644, 4, now)); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("late"))
+	w.Close()
+	return &gatedReaderAt{ra: bytes.NewReader(buf.Bytes()), size: int64(buf.Len()), gate: gate, open: make(chan struct{})}
+}
+
+func TestProgressiveIndexing(t *testing.T) {
+	r := newGatedArchive(t)
+	fs, err := FromReaderAt(r, r.size, NewBTreeStore(2), WithProgressiveIndexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, fs, "a"); string(content) != "a" {
+		t.Fatalf("expected %q, got %q", "a", content)
+	}
+	if _, status := fs.GetAttr("d", &fuse.Context{}); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	statuses := make(map[string]chan fuse.Status)
+	for _, name := range []string{"d/late", "link", "missing"} {
+		c := make(chan fuse.Status, 1)
+		statuses[name] = c
+		go func(name string) {
+			_, status := fs.GetAttr(name, &fuse.Context{})
+			c <- status
+		}(name)
+	}
+	dir := make(chan []fuse.DirEntry, 1)
+	go func() {
+		entries, _ := fs.OpenDir("d", &fuse.Context{})
+		dir <- entries
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	for name, c := range statuses {
+		select {
+		case status := <-c:
+			t.Fatalf("%s: expected lookup to wait, got %v", name, status)
+		default:
+		}
+	}
+	select {
+	case entries := <-dir:
+		t.Fatalf("expected readdir to wait, got %v", entries)
+	case <-Ready(fs):
+		t.Fatal("expected archive not to be indexed")
+	default:
+	}
+
+	close(r.open)
+	if err := WaitIndexed(fs); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]fuse.Status{"d/late": fuse.OK, "link": fuse.OK, "missing": fuse.ENOENT} {
+		if status := <-statuses[name]; status != expected {
+			t.Fatalf("%s: expected %v, got %v", name, expected, status)
+		}
+	}
+	if entries := <-dir; len(entries) != 1 || entries[0].Name != "late" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if attr, _ := fs.GetAttr("link", &fuse.Context{}); attr.Nlink != 2 {
+		t.Fatalf("expected 2 links, got %d", attr.Nlink)
+	}
+	if content := readTestFile(t, fs, "link"); string(content) != "late" {
+		t.Fatalf("expected %q, got %q", "late", content)
+	}
+}
+
+func TestProgressiveIndexingCompressed(t *testing.T) {
+	data := newIndexTestArchive(t)
+	compressed := gzipMembers(t, data, 2)
+	expected, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := FromReaderAt(bytes.NewReader(compressed), int64(len(compressed)), NewBTreeStore(2), WithProgressiveIndexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, fs, "foo/bar"); !bytes.Equal(content, testData(3)) {
+		t.Fatal("content does not match")
+	}
+	<-Ready(fs)
+	if err := WaitIndexed(fs); err != nil {
+		t.Fatal(err)
+	}
+	compareFS(t, expected, fs, "")
+}
+
+func TestProgressiveIndexingError(t *testing.T) {
+	data := testArchive(t, []testEntry{
+		{"x/y", 0644, "y", nil},
+		{"z", 0644, "z", nil},
+	})
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithProgressiveIndexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitIndexed(fs); err == nil {
+		t.Fatal("expected error for missing directory")
+	}
+	// Entries which were found are still served, the missing directory is
+	// not.
+	if content := readTestFile(t, fs, "z"); string(content) != "z" {
+		t.Fatalf("expected %q, got %q", "z", content)
+	}
+	if _, status := fs.GetAttr("x", &fuse.Context{}); status != fuse.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", status)
+	}
+	if names := dirNames(t, fs, ""); names != "z" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+}
@@ -0,0 +1,336 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements support for sparse files.
+// archive/tar expands sparse files when they are read, but it does not expose
+// where the data is stored, so the sparse maps are read from the raw headers
+// instead.
+
+// SparseEntry is a fragment of a sparse file which holds data, everything
+// outside of the fragments of a sparse file is a hole.
+type SparseEntry struct {
+	// Offset is the offset of the fragment in the file.
+	Offset int64
+	// Length is the length of the fragment.
+	Length int64
+}
+
+const (
+	paxGNUSparseMajor = "GNU.sparse.major"
+	paxGNUSparseMinor = "GNU.sparse.minor"
+	paxGNUSparseMap   = "GNU.sparse.map"
+
+	// offsets in old GNU headers
+	gnuSparseOffset     = 386
+	gnuIsExtended       = 482
+	gnuSparseEntries    = 4
+	gnuExtSparseEntries = 21
+	headerSizeOffset    = 124
+	headerTypeOffset    = 156
+)
+
+// sparseMap returns the data fragments of a sparse file, nil is returned if
+// the entry is not a sparse file.
+// `start` is the offset of the first header of the entry, and `pos` the
+// offset after the headers.
+func sparseMap(h *tar.Header, ra io.ReaderAt, start, pos int64) ([]SparseEntry, error) {
+	var (
+		sparse []SparseEntry
+		err    error
+	)
+	// The versions are detected in the same way as archive/tar does it.
+	major, minor := h.PAXRecords[paxGNUSparseMajor], h.PAXRecords[paxGNUSparseMinor]
+	switch {
+	case h.Typeflag == tar.TypeGNUSparse:
+		sparse, err = readOldGNUSparseMap(ra, start)
+	case major == "1" && minor == "0":
+		sparse, err = readGNUSparseMap1x0(ra, start, pos)
+	case major == "0" && (minor == "0" || minor == "1"),
+		major == "" && minor == "" && h.PAXRecords[paxGNUSparseMap] != "":
+		sparse, err = parseSparseNumbers(strings.Split(h.PAXRecords[paxGNUSparseMap], ","), false)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading sparse map for %s", h.Name)
+	}
+	for i, s := range sparse {
+		if s.Offset < 0 || s.Length < 0 || s.Offset+s.Length > h.Size || (i > 0 && s.Offset < sparse[i-1].Offset+sparse[i-1].Length) {
+			return nil, errors.Errorf("invalid sparse map for %s", h.Name)
+		}
+	}
+	if sparse == nil {
+		sparse = []SparseEntry{}
+	}
+	return sparse, nil
+}
+
+// sparseDataSize returns the amount of data stored for a sparse file.
+func sparseDataSize(sparse []SparseEntry) int64 {
+	var n int64
+	for _, s := range sparse {
+		n += s.Length
+	}
+	return n
+}
+
+// seekSparse returns the offset of the next data (SEEK_DATA) or hole
+// (SEEK_HOLE) at or after `off`, as lseek(2) does, in a file of `size` bytes
+// which holds the data fragments in `sparse`. The end of the file counts as a
+// hole.
+func seekSparse(sparse []SparseEntry, size, off int64, whence int) (int64, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= size {
+		return 0, syscall.ENXIO
+	}
+	for _, e := range sparse {
+		if e.Length == 0 || e.Offset+e.Length <= off {
+			continue
+		}
+		switch whence {
+		case unix.SEEK_DATA:
+			if e.Offset > off {
+				return e.Offset, nil
+			}
+			return off, nil
+		case unix.SEEK_HOLE:
+			if e.Offset > off {
+				return off, nil
+			}
+			// The fragments are in order, the hole can only be after
+			// this one.
+			off = e.Offset + e.Length
+		default:
+			return 0, syscall.EINVAL
+		}
+	}
+	switch whence {
+	case unix.SEEK_DATA:
+		return 0, syscall.ENXIO
+	case unix.SEEK_HOLE:
+		if off > size {
+			off = size
+		}
+		return off, nil
+	}
+	return 0, syscall.EINVAL
+}
+
+// mainHeader returns the offset of the header block for the entry at `start`,
+// skipping over any extended headers.
+func mainHeader(ra io.ReaderAt, start int64) (int64, []byte, error) {
+	blk := make([]byte, blockSize)
+	off := start
+	for {
+		if _, err := ra.ReadAt(blk, off); err != nil {
+			return 0, nil, err
+		}
+		switch blk[headerTypeOffset] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseNumeric(blk[headerSizeOffset : headerSizeOffset+12])
+			if err != nil {
+				return 0, nil, err
+			}
+			off += blockSize + blockAlign(size)
+		default:
+			return off, blk, nil
+		}
+	}
+}
+
+func readOldGNUSparseMap(ra io.ReaderAt, start int64) ([]SparseEntry, error) {
+	off, blk, err := mainHeader(ra, start)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	entries := blk[gnuSparseOffset : gnuSparseOffset+gnuSparseEntries*24]
+	extended := blk[gnuIsExtended] != 0
+	for {
+		for i := 0; i+24 <= len(entries); i += 24 {
+			if entries[i] == 0 {
+				break
+			}
+			o, err := parseNumeric(entries[i : i+12])
+			if err != nil {
+				return nil, err
+			}
+			n, err := parseNumeric(entries[i+12 : i+24])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, strconv.FormatInt(o, 10), strconv.FormatInt(n, 10))
+		}
+		if !extended {
+			break
+		}
+		off += blockSize
+		if _, err := ra.ReadAt(blk, off); err != nil {
+			return nil, err
+		}
+		entries = blk[:gnuExtSparseEntries*24]
+		extended = blk[gnuExtSparseEntries*24] != 0
+	}
+	return parseSparseNumbers(fields, false)
+}
+
+// readGNUSparseMap1x0 reads the sparse map of PAX 1.0 sparse files which is
+// stored in front of the file data.
+func readGNUSparseMap1x0(ra io.ReaderAt, start, pos int64) ([]SparseEntry, error) {
+	off, _, err := mainHeader(ra, start)
+	if err != nil {
+		return nil, err
+	}
+	off += blockSize
+	if pos < off {
+		return nil, errors.New("invalid sparse map position")
+	}
+	buf := make([]byte, pos-off)
+	if _, err := ra.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return parseSparseNumbers(strings.Split(string(buf), "\n"), true)
+}
+
+// parseSparseNumbers parses offset and length pairs. If `counted` is set the
+// first number is the number of pairs and anything after the pairs is
+// ignored.
+func parseSparseNumbers(fields []string, counted bool) ([]SparseEntry, error) {
+	if counted {
+		if len(fields) == 0 {
+			return nil, errors.New("missing sparse map size")
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || n < 0 || 2*n > int64(len(fields)-1) {
+			return nil, errors.New("invalid sparse map size")
+		}
+		fields = fields[1 : 1+2*n]
+	}
+	if len(fields) == 1 && fields[0] == "" {
+		return nil, nil
+	}
+	if len(fields)%2 != 0 {
+		return nil, errors.New("odd number of sparse map fields")
+	}
+
+	var sparse []SparseEntry
+	for i := 0; i < len(fields); i += 2 {
+		o, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// archive/tar writes an empty fragment at the end of files which
+			// end in a hole.
+			continue
+		}
+		sparse = append(sparse, SparseEntry{Offset: o, Length: n})
+	}
+	return sparse, nil
+}
+
+// parseNumeric parses a numeric header field, which is either octal or
+// base-256 encoded.
+func parseNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if b[0]&0x40 != 0 {
+			return 0, errors.New("negative number in header")
+		}
+		var n int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if n>>55 != 0 {
+				return 0, errors.New("number in header overflows")
+			}
+			n = n<<8 | int64(c)
+		}
+		return n, nil
+	}
+
+	s := strings.TrimSpace(string(bytes.Trim(b, " \x00")))
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+// sparseReaderAt reads a sparse file, holes are read as zeros.
+type sparseReaderAt struct {
+	ra     io.ReaderAt
+	sparse []SparseEntry
+	// data is the offset in `ra` of each fragment
+	data []int64
+}
+
+func newSparseReaderAt(ra io.ReaderAt, base int64, sparse []SparseEntry) *sparseReaderAt {
+	data := make([]int64, len(sparse))
+	for i, s := range sparse {
+		data[i] = base
+		base += s.Length
+	}
+	return &sparseReaderAt{ra: ra, sparse: sparse, data: data}
+}
+
+// ReadAt reads from the sparse file, it should be wrapped in an
+// io.SectionReader which limits reads to the size of the file.
+func (r *sparseReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	// the first fragment which ends after `off`
+	i := sort.Search(len(r.sparse), func(i int) bool {
+		return r.sparse[i].Offset+r.sparse[i].Length > off
+	})
+
+	n := 0
+	for n < len(p) {
+		if i == len(r.sparse) || off < r.sparse[i].Offset {
+			// hole
+			end := int64(len(p) - n)
+			if i < len(r.sparse) && r.sparse[i].Offset-off < end {
+				end = r.sparse[i].Offset - off
+			}
+			for j := range p[n : n+int(end)] {
+				p[n+j] = 0
+			}
+			n += int(end)
+			off += end
+			continue
+		}
+
+		s := r.sparse[i]
+		end := s.Offset + s.Length - off
+		if end > int64(len(p)-n) {
+			end = int64(len(p) - n)
+		}
+		m, err := r.ra.ReadAt(p[n:n+int(end)], r.data[i]+off-s.Offset)
+		n += m
+		off += int64(m)
+		if err != nil && m < int(end) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		i++
+	}
+	return n, nil
+}
@@ -0,0 +1,310 @@
+package tarfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// archive/tar can't write sparse files, so the test archives are put together
+// from raw header blocks.
+
+func rawHeader(name string, typeflag byte, size int64, gnu bool) []byte {
+	b := make([]byte, blockSize)
+	copy(b, name)
+	copy(b[100:], "0000644\x00")
+	copy(b[108:], "0000000\x00")
+	copy(b[116:], "0000000\x00")
+	copy(b[124:], fmt.Sprintf("%011o\x00", size))
+	copy(b[136:], fmt.Sprintf("%011o\x00", time.Now().Unix()))
+	b[headerTypeOffset] = typeflag
+	if gnu {
+		copy(b[257:], "ustar  \x00")
+	} else {
+		copy(b[257:], "ustar\x0000")
+	}
+	return b
+}
+
+func setChecksum(b []byte) []byte {
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+func padBlock(b []byte) []byte {
+	return append(b, make([]byte, blockAlign(int64(len(b)))-int64(len(b)))...)
+}
+
+func paxHeader(name string, records [][2]string) []byte {
+	var data []byte
+	for _, r := range records {
+		rec := " " + r[0] + "=" + r[1] + "\n"
+		n := len(rec) + len(strconv.Itoa(len(rec)))
+		if len(strconv.Itoa(n)) > len(strconv.Itoa(len(rec))) {
+			n++
+		}
+		data = append(data, strconv.Itoa(n)+rec...)
+	}
+	return append(setChecksum(rawHeader("PaxHeaders/"+name, 'x', int64(len(data)), false)), padBlock(data)...)
+}
+
+// sparseTestData returns the content of a sparse file and the data which is
+// stored in the archive.
+func sparseTestData(size int64, sparse []SparseEntry) ([]byte, []byte) {
+	logical := make([]byte, size)
+	var physical []byte
+	for i, s := range sparse {
+		data := bytes.Repeat([]byte{byte('a' + i)}, int(s.Length))
+		copy(logical[s.Offset:], data)
+		physical = append(physical, data...)
+	}
+	return logical, physical
+}
+
+func sparseNumbers(sparse []SparseEntry) []string {
+	var fields []string
+	for _, s := range sparse {
+		fields = append(fields, strconv.FormatInt(s.Offset, 10), strconv.FormatInt(s.Length, 10))
+	}
+	return fields
+}
+
+func newSparseTestArchive(t *testing.T) ([]byte, map[string][]byte) {
+	const size = 30000
+	// Like GNU tar, only the last fragment is not a multiple of the block size
+	// and the sparse map ends with an empty fragment at the end of the file.
+	sparse := []SparseEntry{{0, 512}, {4096, 1024}, {8192, 1536}, {12288, 512}, {16384, 512}, {20480, 100}, {size, 0}}
+	logical, physical := sparseTestData(size, sparse)
+	files := map[string][]byte{}
+	var buf []byte
+
+	// old GNU format, with the sparse map continued in an extension block
+	h := rawHeader("gnu", 'S', int64(len(physical)), true)
+	for i, s := range sparse[:gnuSparseEntries] {
+		copy(h[gnuSparseOffset+i*24:], fmt.Sprintf("%011o\x00%011o\x00", s.Offset, s.Length))
+	}
+	h[gnuIsExtended] = 1
+	copy(h[483:], fmt.Sprintf("%011o\x00", size))
+	ext := make([]byte, blockSize)
+	for i, s := range sparse[gnuSparseEntries:] {
+		copy(ext[i*24:], fmt.Sprintf("%011o\x00%011o\x00", s.Offset, s.Length))
+	}
+	buf = append(buf, setChecksum(h)...)
+	buf = append(buf, ext...)
+	buf = append(buf, padBlock(physical)...)
+	files["gnu"] = logical
+
+	// PAX 0.1
+	buf = append(buf, paxHeader("pax01", [][2]string{
+		{"GNU.sparse.name", "pax01"},
+		{"GNU.sparse.size", strconv.Itoa(size)},
+		{"GNU.sparse.numblocks", strconv.Itoa(len(sparse))},
+		{"GNU.sparse.map", strings.Join(sparseNumbers(sparse), ",")},
+	})...)
+	buf = append(buf, setChecksum(rawHeader("GNUSparseFile.0/pax01", '0', int64(len(physical)), false))...)
+	buf = append(buf, padBlock(physical)...)
+	files["pax01"] = logical
+
+	// PAX 1.0, where the sparse map is stored in front of the data
+	for _, f := range []struct {
+		name   string
+		sparse []SparseEntry
+	}{
+		{"pax10", sparse},
+		{"holes", []SparseEntry{{size, 0}}},
+	} {
+		logical, physical := sparseTestData(size, f.sparse)
+		m := padBlock([]byte(strings.Join(append([]string{strconv.Itoa(len(f.sparse))}, sparseNumbers(f.sparse)...), "\n") + "\n"))
+		buf = append(buf, paxHeader(f.name, [][2]string{
+			{"GNU.sparse.major", "1"},
+			{"GNU.sparse.minor", "0"},
+			{"GNU.sparse.name", f.name},
+			{"GNU.sparse.realsize", strconv.Itoa(size)},
+		})...)
+		buf = append(buf, setChecksum(rawHeader("GNUSparseFile.0/"+f.name, '0', int64(len(m)+len(physical)), false))...)
+		buf = append(buf, m...)
+		buf = append(buf, padBlock(physical)...)
+		files[f.name] = logical
+	}
+
+	// make sure the entries after the sparse files are found
+	buf = append(buf, setChecksum(rawHeader("after", '0', 5, false))...)
+	buf = append(buf, padBlock([]byte("after"))...)
+	files["after"] = []byte("after")
+
+	return append(buf, make([]byte, 2*blockSize)...), files
+}
+
+func TestSparseFiles(t *testing.T) {
+	data, files := newSparseTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"uncompressed", data},
+		{"gzip", gzipMembers(t, data, 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			index := filepath.Join(dir, tc.name+".idx")
+			rdr := bytes.NewReader(tc.archive)
+			fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithIndexFile(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range files {
+				attr, status := fs.GetAttr(name, &fuse.Context{})
+				if !status.Ok() {
+					t.Fatalf("%s: %v", name, status)
+				}
+				if attr.Size != uint64(len(expected)) {
+					t.Fatalf("%s: expected size %d, got %d", name, len(expected), attr.Size)
+				}
+				if !bytes.Equal(readTestFile(t, fs, name), expected) {
+					t.Fatalf("%s: content does not match", name)
+				}
+			}
+
+			out := bytes.NewBuffer(nil)
+			if err := Export(fs, out, ExportFull); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatal("export does not match the archive")
+			}
+
+			fromIndex, err := FromReaderAt(rdr, rdr.Size(), nil, WithIndexFile(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareFS(t, fs, fromIndex, "")
+		})
+	}
+}
+
+func TestSparseCopyUp(t *testing.T) {
+	data, files := newSparseTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rdr := bytes.NewReader(data)
+	fs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, status := fs.Open("gnu", uint32(os.O_WRONLY), &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+
+	copied, err := ioutil.ReadFile(filepath.Join(dir, "gnu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, files["gnu"]) {
+		t.Fatal("copied up content does not match")
+	}
+}
+
+func TestSparseLseek(t *testing.T) {
+	data, _ := newSparseTestArchive(t)
+	dir, err := ioutil.TempDir("", "tarfs-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type seek struct {
+		name     string
+		whence   int
+		off, pos uint64
+		status   fuse.Status
+	}
+	seeks := []seek{
+		{"gnu", unix.SEEK_DATA, 0, 0, fuse.OK},
+		{"gnu", unix.SEEK_DATA, 600, 4096, fuse.OK},
+		{"gnu", unix.SEEK_DATA, 4100, 4100, fuse.OK},
+		{"gnu", unix.SEEK_DATA, 20580, 0, fuse.Status(syscall.ENXIO)},
+		{"gnu", unix.SEEK_HOLE, 0, 512, fuse.OK},
+		{"gnu", unix.SEEK_HOLE, 4096, 5120, fuse.OK},
+		{"gnu", unix.SEEK_HOLE, 6000, 6000, fuse.OK},
+		{"gnu", unix.SEEK_HOLE, 20500, 20580, fuse.OK},
+		{"gnu", unix.SEEK_HOLE, 30000, 0, fuse.Status(syscall.ENXIO)},
+		{"pax10", unix.SEEK_DATA, 12800, 16384, fuse.OK},
+		{"holes", unix.SEEK_DATA, 0, 0, fuse.Status(syscall.ENXIO)},
+		{"holes", unix.SEEK_HOLE, 0, 0, fuse.OK},
+		{"after", unix.SEEK_DATA, 2, 2, fuse.OK},
+		{"after", unix.SEEK_HOLE, 0, 5, fuse.OK},
+	}
+	lseek := func(t *testing.T, raw fuse.RawFileSystem, s seek) {
+		t.Helper()
+		id := mustLookupNode(t, raw, s.name).NodeId
+		var out fuse.LseekOut
+		status := raw.Lseek(nil, &fuse.LseekIn{InHeader: fuse.InHeader{NodeId: id}, Offset: s.off, Whence: uint32(s.whence)}, &out)
+		if status != s.status {
+			t.Fatalf("%s: seek %d from %d: expected %v, got %v", s.name, s.whence, s.off, s.status, status)
+		}
+		if status.Ok() && out.Offset != s.pos {
+			t.Fatalf("%s: seek %d from %d: expected %d, got %d", s.name, s.whence, s.off, s.pos, out.Offset)
+		}
+	}
+
+	for _, opts := range [][]Opt{nil, {WithUpperDir(dir)}} {
+		rdr := bytes.NewReader(data)
+		tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := newTestNodeFS(t, tfs)
+		for _, s := range seeks {
+			lseek(t, raw, s)
+		}
+	}
+
+	// Files in the upper dir report the holes of the host file.
+	rdr := bytes.NewReader(data)
+	tfs, err := FromReaderAt(rdr, rdr.Size(), NewBTreeStore(2), WithUpperDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := tfs.Chmod("gnu", 0600, &fuse.Context{}); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, err := os.Open(filepath.Join(dir, "gnu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	raw, _ := newTestNodeFS(t, tfs)
+	for _, whence := range []int{unix.SEEK_DATA, unix.SEEK_HOLE} {
+		pos, err := unix.Seek(int(f.Fd()), 600, whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lseek(t, raw, seek{"gnu", whence, 600, uint64(pos), fuse.OK})
+	}
+}
@@ -0,0 +1,386 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements support for stargz and eStargz archives, which are
+// gzip compressed archives with a table of contents (TOC) at the end.
+// The content of every file starts a new gzip member, and the TOC has the
+// offsets of those members, so the archive can be served without scanning it.
+
+const (
+	stargzTOCName = "stargz.index.json"
+	// maxStargzFooterSize is the size of the footer of eStargz archives,
+	// which have the offset of the TOC in an "SG" extra field. Footers of
+	// stargz archives have it as the entire extra field, and are smaller.
+	maxStargzFooterSize = 51
+	// stargzFooterPayloadSize is the size of the offset of the TOC in the
+	// footer, 16 hex digits followed by "STARGZ".
+	stargzFooterPayloadSize = 22
+
+	stargzPrefetchLandmark   = ".prefetch.landmark"
+	stargzNoPrefetchLandmark = ".no.prefetch.landmark"
+
+	// maxStargzChunks is the number of verified chunks which are kept, so
+	// reads of less than a chunk don't need to decompress it again.
+	maxStargzChunks = 8
+)
+
+// errNotStargz is returned for archives which don't have a stargz footer.
+var errNotStargz = errors.New("not a stargz archive")
+
+// stargzTOC is the table of contents of a stargz archive.
+type stargzTOC struct {
+	Version int            `json:"version"`
+	Entries []*stargzEntry `json:"entries"`
+}
+
+// stargzEntry is an entry of the TOC. Files which are split into multiple
+// chunks have an entry of type "chunk" for every chunk after the first.
+type stargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var stargzTypes = map[string]byte{
+	"dir":      tar.TypeDir,
+	"reg":      tar.TypeReg,
+	"symlink":  tar.TypeSymlink,
+	"hardlink": tar.TypeLink,
+	"char":     tar.TypeChar,
+	"block":    tar.TypeBlock,
+	"fifo":     tar.TypeFifo,
+}
+
+// header returns the tar header the entry was created from.
+func (e *stargzEntry) header() (*tar.Header, error) {
+	typ, ok := stargzTypes[e.Type]
+	if !ok {
+		return nil, errors.Errorf("unsupported entry type in TOC: %s", e.Type)
+	}
+	h := &tar.Header{
+		Typeflag: typ,
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+	}
+	if typ == tar.TypeReg {
+		h.Size = e.Size
+	}
+	if e.ModTime != "" {
+		t, err := time.Parse(time.RFC3339, e.ModTime)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modification time for %s", e.Name)
+		}
+		h.ModTime = t
+	}
+	for k, v := range e.Xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[paxSchilyXattr+k] = string(v)
+	}
+	return h, nil
+}
+
+// stargzTOCOffset returns the offset of the TOC from the footer of the
+// archive. The footer is an empty gzip member with the offset in its extra
+// field, the size of the member depends on the compressor which wrote it.
+func stargzTOCOffset(ra io.ReaderAt, size int64) (int64, error) {
+	tail := make([]byte, maxStargzFooterSize)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if _, err := ra.ReadAt(tail, size-int64(len(tail))); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "error reading stargz footer")
+	}
+
+	// The extra field follows the 10 byte gzip header and its 2 byte length.
+	for i := 0; i+12 <= len(tail); i++ {
+		h := tail[i:]
+		if h[0] != gzipID1 || h[1] != gzipID2 || h[2] != gzipDeflate || h[3]&gzipFlagExtra == 0 {
+			continue
+		}
+		xlen := int(binary.LittleEndian.Uint16(h[10:12]))
+		if 12+xlen > len(h) {
+			continue
+		}
+		extra := h[12 : 12+xlen]
+		if len(extra) == 4+stargzFooterPayloadSize && extra[0] == 'S' && extra[1] == 'G' {
+			// eStargz
+			extra = extra[4:]
+		}
+		if len(extra) != stargzFooterPayloadSize || !bytes.HasSuffix(extra, []byte("STARGZ")) {
+			continue
+		}
+		off, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+		if err != nil || off < 0 || off >= size {
+			continue
+		}
+		return off, nil
+	}
+	return 0, errNotStargz
+}
+
+// readStargzTOC reads the TOC, which is stored as the only entry of a tar
+// stream in the gzip member at `off`.
+func readStargzTOC(ra io.ReaderAt, size, off int64) (*stargzTOC, error) {
+	zr, err := gzip.NewReader(io.NewSectionReader(ra, off, size-off))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading stargz TOC")
+	}
+	tr := tar.NewReader(zr)
+	h, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading stargz TOC")
+	}
+	if h.Name != stargzTOCName {
+		return nil, errors.Errorf("unexpected stargz TOC entry: %s", h.Name)
+	}
+	var toc stargzTOC
+	if err := json.NewDecoder(tr).Decode(&toc); err != nil {
+		return nil, errors.Wrap(err, "error decoding stargz TOC")
+	}
+	return &toc, nil
+}
+
+// indexStargz adds the entries from the TOC of a stargz archive to db.
+// `errNotStargz` is returned if the archive is not a stargz archive.
+func indexStargz(ra io.ReaderAt, size int64, db MetadataStore) (*indexedArchive, error) {
+	off, err := stargzTOCOffset(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	toc, err := readStargzTOC(ra, size, off)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithField("entries", len(toc.Entries)).Debug("using stargz TOC")
+
+	x, err := newTarIndexer(db)
+	if err != nil {
+		return nil, err
+	}
+	// The content of the files is laid out one after another in the stream
+	// of the archive, see `stargzReaderAt`.
+	r := &stargzReaderAt{ra: ra, size: off}
+	var (
+		pos  int64
+		file *stargzEntry
+		base int64
+	)
+	for i, e := range toc.Entries {
+		if e.Type == "chunk" {
+			if file == nil || e.Name != file.Name {
+				return nil, errors.Errorf("chunk without file in TOC: %s", e.Name)
+			}
+			if err := r.addChunk(file, e, base); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file = nil
+		switch strings.TrimPrefix(e.Name, "./") {
+		case stargzPrefetchLandmark, stargzNoPrefetchLandmark:
+			continue
+		}
+
+		h, err := e.header()
+		if err != nil {
+			return nil, err
+		}
+		// The index in the TOC is used as the header offset, which keeps the
+		// order of the archive for `Export`.
+		if err := x.add(h, int64(i), pos, int64(i), nil); err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && e.Size > 0 {
+			file, base = e, pos
+			if err := r.addChunk(file, e, base); err != nil {
+				return nil, err
+			}
+			pos += e.Size
+		}
+	}
+
+	// Parent directories don't need to be in the TOC.
+	next := int64(len(toc.Entries))
+	for len(x.missingDirs) != 0 {
+		var missing []string
+		for key := range x.missingDirs {
+			missing = append(missing, key)
+		}
+		sort.Strings(missing)
+		for _, key := range missing {
+			h := &tar.Header{Typeflag: tar.TypeDir, Name: strings.TrimPrefix(key, "/") + "/", Mode: 0755}
+			if err := x.add(h, next, pos, next, nil); err != nil {
+				return nil, err
+			}
+			next++
+		}
+	}
+	if err := x.finish(); err != nil {
+		return nil, err
+	}
+	sort.Slice(r.chunks, func(i, j int) bool {
+		return r.chunks[i].off < r.chunks[j].off
+	})
+	return &indexedArchive{stream: r, size: pos, toc: true}, nil
+}
+
+// stargzChunk is a chunk of a file in a stargz archive.
+type stargzChunk struct {
+	// off is the offset of the chunk in the stream, see `stargzReaderAt`.
+	off  int64
+	size int64
+	// gzipOffset is the offset of the gzip member the chunk starts in.
+	gzipOffset int64
+	digest     string
+}
+
+// stargzReaderAt reads the content of files in a stargz archive.
+// The content of all files is laid out one after another in the order of the
+// TOC, this is the stream the data offsets of the entries refer to.
+// Chunks are verified against their digests from the TOC.
+type stargzReaderAt struct {
+	ra io.ReaderAt
+	// size is the size of the compressed archive up to the TOC.
+	size   int64
+	chunks []stargzChunk
+
+	mu       sync.Mutex
+	verified []*verifiedChunk
+}
+
+type verifiedChunk struct {
+	off  int64
+	data []byte
+}
+
+// addChunk adds the chunk described by `e` of a file which starts at offset
+// `base` of the stream.
+func (r *stargzReaderAt) addChunk(file, e *stargzEntry, base int64) error {
+	size := e.ChunkSize
+	if size == 0 {
+		size = file.Size - e.ChunkOffset
+	}
+	if e.ChunkOffset < 0 || size <= 0 || e.ChunkOffset+size > file.Size || e.Offset < 0 || e.Offset >= r.size {
+		return errors.Errorf("invalid chunk in TOC for %s at %d", file.Name, e.ChunkOffset)
+	}
+	digest := e.ChunkDigest
+	if digest == "" && e.ChunkOffset == 0 && size == file.Size {
+		// stargz archives only have the digest of the entire file.
+		digest = file.Digest
+	}
+	r.chunks = append(r.chunks, stargzChunk{
+		off:        base + e.ChunkOffset,
+		size:       size,
+		gzipOffset: e.Offset,
+		digest:     digest,
+	})
+	return nil
+}
+
+// chunk returns the verified content of a chunk.
+func (r *stargzReaderAt) chunk(c stargzChunk) ([]byte, error) {
+	r.mu.Lock()
+	for i, v := range r.verified {
+		if v.off == c.off {
+			copy(r.verified[1:i+1], r.verified[:i])
+			r.verified[0] = v
+			r.mu.Unlock()
+			return v.data, nil
+		}
+	}
+	r.mu.Unlock()
+
+	zr, err := gzip.NewReader(io.NewSectionReader(r.ra, c.gzipOffset, r.size-c.gzipOffset))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading chunk at %d", c.gzipOffset)
+	}
+	data := make([]byte, c.size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, errors.Wrapf(err, "error reading chunk at %d", c.gzipOffset)
+	}
+	if c.digest != "" {
+		if !strings.HasPrefix(c.digest, "sha256:") {
+			return nil, errors.Errorf("unsupported digest: %s", c.digest)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != strings.TrimPrefix(c.digest, "sha256:") {
+			err := errors.Wrapf(errVerification, "chunk at %d", c.gzipOffset)
+			logrus.WithError(err).Error("error verifying stargz chunk")
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	r.verified = append([]*verifiedChunk{{off: c.off, data: data}}, r.verified...)
+	if len(r.verified) > maxStargzChunks {
+		r.verified = r.verified[:maxStargzChunks]
+	}
+	r.mu.Unlock()
+	return data, nil
+}
+
+func (r *stargzReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		i := sort.Search(len(r.chunks), func(i int) bool {
+			return r.chunks[i].off+r.chunks[i].size > off
+		})
+		if i == len(r.chunks) {
+			return n, io.EOF
+		}
+		c := r.chunks[i]
+		if c.off > off {
+			return n, errors.Errorf("no chunk for offset %d", off)
+		}
+		data, err := r.chunk(c)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], data[off-c.off:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
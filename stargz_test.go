@@ -0,0 +1,270 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// switchWriter writes to the current gzip member of a stargz archive.
+type switchWriter struct {
+	w io.Writer
+}
+
+func (w *switchWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// stargzOpts configures the archives written by `newStargz`.
+type stargzOpts struct {
+	chunkSize int64
+	legacy    bool
+	// badDigest is the name of a file which gets a wrong chunk digest
+	badDigest string
+}
+
+// newStargz writes an eStargz archive the way the stargz-snapshotter does,
+// with every chunk of file content in a new gzip member.
+func newStargz(t *testing.T, headers []*tar.Header, content map[string][]byte, opts stargzOpts) []byte {
+	buf := bytes.NewBuffer(nil)
+	sw := &switchWriter{}
+	gz := gzip.NewWriter(buf)
+	sw.w = gz
+	tw := tar.NewWriter(sw)
+	newMember := func() {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		gz = gzip.NewWriter(buf)
+		sw.w = gz
+	}
+
+	var toc stargzTOC
+	for _, h := range headers {
+		data := content[h.Name]
+		h.Size = int64(len(data))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		e := &stargzEntry{
+			Name:     h.Name,
+			Mode:     h.Mode,
+			ModTime:  h.ModTime.Format(time.RFC3339),
+			LinkName: h.Linkname,
+			UID:      h.Uid,
+			GID:      h.Gid,
+			Size:     h.Size,
+		}
+		for typ, flag := range stargzTypes {
+			if flag == h.Typeflag {
+				e.Type = typ
+			}
+		}
+		if h.Typeflag != tar.TypeReg || len(data) == 0 {
+			toc.Entries = append(toc.Entries, e)
+			continue
+		}
+
+		e.Digest = sha256Digest(data)
+		for off := int64(0); off < int64(len(data)); off += opts.chunkSize {
+			end := off + opts.chunkSize
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			newMember()
+			chunk := e
+			if off > 0 {
+				chunk = &stargzEntry{Name: h.Name, Type: "chunk"}
+			}
+			chunk.Offset = int64(buf.Len())
+			chunk.ChunkOffset = off
+			if end-off == opts.chunkSize {
+				chunk.ChunkSize = opts.chunkSize
+			}
+			chunk.ChunkDigest = sha256Digest(data[off:end])
+			if h.Name == opts.badDigest {
+				chunk.ChunkDigest = sha256Digest(nil)
+			}
+			if opts.legacy {
+				chunk.ChunkDigest = ""
+			}
+			toc.Entries = append(toc.Entries, chunk)
+			if _, err := tw.Write(data[off:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	newMember()
+	tocOff := int64(buf.Len())
+	tocData, err := json.Marshal(&toc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: stargzTOCName, Mode: 0644, Size: int64(len(tocData))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(tocData)
+	tw.Close()
+	gz.Close()
+
+	footer, _ := gzip.NewWriterLevel(buf, gzip.NoCompression)
+	payload := fmt.Sprintf("%016xSTARGZ", tocOff)
+	if opts.legacy {
+		footer.Header.Extra = []byte(payload)
+	} else {
+		extra := []byte{'S', 'G', 0, 0}
+		binary.LittleEndian.PutUint16(extra[2:], uint16(len(payload)))
+		footer.Header.Extra = append(extra, payload...)
+	}
+	footer.Close()
+	return buf.Bytes()
+}
+
+func stargzTestHeaders() ([]*tar.Header, map[string][]byte) {
+	now := time.Now().Truncate(time.Second)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: stargzPrefetchLandmark, Mode: 0644, ModTime: now},
+		{Typeflag: tar.TypeReg, Name: "a/b/big", Mode: 0644, ModTime: now},
+		{Typeflag: tar.TypeReg, Name: "a/small", Mode: 0600, Uid: 1000, ModTime: now},
+		{Typeflag: tar.TypeReg, Name: "a/empty", Mode: 0644, ModTime: now},
+		{Typeflag: tar.TypeSymlink, Name: "a/link", Linkname: "b/big", Mode: 0777, ModTime: now},
+		{Typeflag: tar.TypeLink, Name: "a/hardlink", Linkname: "a/small", ModTime: now},
+		{Typeflag: tar.TypeDir, Name: "c/", Mode: 0750, ModTime: now},
+	}
+	content := map[string][]byte{
+		stargzPrefetchLandmark: {0xf},
+		"a/b/big":              testData(2500),
+		"a/small":              []byte("small"),
+	}
+	return headers, content
+}
+
+func TestStargz(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		headers, content := stargzTestHeaders()
+		data := newStargz(t, headers, content, stargzOpts{chunkSize: 1000, legacy: legacy})
+		fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{stargzTOCName, stargzPrefetchLandmark} {
+			if _, status := fs.GetAttr(name, &fuse.Context{}); status != fuse.ENOENT {
+				t.Fatalf("expected %s to be hidden, got %v", name, status)
+			}
+		}
+		for _, tc := range []struct {
+			name  string
+			mode  uint32
+			nlink uint32
+		}{
+			{"a", fuse.S_IFDIR | 0755, 3},
+			{"a/b", fuse.S_IFDIR | 0755, 2},
+			{"a/small", fuse.S_IFREG | 0600, 2},
+			{"a/link", fuse.S_IFLNK | 0777, 1},
+			{"c", fuse.S_IFDIR | 0750, 2},
+		} {
+			attr, status := fs.GetAttr(tc.name, &fuse.Context{})
+			if !status.Ok() {
+				t.Fatalf("%s: %v", tc.name, status)
+			}
+			if attr.Mode != tc.mode || attr.Nlink != tc.nlink {
+				t.Fatalf("%s: expected mode %o and %d links, got %o and %d", tc.name, tc.mode, tc.nlink, attr.Mode, attr.Nlink)
+			}
+		}
+		if attr, _ := fs.GetAttr("a/small", &fuse.Context{}); attr.Uid != 1000 {
+			t.Fatalf("expected uid 1000, got %d", attr.Uid)
+		}
+
+		big := content["a/b/big"]
+		for _, tc := range []struct {
+			name    string
+			off, n  int64
+			content []byte
+		}{
+			{"a/b/big", 0, 2500, big},
+			{"a/b/big", 900, 200, big[900:1100]},
+			{"a/b/big", 2400, 100, big[2400:]},
+			{"a/small", 0, 5, []byte("small")},
+			{"a/hardlink", 0, 5, []byte("small")},
+		} {
+			got, status := readVerified(fs, tc.name, tc.off, tc.n)
+			if !status.Ok() {
+				t.Fatalf("%s: %v", tc.name, status)
+			}
+			if !bytes.Equal(got, tc.content) {
+				t.Fatalf("%s: content at %d does not match", tc.name, tc.off)
+			}
+		}
+		if target, status := fs.Readlink("a/link", &fuse.Context{}); !status.Ok() || target != "b/big" {
+			t.Fatalf("expected link to b/big, got %q, %v", target, status)
+		}
+	}
+}
+
+func TestStargzDigests(t *testing.T) {
+	headers, content := stargzTestHeaders()
+	data := newStargz(t, headers, content, stargzOpts{chunkSize: 1000, badDigest: "a/b/big"})
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := readVerified(fs, "a/b/big", 0, 100); status != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", status)
+	}
+	if _, status := readVerified(fs, "a/small", 0, 5); !status.Ok() {
+		t.Fatal(status)
+	}
+}
+
+func TestStargzExport(t *testing.T) {
+	headers, content := stargzTestHeaders()
+	data := newStargz(t, headers, content, stargzOpts{chunkSize: 1000})
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, entries := readExport(t, fs, ExportFull)
+	if names := entryNames(entries); names != "a/b/big,a/small,a/empty,a/link,a/hardlink,c/,a/,a/b/" {
+		t.Fatalf("unexpected entries: %s", names)
+	}
+	if entries[0].data != string(content["a/b/big"]) {
+		t.Fatal("content does not match")
+	}
+	if h := entries[4].hdr; h.Typeflag != tar.TypeLink || h.Linkname != "a/small" {
+		t.Fatalf("expected hard link to a/small, got %c %s", h.Typeflag, h.Linkname)
+	}
+}
+
+func TestStargzFooter(t *testing.T) {
+	// The footer as written by older compressors, with an empty stored
+	// block.
+	footer := []byte{gzipID1, gzipID2, gzipDeflate, gzipFlagExtra, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, "0000000000000400STARGZ"...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	if len(footer) != maxStargzFooterSize {
+		t.Fatalf("expected footer of %d bytes, got %d", maxStargzFooterSize, len(footer))
+	}
+	data := append(make([]byte, 2048), footer...)
+	off, err := stargzTOCOffset(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != 1024 {
+		t.Fatalf("expected TOC at 1024, got %d", off)
+	}
+
+	data = gzipMembers(t, testArchive(t, []testEntry{{"file", 0644, "data", nil}}), 1)
+	if _, err := stargzTOCOffset(bytes.NewReader(data), int64(len(data))); err != errNotStargz {
+		t.Fatalf("expected errNotStargz, got %v", err)
+	}
+}
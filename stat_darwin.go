@@ -5,6 +5,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
@@ -13,9 +14,9 @@ func fillStatSys(t *StatT, fi os.FileInfo) {
 	case *unix.Stat_t:
 		t.Owner.UID = sys.Uid
 		t.Owner.GID = sys.Gid
-		t.Mtime = time.Unix(sys.Mtimespec.Sec, sys.Mtimespec.Nsec)
-		t.Atime = time.Unix(sys.Atimespec.Sec, sys.Atimespec.Nsec)
-		t.Ctime = time.Unix(sys.Ctimespec.Sec, sys.Ctimespec.Nsec)
+		t.Mtime = time.Unix(sys.Mtim.Unix())
+		t.Atime = time.Unix(sys.Atim.Unix())
+		t.Ctime = time.Unix(sys.Ctim.Unix())
 	case *syscall.Stat_t:
 		t.Owner.UID = sys.Uid
 		t.Owner.GID = sys.Gid
@@ -24,3 +25,23 @@ func fillStatSys(t *StatT, fi os.FileInfo) {
 		t.Ctime = time.Unix(sys.Ctimespec.Sec, sys.Ctimespec.Nsec)
 	}
 }
+
+func setXattr(path, attr string, data []byte) error {
+	return syscall.ENOTSUP
+}
+
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setBlksize does nothing, fuse on darwin has no block size attribute.
+func setBlksize(attr *fuse.Attr, size uint32) {}
+
+// fileID returns the inode number and link count from the system specific
+// stat info.
+func fileID(fi os.FileInfo) (ino uint64, nlink uint64) {
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return sys.Ino, uint64(sys.Nlink)
+	}
+	return 0, 0
+}
@@ -2,9 +2,11 @@ package tarfs
 
 import (
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
@@ -24,3 +26,47 @@ func fillStatSys(t *StatT, fi os.FileInfo) {
 		t.Ctime = time.Unix(sys.Ctim.Sec, sys.Ctim.Nsec)
 	}
 }
+
+func setXattr(path, attr string, data []byte) error {
+	return unix.Setxattr(path, attr, data, 0)
+}
+
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := unix.Getxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, size)
+		size, err = unix.Getxattr(path, attr, v)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[attr] = v[:size]
+	}
+	return xattrs, nil
+}
+
+func setBlksize(attr *fuse.Attr, size uint32) {
+	attr.Blksize = size
+}
+
+// fileID returns the inode number and link count from the system specific
+// stat info.
+func fileID(fi os.FileInfo) (ino uint64, nlink uint64) {
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return sys.Ino, uint64(sys.Nlink)
+	}
+	return 0, 0
+}
@@ -0,0 +1,276 @@
+package tarfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// This file implements the verification of file contents, see `WithManifest`
+// and `WithComputedDigests`.
+
+// verifyChunkSize is the size of the chunks file contents are verified in.
+const verifyChunkSize = 64 << 10
+
+// errVerification is returned for reads of content which does not match its
+// digest.
+var errVerification = errors.New("content does not match digest")
+
+// Manifest maps the paths of the regular files of an archive to the digests
+// of their content, in the form `sha256:<hex>`.
+type Manifest map[string]string
+
+// WithManifest verifies the content of files against the passed in manifest.
+// Opening or reading files which don't match the manifest, or which are not
+// in it, fails with EIO.
+//
+// The first time a file is opened the entire file is read and verified, and
+// the digests of its chunks are recorded. Reads only verify the chunks they
+// read.
+func WithManifest(m Manifest) Opt {
+	return func(c *config) {
+		c.manifest = m
+	}
+}
+
+// WithComputedDigests computes the digests of the content of files while the
+// archive is indexed, and verifies reads against those. This detects content
+// which changed after the archive was indexed, e.g. in a remote archive.
+// Combined with `WithManifest` the computed digests are checked against the
+// manifest instead of reading the files again.
+//
+// Index files (see `WithIndexFile`) don't store digests, so the archive is
+// always indexed when this is set. stargz archives are verified against the
+// digests in their table of contents instead.
+func WithComputedDigests() Opt {
+	return func(c *config) {
+		c.computeDigests = true
+	}
+}
+
+// fileDigest holds the digests of the content of a file.
+type fileDigest struct {
+	// sum is the digest of the entire file
+	sum    string
+	chunks [][]byte
+}
+
+// contentDigests are the digests of the regular files of an archive, by the
+// data offset of the files.
+type contentDigests map[int64]*fileDigest
+
+// digestContent computes the digests of a file.
+func digestContent(r io.Reader) (*fileDigest, error) {
+	fd := &fileDigest{}
+	h := sha256.New()
+	buf := make([]byte, verifyChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n]) // nolint: errcheck
+			sum := sha256.Sum256(buf[:n])
+			fd.chunks = append(fd.chunks, sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	fd.sum = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return fd, nil
+}
+
+// verifier checks the content of files which are read.
+type verifier struct {
+	manifest map[string]string
+
+	mu    sync.Mutex
+	files map[int64]*verifiedFile
+}
+
+// verifiedFile holds the digests of a file, which are checked against the
+// manifest when the file is first read.
+type verifiedFile struct {
+	once sync.Once
+	fd   *fileDigest
+	err  error
+}
+
+func newVerifier(manifest Manifest) *verifier {
+	v := &verifier{files: make(map[int64]*verifiedFile)}
+	if manifest != nil {
+		v.manifest = make(map[string]string, len(manifest))
+		for p, d := range manifest {
+			v.manifest[headerNameEntry(p)] = d
+		}
+	}
+	return v
+}
+
+// add adds the digests which were computed while indexing.
+func (v *verifier) add(digests contentDigests) {
+	v.mu.Lock()
+	for off, fd := range digests {
+		v.files[off] = &verifiedFile{fd: fd}
+	}
+	v.mu.Unlock()
+}
+
+// digests returns the verified chunk digests of a file. `content` is only
+// read if the file was not verified yet.
+func (v *verifier) digests(name string, off int64, content io.Reader) (*fileDigest, error) {
+	v.mu.Lock()
+	f, ok := v.files[off]
+	if !ok {
+		f = &verifiedFile{}
+		v.files[off] = f
+	}
+	v.mu.Unlock()
+
+	f.once.Do(func() {
+		if v.manifest == nil {
+			if f.fd == nil {
+				f.err = errors.Errorf("no digest for %s", name)
+			}
+			return
+		}
+		expected, ok := v.manifest[headerNameEntry(name)]
+		if !ok {
+			f.err = errors.Errorf("%s is not in the manifest", name)
+			return
+		}
+		if !strings.HasPrefix(expected, "sha256:") {
+			f.err = errors.Errorf("unsupported digest for %s: %s", name, expected)
+			return
+		}
+		if f.fd == nil {
+			fd, err := digestContent(content)
+			if err != nil {
+				f.err = errors.Wrapf(err, "error reading %s", name)
+				return
+			}
+			f.fd = fd
+		}
+		if f.fd.sum != expected {
+			f.err = errors.Wrapf(errVerification, "%s: expected %s, got %s", name, expected, f.fd.sum)
+		}
+	})
+	if f.err != nil {
+		logrus.WithError(f.err).WithField("name", name).Error("error verifying file")
+		return nil, f.err
+	}
+	return f.fd, nil
+}
+
+// verifiedReaderAt reads the content of a file and verifies each chunk which
+// is read.
+type verifiedReaderAt struct {
+	v    *verifier
+	name string
+	// off is the data offset of the file, which identifies its digests.
+	off  int64
+	size int64
+	ra   io.ReaderAt
+
+	// last is the last chunk which was verified, which is kept for
+	// sequential reads of less than a chunk.
+	mu        sync.Mutex
+	last      int64
+	lastChunk []byte
+}
+
+func newVerifiedReaderAt(v *verifier, name string, off, size int64, ra io.ReaderAt) *verifiedReaderAt {
+	return &verifiedReaderAt{v: v, name: name, off: off, size: size, ra: ra, last: -1}
+}
+
+// chunk returns the verified content of a chunk.
+func (r *verifiedReaderAt) chunk(fd *fileDigest, i int64) ([]byte, error) {
+	r.mu.Lock()
+	if r.last == i {
+		data := r.lastChunk
+		r.mu.Unlock()
+		return data, nil
+	}
+	r.mu.Unlock()
+
+	if i >= int64(len(fd.chunks)) {
+		return nil, errors.Wrapf(errVerification, "%s: no digest for chunk %d", r.name, i)
+	}
+	n := r.size - i*verifyChunkSize
+	if n > verifyChunkSize {
+		n = verifyChunkSize
+	}
+	data := make([]byte, n)
+	if _, err := r.ra.ReadAt(data, i*verifyChunkSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], fd.chunks[i]) {
+		err := errors.Wrapf(errVerification, "%s: chunk %d", r.name, i)
+		logrus.WithError(err).WithField("name", r.name).Error("error verifying file")
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.last, r.lastChunk = i, data
+	r.mu.Unlock()
+	return data, nil
+}
+
+func (r *verifiedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	fd, err := r.v.digests(r.name, r.off, io.NewSectionReader(r.ra, 0, r.size))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for n < len(p) && off < r.size {
+		i := off / verifyChunkSize
+		data, err := r.chunk(fd, i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-i*verifyChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// verifyFile verifies the content of an entry against the manifest, if the
+// server verifies file contents. This is done when files are opened, reads of
+// the content are verified anyway but empty files are never read.
+func (s *server) verifyFile(fi FileInfo) error {
+	if !s.verified(fi) {
+		return nil
+	}
+	_, err := s.verify.digests(fi.Name(), dataOffset(fi), s.rawData(fi))
+	return err
+}
+
+// verified returns whether the content of an entry is verified by the server.
+// Layers indexed from a table of contents verify their content themselves,
+// those are only verified if there is a manifest.
+func (s *server) verified(fi FileInfo) bool {
+	if s.verify == nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	if n := asNode(fi); n != nil && n.layer < len(s.layers) && s.layers[n.layer].toc {
+		return s.verify.manifest != nil
+	}
+	return true
+}
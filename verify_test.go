@@ -0,0 +1,172 @@
+package tarfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readVerified opens a file and reads n bytes at off, and returns the status
+// of the open or the read.
+func readVerified(fs pathfs.FileSystem, name string, off, n int64) ([]byte, fuse.Status) {
+	f, status := fs.Open(name, uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		return nil, status
+	}
+	p := make([]byte, n)
+	rr, status := f.Read(p, off)
+	if !status.Ok() {
+		return nil, status
+	}
+	data, _ := rr.Bytes(p)
+	rr.Done()
+	return data, status
+}
+
+var verifyTestContent = testData(3*verifyChunkSize + 100)
+
+func newVerifyTestArchive(t *testing.T) []byte {
+	return testArchive(t, []testEntry{
+		{"dir", os.ModeDir | 0755, "", nil},
+		{"dir/big", 0644, string(verifyTestContent), nil},
+		{"small", 0644, "small", nil},
+		{"empty", 0644, "", nil},
+	})
+}
+
+// corrupt changes a byte of the big file in the archive.
+func corrupt(t *testing.T, data []byte, off int64) {
+	i := bytes.Index(data, verifyTestContent)
+	if i < 0 {
+		t.Fatal("content not found in archive")
+	}
+	data[int64(i)+off] ^= 0xff
+}
+
+func TestManifest(t *testing.T) {
+	data := newVerifyTestArchive(t)
+	manifest := Manifest{
+		"dir/big": sha256Digest(verifyTestContent),
+		"./small": sha256Digest([]byte("small")),
+		"empty":   sha256Digest(nil),
+	}
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithManifest(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, status := readVerified(fs, "dir/big", 100, 2*verifyChunkSize)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if !bytes.Equal(content, verifyTestContent[100:100+2*verifyChunkSize]) {
+		t.Fatal("content does not match")
+	}
+	if content, status := readVerified(fs, "small", 0, 5); !status.Ok() || string(content) != "small" {
+		t.Fatalf("expected %q, got %q, %v", "small", content, status)
+	}
+	if _, status := readVerified(fs, "empty", 0, 100); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	// After the first read only the chunks which are read are verified.
+	corrupt(t, data, 2*verifyChunkSize+10)
+	if _, status := readVerified(fs, "dir/big", 0, 100); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := readVerified(fs, "dir/big", 2*verifyChunkSize, 100); status != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", status)
+	}
+
+	manifest = Manifest{
+		"dir/big": sha256Digest(verifyTestContent),
+		"small":   sha256Digest([]byte("other")),
+	}
+	fs, err = FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithManifest(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/big", "small", "empty"} {
+		if _, status := readVerified(fs, name, 0, 100); status != fuse.EIO {
+			t.Fatalf("%s: expected EIO, got %v", name, status)
+		}
+	}
+}
+
+func TestComputedDigests(t *testing.T) {
+	data := newVerifyTestArchive(t)
+	fs, err := FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithComputedDigests())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, data, verifyChunkSize+10)
+
+	if content, status := readVerified(fs, "small", 0, 5); !status.Ok() || string(content) != "small" {
+		t.Fatalf("expected %q, got %q, %v", "small", content, status)
+	}
+	if _, status := readVerified(fs, "dir/big", 0, 100); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := readVerified(fs, "dir/big", verifyChunkSize, 100); status != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", status)
+	}
+
+	// computed digests are checked against the manifest
+	data = newVerifyTestArchive(t)
+	manifest := Manifest{
+		"dir/big": sha256Digest([]byte("other")),
+		"small":   sha256Digest([]byte("small")),
+	}
+	fs, err = FromReaderAt(bytes.NewReader(data), int64(len(data)), NewBTreeStore(2), WithComputedDigests(), WithManifest(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := readVerified(fs, "small", 0, 100); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := readVerified(fs, "dir/big", 0, 100); status != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", status)
+	}
+}
+
+func TestComputedDigestsLayers(t *testing.T) {
+	lower := testArchive(t, []testEntry{
+		{"a", 0644, "a", nil},
+		{"b", 0644, "b", nil},
+	})
+	upper := testArchive(t, []testEntry{
+		{"b", 0644, "b2", nil},
+		{"c", 0644, "c", nil},
+	})
+	fs, err := FromLayers([]Layer{
+		{ReaderAt: bytes.NewReader(lower), Size: int64(len(lower))},
+		{ReaderAt: bytes.NewReader(upper), Size: int64(len(upper))},
+	}, NewBTreeStore(2), WithComputedDigests())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"a": "a", "b": "b2", "c": "c"} {
+		content, status := readVerified(fs, name, 0, int64(len(expected)))
+		if !status.Ok() {
+			t.Fatalf("%s: %v", name, status)
+		}
+		if string(content) != expected {
+			t.Fatalf("%s: expected %q, got %q", name, expected, content)
+		}
+	}
+
+	upper[bytes.Index(upper, []byte("b2"))] = 'x'
+	if _, status := readVerified(fs, "b", 0, 10); status != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", status)
+	}
+}
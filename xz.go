@@ -0,0 +1,168 @@
+package tarfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The blocks of an xz stream are compressed independently, and the index at
+// the end of each stream lists their sizes. A block is decompressed on its own
+// by passing it to the xz reader as a stream with only the blocks from that
+// one on.
+
+const (
+	xzHeaderSize = 12
+	xzFooterSize = 12
+)
+
+var xzFooterMagic = []byte{'Y', 'Z'}
+
+// xzStream is a stream of an xz file, which can contain multiple streams.
+type xzStream struct {
+	// start is the offset of the stream header, index the offset of the
+	// index and end the offset after the stream footer.
+	start, index, end int64
+	flags             []byte
+	blocks            []xzBlock
+}
+
+type xzBlock struct {
+	// in is the offset of the block header in the file, out the offset of
+	// the block content in the uncompressed data.
+	in, out int64
+	// unpadded and uncompressed are the sizes from the index record.
+	unpadded, uncompressed int64
+}
+
+// readXzIndex reads the indexes of the streams of an xz file, starting with
+// the last stream.
+func readXzIndex(ra io.ReaderAt, size int64) ([]xzStream, error) {
+	var streams []xzStream
+	end := size
+	for end > 0 {
+		var pad [4]byte
+		if end < int64(len(pad)) {
+			return nil, errors.New("truncated xz stream")
+		}
+		if _, err := ra.ReadAt(pad[:], end-int64(len(pad))); err != nil {
+			return nil, errors.Wrap(err, "error reading xz footer")
+		}
+		if pad == [4]byte{} {
+			// stream padding
+			end -= int64(len(pad))
+			continue
+		}
+		s, err := readXzStream(ra, end)
+		if err != nil {
+			return nil, err
+		}
+		streams = append([]xzStream{s}, streams...)
+		end = s.start
+	}
+
+	var out int64
+	for _, s := range streams {
+		for i := range s.blocks {
+			s.blocks[i].out = out
+			out += s.blocks[i].uncompressed
+		}
+	}
+	return streams, nil
+}
+
+// readXzStream reads the footer and index of the stream which ends at `end`.
+func readXzStream(ra io.ReaderAt, end int64) (xzStream, error) {
+	s := xzStream{end: end}
+	if end < xzHeaderSize+xzFooterSize {
+		return s, errors.New("truncated xz stream")
+	}
+	footer := make([]byte, xzFooterSize)
+	if _, err := ra.ReadAt(footer, end-xzFooterSize); err != nil {
+		return s, errors.Wrap(err, "error reading xz footer")
+	}
+	if !bytes.Equal(footer[10:], xzFooterMagic) || crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+		return s, errors.New("invalid xz stream footer")
+	}
+	s.flags = footer[8:10]
+
+	size := (int64(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+	s.index = end - xzFooterSize - size
+	if s.index < xzHeaderSize {
+		return s, errors.New("invalid xz index size")
+	}
+	index := make([]byte, size)
+	if _, err := ra.ReadAt(index, s.index); err != nil {
+		return s, errors.Wrap(err, "error reading xz index")
+	}
+	if index[0] != 0 || crc32.ChecksumIEEE(index[:size-4]) != binary.LittleEndian.Uint32(index[size-4:]) {
+		return s, errors.New("invalid xz index")
+	}
+
+	r := bytes.NewReader(index[1 : size-4])
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(size) {
+		return s, errors.New("invalid xz index")
+	}
+	blocks := make([]xzBlock, n)
+	var blocksSize int64
+	for i := range blocks {
+		unpadded, err := binary.ReadUvarint(r)
+		if err != nil {
+			return s, errors.New("invalid xz index record")
+		}
+		uncompressed, err := binary.ReadUvarint(r)
+		if err != nil {
+			return s, errors.New("invalid xz index record")
+		}
+		blocks[i] = xzBlock{unpadded: int64(unpadded), uncompressed: int64(uncompressed)}
+		blocksSize += (int64(unpadded) + 3) &^ 3
+	}
+
+	s.start = s.index - blocksSize - xzHeaderSize
+	if s.start < 0 {
+		return s, errors.New("invalid xz index")
+	}
+	header := make([]byte, xzHeaderSize)
+	if _, err := ra.ReadAt(header, s.start); err != nil {
+		return s, errors.Wrap(err, "error reading xz header")
+	}
+	if !bytes.HasPrefix(header, magicXz) || !bytes.Equal(header[6:8], s.flags) {
+		return s, errors.New("xz stream header does not match its index")
+	}
+	in := s.start + xzHeaderSize
+	for i := range blocks {
+		blocks[i].in = in
+		in += (blocks[i].unpadded + 3) &^ 3
+	}
+	s.blocks = blocks
+	return s, nil
+}
+
+// tail returns a stream with the blocks of s starting at block `i`.
+func (s *xzStream) tail(ra io.ReaderAt, i int) io.Reader {
+	header := append(append([]byte{}, magicXz...), s.flags...)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(s.flags))
+
+	index := []byte{0}
+	index = binary.AppendUvarint(index, uint64(len(s.blocks)-i))
+	for _, b := range s.blocks[i:] {
+		index = binary.AppendUvarint(index, uint64(b.unpadded))
+		index = binary.AppendUvarint(index, uint64(b.uncompressed))
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, s.flags...)
+	footer = append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(footer)), footer...)
+	footer = append(footer, xzFooterMagic...)
+
+	blocks := io.NewSectionReader(ra, s.blocks[i].in, s.index-s.blocks[i].in)
+	return io.MultiReader(bytes.NewReader(header), blocks, bytes.NewReader(index), bytes.NewReader(footer))
+}